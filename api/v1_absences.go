@@ -0,0 +1,189 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/markuskjeldsen/mop-backend-api/internal"
+	"github.com/markuskjeldsen/mop-backend-api/middleware"
+	"github.com/markuskjeldsen/mop-backend-api/models"
+)
+
+// a konsulent manages their own absences, the office manages everyones
+func canManageAbsences(actingUser models.User, userID uint) bool {
+	return actingUser.ID == userID || middleware.HasPermission(actingUser.Rights, middleware.PermUsersAbsences)
+}
+
+// absenceUser reads the user id from the path and checks the acting user may manage their absences
+func absenceUser(c *gin.Context) (models.User, uint, bool) {
+	actingUser, _ := getVerifyUser(c)
+	userID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return actingUser, 0, false
+	}
+	if !canManageAbsences(actingUser, uint(userID)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot manage the absences of another user"})
+		return actingUser, 0, false
+	}
+	return actingUser, uint(userID), true
+}
+
+type absenceBody struct {
+	Type      models.AbsenceType `json:"type" binding:"required"`
+	StartDate string             `json:"start_date" binding:"required"` // 2006-01-02
+	EndDate   string             `json:"end_date" binding:"required"`
+	Note      string             `json:"note"`
+}
+
+func bindAbsence(c *gin.Context, absence *models.Absence) bool {
+	var body absenceBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	start, err1 := time.Parse("2006-01-02", body.StartDate)
+	end, err2 := time.Parse("2006-01-02", body.EndDate)
+	if err1 != nil || err2 != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid date format. Use YYYY-MM-DD"})
+		return false
+	}
+	absence.Type = body.Type
+	absence.StartDate = start
+	absence.EndDate = end
+	absence.Note = body.Note
+	return true
+}
+
+func absenceResponse(c *gin.Context, status int, absence models.Absence, err error) {
+	var validationErr internal.ValidationError
+	if errors.As(err, &validationErr) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(status, absence)
+}
+
+// GET /users/:id/absences?from=2024-07-01&to=2024-07-31
+// leave out from and to for every absence
+func GetAbsences(c *gin.Context) {
+	_, userID, ok := absenceUser(c)
+	if !ok {
+		return
+	}
+
+	from, ok := dateQuery(c, "from")
+	if !ok {
+		return
+	}
+	to, ok := dateQuery(c, "to")
+	if !ok {
+		return
+	}
+
+	absences, err := internal.Absences(userID, from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, absences)
+}
+
+// POST /users/:id/absences
+// type is vacation, sick, blocked or other, both dates are included
+func CreateAbsence(c *gin.Context) {
+	actingUser, userID, ok := absenceUser(c)
+	if !ok {
+		return
+	}
+	absence := models.Absence{UserID: userID}
+	if !bindAbsence(c, &absence) {
+		return
+	}
+	absence, err := internal.CreateAbsence(actingUser, absence)
+	absenceResponse(c, http.StatusCreated, absence, err)
+}
+
+// PATCH /users/:id/absences/:absenceId
+func UpdateAbsence(c *gin.Context) {
+	actingUser, userID, ok := absenceUser(c)
+	if !ok {
+		return
+	}
+	absenceID, err := strconv.ParseUint(c.Param("absenceId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	previous, err := internal.FindAbsence(userID, uint(absenceID))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Absence not found"})
+		return
+	}
+
+	absence := previous
+	if !bindAbsence(c, &absence) {
+		return
+	}
+	absence, err = internal.UpdateAbsence(actingUser, previous, absence)
+	absenceResponse(c, http.StatusOK, absence, err)
+}
+
+// DELETE /users/:id/absences/:absenceId
+func DeleteAbsence(c *gin.Context) {
+	actingUser, userID, ok := absenceUser(c)
+	if !ok {
+		return
+	}
+	absenceID, err := strconv.ParseUint(c.Param("absenceId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	absence, err := internal.FindAbsence(userID, uint(absenceID))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Absence not found"})
+		return
+	}
+
+	if err := internal.DeleteAbsence(actingUser, absence); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// GET /availability?date=2024-07-01&postnr=8000
+// the konsulenter who can take visits on the day, postnr is optional
+func GetAvailability(c *gin.Context) {
+	date, err := time.Parse("2006-01-02", c.Query("date"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "date is required. Use YYYY-MM-DD"})
+		return
+	}
+	postnr := 0
+	if q := c.Query("postnr"); q != "" {
+		if postnr, err = strconv.Atoi(q); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid postnr"})
+			return
+		}
+	}
+
+	free, err := internal.FreeKonsulenter(date, postnr)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"date":        date.Format("2006-01-02"),
+		"postnr":      postnr,
+		"konsulenter": free,
+	})
+}
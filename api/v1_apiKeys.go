@@ -0,0 +1,90 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/markuskjeldsen/mop-backend-api/initializers"
+	"github.com/markuskjeldsen/mop-backend-api/internal"
+	"github.com/markuskjeldsen/mop-backend-api/middleware"
+	"github.com/markuskjeldsen/mop-backend-api/models"
+	"gorm.io/gorm"
+)
+
+// GET /apikeys
+// every key including revoked and expired ones, the keys themselves cannot be read again
+func GetAPIKeys(c *gin.Context) {
+	var keys []models.APIKey
+	if err := initializers.DB.Order("created_at DESC").Find(&keys).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, keys)
+}
+
+// POST /apikeys
+// the key is in the response this one time, leave out expires_at for a key that does not expire
+func CreateAPIKey(c *gin.Context) {
+	actingUser, _ := getVerifyUser(c)
+
+	var body struct {
+		Name        string     `json:"name" binding:"required"`
+		Permissions []string   `json:"permissions" binding:"required"`
+		ExpiresAt   *time.Time `json:"expires_at"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if len(body.Permissions) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "an api key needs at least one permission"})
+		return
+	}
+	for _, p := range body.Permissions {
+		if !middleware.APIKeyPermission(middleware.Permission(p)) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "an api key cannot have the permission " + p})
+			return
+		}
+	}
+	if body.ExpiresAt != nil && body.ExpiresAt.Before(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at is in the past"})
+		return
+	}
+
+	key, apiKey, err := internal.CreateAPIKey(actingUser, body.Name, body.Permissions, body.ExpiresAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "store the key now, it cannot be shown again",
+		"key":     key,
+		"api_key": apiKey,
+	})
+}
+
+// DELETE /apikeys/:id
+func RevokeAPIKey(c *gin.Context) {
+	actingUser, _ := getVerifyUser(c)
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	apiKey, err := internal.RevokeAPIKey(actingUser, uint(id))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, apiKey)
+}
@@ -0,0 +1,149 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/markuskjeldsen/mop-backend-api/initializers"
+	"github.com/markuskjeldsen/mop-backend-api/internal"
+	"github.com/markuskjeldsen/mop-backend-api/models"
+	"gorm.io/gorm"
+)
+
+// GET /bans
+// the active bans, ?all=true also returns the ones that have expired or been lifted. ?kind=ip or ?kind=username filters
+func GetBans(c *gin.Context) {
+	query := initializers.DB.Order("created_at DESC")
+	if c.Query("all") != "true" {
+		query = query.Where("lifted_at IS NULL AND (expires_at IS NULL OR expires_at > ?)", time.Now())
+	}
+	if kind := c.Query("kind"); kind != "" {
+		query = query.Where("kind = ?", kind)
+	}
+
+	var bans []models.Ban
+	if err := query.Find(&bans).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, bans)
+}
+
+// POST /bans
+// bans an ip or username by hand, leave out minutes to ban until it is lifted
+func CreateBan(c *gin.Context) {
+	actingUser, _ := getVerifyUser(c)
+
+	var body struct {
+		Kind    models.BanKind `json:"kind" binding:"required"`
+		Value   string         `json:"value" binding:"required"`
+		Reason  string         `json:"reason"`
+		Minutes int            `json:"minutes"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if body.Minutes < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "minutes cannot be negative"})
+		return
+	}
+
+	ban, err := internal.CreateBan(actingUser, body.Kind, body.Value, body.Reason, time.Duration(body.Minutes)*time.Minute)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, ban)
+}
+
+// DELETE /bans/:id
+// lifts the ban, the ban itself is kept so it still shows with ?all=true
+func LiftBan(c *gin.Context) {
+	actingUser, _ := getVerifyUser(c)
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	ban, err := internal.LiftBan(actingUser, uint(id))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Ban not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, ban)
+}
+
+// GET /allowlist
+func GetAllowlist(c *gin.Context) {
+	var entries []models.AllowlistEntry
+	if err := initializers.DB.Order("created_at DESC").Find(&entries).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, entries)
+}
+
+// POST /allowlist
+// takes a single ip or a cidr range, e.g. the office network
+func CreateAllowlistEntry(c *gin.Context) {
+	actingUser, _ := getVerifyUser(c)
+
+	var body struct {
+		CIDR string `json:"cidr" binding:"required"`
+		Note string `json:"note"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	cidr, err := internal.ParseAllowlistCIDR(body.CIDR)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	entry := models.AllowlistEntry{CIDR: cidr, Note: body.Note, CreatedByID: actingUser.ID}
+	if err := initializers.DB.Create(&entry).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "Error with Database",
+			"error":  err.Error(),
+		})
+		return
+	}
+	internal.InvalidateBanCache()
+
+	c.JSON(http.StatusCreated, entry)
+}
+
+// DELETE /allowlist/:id
+func DeleteAllowlistEntry(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	// deleted for good, so the same range can be added again later
+	result := initializers.DB.Unscoped().Delete(&models.AllowlistEntry{}, id)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error.Error()})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Allowlist entry not found"})
+		return
+	}
+	internal.InvalidateBanCache()
+
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,195 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/markuskjeldsen/mop-backend-api/initializers"
+	"github.com/markuskjeldsen/mop-backend-api/internal"
+	"github.com/markuskjeldsen/mop-backend-api/middleware"
+	"github.com/markuskjeldsen/mop-backend-api/models"
+	"gorm.io/gorm"
+)
+
+type takeOutFunc func(tx *gorm.DB, actingUser models.User, can internal.PermissionCheck, visitID uint, code string, note string) (models.VisitCancellation, error)
+
+// takeOutVisit is the shared part of cancelling and postponing a visit
+func takeOutVisit(c *gin.Context, takeOut takeOutFunc) {
+	actingUser, _ := getVerifyUser(c)
+	visitID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	var body struct {
+		ReasonCode string `json:"reason_code" binding:"required"`
+		Note       string `json:"note"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	can := func(permission string) bool {
+		return middleware.Allowed(c, middleware.Permission(permission))
+	}
+	var cancellation models.VisitCancellation
+	err = initializers.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		cancellation, err = takeOut(tx, actingUser, can, uint(visitID), body.ReasonCode, body.Note)
+		return err
+	})
+	var validationErr internal.ValidationError
+	if errors.As(err, &validationErr) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		transitionErrorResponse(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, cancellation)
+}
+
+// POST /visits/:id/cancel
+// the visit is kept with the cancelled status and the reason, e.g. paid_in_full
+func CancelVisit(c *gin.Context) {
+	takeOutVisit(c, internal.CancelVisit)
+}
+
+// POST /visits/:id/postpone
+// sends a planned visit back to planning, e.g. because the konsulent is sick
+func PostponeVisit(c *gin.Context) {
+	takeOutVisit(c, internal.PostponeVisit)
+}
+
+// GET /visits/:id/cancellations
+// every time the visit was cancelled or postponed, newest first
+func GetVisitCancellations(c *gin.Context) {
+	var cancellations []models.VisitCancellation
+	err := initializers.DB.Preload("ReasonCode").
+		Where("visit_id = ?", c.Param("id")).
+		Order("created_at DESC").
+		Find(&cancellations).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, cancellations)
+}
+
+// GET /visits/cancellations/report?kind=cancel&from=2024-01-01&to=2024-12-31
+// how many visits were cancelled, per client and reason and per reason alone
+func GetCancellationReport(c *gin.Context) {
+	kind := models.ReasonKind(c.DefaultQuery("kind", string(models.ReasonCancel)))
+	if !internal.ValidReasonKind(kind) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "kind must be cancel or postpone"})
+		return
+	}
+	from, ok := dateQuery(c, "from")
+	if !ok {
+		return
+	}
+	to, ok := dateQuery(c, "to")
+	if !ok {
+		return
+	}
+
+	byClient, byReason, err := internal.CancellationReport(kind, from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"kind":      kind,
+		"by_client": byClient,
+		"by_reason": byReason,
+	})
+}
+
+// GET /visits/reasons?kind=cancel
+// the active reason codes, ?all=true includes those that are turned off
+func GetReasonCodes(c *gin.Context) {
+	query := initializers.DB
+	if c.Query("all") != "true" {
+		query = query.Where("active = ?", true)
+	}
+	if kind := c.Query("kind"); kind != "" {
+		query = query.Where("kind = ?", kind)
+	}
+	var reasons []models.VisitReasonCode
+	if err := query.Order("kind, code").Find(&reasons).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, reasons)
+}
+
+func bindReasonCode(c *gin.Context, reason *models.VisitReasonCode) bool {
+	var body struct {
+		Code   string            `json:"code" binding:"required"`
+		Text   string            `json:"text" binding:"required"`
+		Kind   models.ReasonKind `json:"kind" binding:"required"`
+		Active *bool             `json:"active"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	if !internal.ValidReasonKind(body.Kind) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "kind must be cancel or postpone"})
+		return false
+	}
+	reason.Code = body.Code
+	reason.Text = body.Text
+	reason.Kind = body.Kind
+	reason.Active = body.Active == nil || *body.Active
+	return true
+}
+
+// POST /visits/reasons
+func CreateReasonCode(c *gin.Context) {
+	var reason models.VisitReasonCode
+	if !bindReasonCode(c, &reason) {
+		return
+	}
+	if err := initializers.DB.Create(&reason).Error; err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "a reason with that code already exists"})
+		return
+	}
+	c.JSON(http.StatusCreated, reason)
+}
+
+// PUT /visits/reasons/:id
+func UpdateReasonCode(c *gin.Context) {
+	var reason models.VisitReasonCode
+	if err := initializers.DB.First(&reason, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Reason not found"})
+		return
+	}
+	if !bindReasonCode(c, &reason) {
+		return
+	}
+	if err := initializers.DB.Save(&reason).Error; err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "a reason with that code already exists"})
+		return
+	}
+	c.JSON(http.StatusOK, reason)
+}
+
+// DELETE /visits/reasons/:id
+// turns the reason off, the cancellations that used it keep it
+func DeleteReasonCode(c *gin.Context) {
+	result := initializers.DB.Model(&models.VisitReasonCode{}).Where("id = ?", c.Param("id")).Update("active", false)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error.Error()})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Reason not found"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/markuskjeldsen/mop-backend-api/initializers"
+	"github.com/markuskjeldsen/mop-backend-api/internal"
+	"github.com/markuskjeldsen/mop-backend-api/models"
+	"gorm.io/gorm"
+)
+
+// followUpErrorResponse sends the error of accepting or dismissing a proposal with a fitting status
+func followUpErrorResponse(c *gin.Context, err error) {
+	var validationErr internal.ValidationError
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Proposal not found"})
+	case errors.Is(err, internal.ErrFollowUpDecided), errors.As(err, &validationErr):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// GET /followups?status=pending&visitId=12
+// the queue of proposed follow-up visits, pending ones unless ?status says otherwise
+func GetFollowUps(c *gin.Context) {
+	status := models.FollowUpStatus(c.DefaultQuery("status", string(models.FollowUpPending)))
+	query := initializers.DB.Preload("Visit").Preload("Visit.Debitors").Where("status = ?", status)
+	if visitID := c.Query("visitId"); visitID != "" {
+		query = query.Where("visit_id = ?", visitID)
+	}
+
+	var proposals []models.FollowUpProposal
+	if err := query.Order("created_at").Find(&proposals).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, proposals)
+}
+
+// POST /followups/:id/accept
+// creates the follow-up visit as not planned, an escalation is only marked as handled
+func AcceptFollowUp(c *gin.Context) {
+	actingUser, _ := getVerifyUser(c)
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	proposal, visit, err := internal.AcceptFollowUp(actingUser, uint(id))
+	if err != nil {
+		followUpErrorResponse(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"proposal": proposal, "visit": visit})
+}
+
+// POST /followups/:id/dismiss
+func DismissFollowUp(c *gin.Context) {
+	actingUser, _ := getVerifyUser(c)
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	proposal, err := internal.DismissFollowUp(actingUser, uint(id), body.Reason)
+	if err != nil {
+		followUpErrorResponse(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, proposal)
+}
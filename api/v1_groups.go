@@ -97,7 +97,7 @@ func ChangeGroupId(c *gin.Context) {
 		if input.TargetGroupId != nil {
 			groupLogVal = fmt.Sprintf("%v", *input.TargetGroupId)
 		}
-		if err := internal.UpdateVisitValue(tx, uint(visitID), groupLogVal, adminUser.ID, "group_id"); err != nil {
+		if err := internal.UpdateVisitValue(tx, uint(visitID), groupLogVal, adminUser, "group_id"); err != nil {
 			return err
 		}
 
@@ -133,7 +133,8 @@ func ChangeGroupDate(c *gin.Context) {
 	}
 
 	var input struct {
-		NewDate string `json:"newDate"`
+		NewDate  string `json:"newDate"`
+		Override bool   `json:"override"` // plan it even though the konsulent is away that day
 	}
 	if err := c.ShouldBindJSON(&input); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "New date is required"})
@@ -157,15 +158,30 @@ func ChangeGroupDate(c *gin.Context) {
 			return errors.New("no visits found in group")
 		}
 
+		// the visits of a group can have more than one konsulent, each of them has to be free on the new date
+		checked := map[uint]bool{}
+		for _, v := range visits {
+			if checked[v.UserID] {
+				continue
+			}
+			checked[v.UserID] = true
+			if err := internal.CheckAvailable(tx, user, v.UserID, parsedDate, input.Override); err != nil {
+				return err
+			}
+		}
+
 		for _, v := range visits {
 			if v.StatusID == 3 {
 				return errors.New("cannot change date: letter has already been sent for one or more visits in this group")
 			}
+			if err := internal.CheckVisitDate(tx, v, parsedDate); err != nil {
+				return err
+			}
 		}
 
 		newDateStr := parsedDate.Format(time.RFC3339)
 		for _, v := range visits {
-			if err := internal.UpdateVisitValue(tx, v.ID, newDateStr, user.ID, "visit_date"); err != nil {
+			if err := internal.UpdateVisitValue(tx, v.ID, newDateStr, user, "visit_date"); err != nil {
 				return err
 			}
 		}
@@ -173,6 +189,14 @@ func ChangeGroupDate(c *gin.Context) {
 		return tx.Model(&models.Visit{}).Where("group_id = ?", groupId).Update("visit_date", parsedDate).Error
 	})
 
+	if unavailableResponse(c, err) {
+		return
+	}
+	var validationErr internal.ValidationError
+	if errors.As(err, &validationErr) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -237,7 +261,7 @@ func RemoveFromGroup(c *gin.Context) {
 
 		// 2. Log for each visit (BEFORE the update)
 		for _, v := range visits {
-			err := internal.UpdateVisitValue(tx, v.ID, fmt.Sprintf("%d", newGroupID), user.ID, "group_id")
+			err := internal.UpdateVisitValue(tx, v.ID, fmt.Sprintf("%d", newGroupID), user, "group_id")
 			if err != nil {
 				return err
 			}
@@ -282,6 +306,7 @@ func ChangeKonsulent(c *gin.Context) {
 	// 3. Get the new Konsulent (User ID) from request body
 	var input struct {
 		NewUserID uint `json:"newUserId" binding:"required"`
+		Override  bool `json:"override"` // assign it even though the konsulent is away that day
 	}
 	if err := c.ShouldBindJSON(&input); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "NewUserID is required"})
@@ -300,6 +325,19 @@ func ChangeKonsulent(c *gin.Context) {
 			return errors.New("no visits found in this group")
 		}
 
+		// the new konsulent has to be free on every day the group has visits
+		checked := map[string]bool{}
+		for _, v := range visits {
+			day := v.VisitDate.Format("2006-01-02")
+			if v.VisitDate.IsZero() || checked[day] {
+				continue
+			}
+			checked[day] = true
+			if err := internal.CheckAvailable(tx, adminUser, input.NewUserID, v.VisitDate, input.Override); err != nil {
+				return err
+			}
+		}
+
 		// B. Log the change for every visit in the group
 		for _, v := range visits {
 			// Skip logging if the konsulent is already the same
@@ -311,7 +349,7 @@ func ChangeKonsulent(c *gin.Context) {
 				tx,
 				v.ID,
 				fmt.Sprintf("%v", input.NewUserID),
-				adminUser.ID,
+				adminUser,
 				"user_id",
 			)
 			if err != nil {
@@ -332,12 +370,16 @@ func ChangeKonsulent(c *gin.Context) {
 		return nil
 	})
 
+	if unavailableResponse(c, err) {
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"message": "Every visit in the group has been assigned to the new konsulent",
+		"message":  "Every visit in the group has been assigned to the new konsulent",
+		"warnings": groupWarnings(uint(groupId)),
 	})
 }
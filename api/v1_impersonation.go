@@ -0,0 +1,92 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/markuskjeldsen/mop-backend-api/initializers"
+	"github.com/markuskjeldsen/mop-backend-api/internal"
+	"github.com/markuskjeldsen/mop-backend-api/models"
+)
+
+// getRealUser is the developer behind an impersonation, or the acting user when nobody is being impersonated
+func getRealUser(c *gin.Context) (models.User, bool) {
+	if u, ok := c.Get("realUser"); ok {
+		if user, ok := u.(models.User); ok {
+			return user, true
+		}
+	}
+	return getVerifyUser(c)
+}
+
+// POST /impersonation
+// the rest of the session acts as the user until it expires or DELETE /impersonation is called
+func StartImpersonation(c *gin.Context) {
+	realUser, _ := getRealUser(c)
+	sessionID, ok := getSessionID(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "impersonation needs a login session"})
+		return
+	}
+
+	var body struct {
+		UserID  uint   `json:"user_id" binding:"required"`
+		Reason  string `json:"reason" binding:"required"`
+		Minutes int    `json:"minutes"` // default 30, at most 120
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var target models.User
+	if err := initializers.DB.First(&target, body.UserID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	impersonation, err := internal.StartImpersonation(realUser, target, sessionID, body.Reason, time.Duration(body.Minutes)*time.Minute)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	target.Password = ""
+	c.JSON(http.StatusOK, gin.H{
+		"message":       "acting as " + target.Username,
+		"impersonation": impersonation,
+		"user":          target,
+	})
+}
+
+// GET /impersonation
+// lets the frontend show a banner while a developer is acting as someone else
+func GetImpersonation(c *gin.Context) {
+	sessionID, _ := getSessionID(c)
+	impersonation, ok := internal.ActiveImpersonation(sessionID)
+	if !ok {
+		c.JSON(http.StatusOK, gin.H{"active": false})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"active":        true,
+		"impersonation": impersonation,
+	})
+}
+
+// DELETE /impersonation
+func EndImpersonation(c *gin.Context) {
+	realUser, _ := getRealUser(c)
+	sessionID, _ := getSessionID(c)
+
+	impersonation, ok := internal.EndImpersonation(realUser, sessionID)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "not acting as another user"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message":       "back as " + realUser.Username,
+		"impersonation": impersonation,
+	})
+}
@@ -0,0 +1,167 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/markuskjeldsen/mop-backend-api/initializers"
+	"github.com/markuskjeldsen/mop-backend-api/internal"
+	"github.com/markuskjeldsen/mop-backend-api/middleware"
+	"github.com/markuskjeldsen/mop-backend-api/models"
+	"gorm.io/gorm"
+)
+
+// GET /users/:id/profile
+// a konsulent can see their own profile, the office can see everyones
+func GetKonsulentProfile(c *gin.Context) {
+	actingUser, _ := getVerifyUser(c)
+	userID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	if actingUser.ID != uint(userID) && !middleware.HasPermission(actingUser.Rights, middleware.PermUsersRead) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot see the profile of another user"})
+		return
+	}
+
+	profile, ok := internal.KonsulentProfile(uint(userID))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "the user has no konsulent profile"})
+		return
+	}
+	c.JSON(http.StatusOK, profile)
+}
+
+// PUT /users/:id/profile
+// creates or replaces the profile, working hours and regions that are left out are removed
+func SaveKonsulentProfile(c *gin.Context) {
+	actingUser, _ := getVerifyUser(c)
+
+	var user models.User
+	if err := initializers.DB.First(&user, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	var body models.KonsulentProfile
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	profile, err := internal.SaveKonsulentProfile(actingUser, user.ID, body)
+	var validationErr internal.ValidationError
+	if errors.As(err, &validationErr) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, profile)
+}
+
+// DELETE /users/:id/profile
+func DeleteKonsulentProfile(c *gin.Context) {
+	actingUser, _ := getVerifyUser(c)
+	userID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	err = internal.DeleteKonsulentProfile(actingUser, uint(userID))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "the user has no konsulent profile"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// GET /visits/group/:groupId/check?userId=2
+// checks a konsulent against a group before it is given to them, without the userId the current konsulent is checked
+func CheckGroupAssignment(c *gin.Context) {
+	groupId, err := strconv.ParseUint(c.Param("groupId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Group ID"})
+		return
+	}
+
+	var visits []models.Visit
+	if err := initializers.DB.Where("group_id = ?", groupId).Find(&visits).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(visits) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no visits found in this group"})
+		return
+	}
+
+	userID := visits[0].UserID
+	if q := c.Query("userId"); q != "" {
+		id, err := strconv.ParseUint(q, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid userId"})
+			return
+		}
+		userID = uint(id)
+	}
+
+	warnings, err := internal.CheckAssignment(userID, visits[0].VisitDate, visits)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"user_id":  userID,
+		"warnings": warnings,
+	})
+}
+
+// groupWarnings checks the visits of a group after they have been assigned, the assignment is kept either way
+func groupWarnings(groupId uint) []internal.AssignmentWarning {
+	var visits []models.Visit
+	initializers.DB.Where("group_id = ?", groupId).Find(&visits)
+	if len(visits) == 0 {
+		return []internal.AssignmentWarning{}
+	}
+	warnings, err := internal.CheckAssignment(visits[0].UserID, visits[0].VisitDate, visits)
+	if err != nil {
+		return []internal.AssignmentWarning{}
+	}
+	return warnings
+}
+
+// unavailableResponse responds with 409 and the absences when err is an internal.UnavailableError
+func unavailableResponse(c *gin.Context, err error) bool {
+	var unavailable internal.UnavailableError
+	if !errors.As(err, &unavailable) {
+		return false
+	}
+	c.JSON(http.StatusConflict, gin.H{
+		"error":    err.Error(),
+		"absences": unavailable.Absences,
+	})
+	return true
+}
+
+// checkAvailable responds with 409 and the absences when the konsulent is away on the day and it was not overridden
+func checkAvailable(c *gin.Context, actingUser models.User, userID uint, date time.Time, override bool) bool {
+	err := internal.CheckAvailable(initializers.DB, actingUser, userID, date, override)
+	if err != nil {
+		if !unavailableResponse(c, err) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return false
+	}
+	return true
+}
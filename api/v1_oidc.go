@@ -0,0 +1,104 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"github.com/markuskjeldsen/mop-backend-api/internal"
+	"github.com/markuskjeldsen/mop-backend-api/middleware"
+	"github.com/markuskjeldsen/mop-backend-api/models"
+)
+
+// binds the login to the browser that started it, so a stolen callback url cannot log someone else in
+const oidcStateCookie = "oidc_state"
+
+// GET /oidc
+// tells the frontend whether to show the single sign-on button
+func OIDCStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"enabled": internal.OIDCEnabled()})
+}
+
+// GET /oidc/login?redirect=/path
+// sends the browser to the identity provider, the redirect is the frontend path to return to after the login
+func OIDCLogin(c *gin.Context) {
+	if !internal.OIDCEnabled() {
+		c.JSON(http.StatusNotFound, gin.H{"error": internal.ErrOIDCDisabled.Error()})
+		return
+	}
+
+	authURL, state, err := internal.BeginOIDCLogin(c.Request.Context(), c.Query("redirect"))
+	if err != nil {
+		fmt.Println(err.Error())
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+
+	// lax, the cookie has to come along when the identity provider redirects back
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, state, int(internal.OIDCStateTTL.Seconds()), refreshCookiePath, os.Getenv("DOMAIN"), true, true)
+	c.Redirect(http.StatusFound, authURL)
+}
+
+// oidcFailed sends the browser back to the login page of the frontend with the reason
+func oidcFailed(c *gin.Context, user models.User, reason string) {
+	recordLoginStep(c, user, models.LoginStepOIDC, false, reason)
+	c.Redirect(http.StatusFound, os.Getenv("FRONTEND_URL")+"/login?sso_error="+url.QueryEscape(reason))
+}
+
+// GET /oidc/callback
+// the identity provider sends the browser here, the session cookies are set and the browser goes on to the frontend
+func OIDCCallback(c *gin.Context) {
+	if !internal.OIDCEnabled() {
+		c.JSON(http.StatusNotFound, gin.H{"error": internal.ErrOIDCDisabled.Error()})
+		return
+	}
+
+	state := c.Query("state")
+	cookieState, _ := c.Cookie(oidcStateCookie)
+	c.SetCookie(oidcStateCookie, "", -1, refreshCookiePath, os.Getenv("DOMAIN"), true, true)
+
+	if idpError := c.Query("error"); idpError != "" {
+		oidcFailed(c, models.User{}, "identity provider: "+idpError)
+		return
+	}
+	if state == "" || state != cookieState {
+		oidcFailed(c, models.User{}, internal.ErrOIDCState.Error())
+		return
+	}
+
+	user, redirectTo, err := internal.FinishOIDCLogin(c.Request.Context(), state, c.Query("code"), middleware.MFARequired)
+	var linkErr *internal.OIDCLinkError
+	if errors.As(err, &linkErr) {
+		// the subject goes in the log, so an administrator can link it to the user
+		recordLoginStep(c, linkErr.User, models.LoginStepOIDC, false, "not linked, subject "+linkErr.Subject)
+		c.Redirect(http.StatusFound, os.Getenv("FRONTEND_URL")+"/login?sso_error="+url.QueryEscape(err.Error()))
+		return
+	}
+	if err != nil {
+		fmt.Println(err.Error())
+		reason := err.Error()
+		if !errors.Is(err, internal.ErrOIDCState) && !errors.Is(err, internal.ErrOIDCNoRights) && !errors.Is(err, internal.ErrOIDCNoAccount) && !errors.Is(err, internal.ErrUserInactive) {
+			reason = "single sign-on failed"
+		}
+		oidcFailed(c, models.User{}, reason)
+		return
+	}
+
+	// two factor is left to the identity provider, accounts with it here are only linked by an administrator
+	tokens, err := internal.CreateSession(user, c.ClientIP(), c.Request.UserAgent())
+	if err != nil {
+		oidcFailed(c, user, "failure to create token")
+		return
+	}
+	if _, err := setSessionCookies(c, tokens); err != nil {
+		oidcFailed(c, user, "failure to create token")
+		return
+	}
+
+	recordLoginStep(c, user, models.LoginStepOIDC, true, "None")
+	c.Redirect(http.StatusFound, os.Getenv("FRONTEND_URL")+redirectTo)
+}
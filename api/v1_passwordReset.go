@@ -0,0 +1,151 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/markuskjeldsen/mop-backend-api/initializers"
+	"github.com/markuskjeldsen/mop-backend-api/internal"
+	"github.com/markuskjeldsen/mop-backend-api/models"
+)
+
+// passwordPolicyResponse writes every rule the password broke, so the frontend can show them next to the field
+func passwordPolicyResponse(c *gin.Context, err error) {
+	var policyErr *internal.PasswordPolicyError
+	if errors.As(err, &policyErr) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":      "password does not meet the policy",
+			"violations": policyErr.Violations,
+		})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
+
+// GET /password/policy
+func GetPasswordPolicy(c *gin.Context) {
+	c.JSON(http.StatusOK, internal.Policy)
+}
+
+// POST /password/forgot
+// mails a reset link to the user. The response is the same whether or not the user exists,
+// so the endpoint cannot be used to find out which usernames are taken.
+func ForgotPassword(c *gin.Context) {
+	attemptID, _ := c.Get("attemptID")
+
+	var body struct {
+		Username string `json:"username" binding:"required"`
+	}
+	if err := c.ShouldBindBodyWithJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var user models.User
+	initializers.DB.First(&user, "username = ?", body.Username)
+
+	// the link is made and mailed after the response, so a user that exists is not answered slower than one that does not
+	c.JSON(http.StatusOK, gin.H{"message": "if the user exists and has an email, a reset link has been sent"})
+	ip := c.ClientIP()
+	passwordResetMails.Add(1)
+	go func() {
+		defer passwordResetMails.Done()
+		sendPasswordReset(user, ip, attemptID)
+	}()
+}
+
+// passwordResetMails are the reset links still being sent
+var passwordResetMails sync.WaitGroup
+
+// sendPasswordReset mails the link and notes on the login attempt how it went
+func sendPasswordReset(user models.User, ip string, attemptID interface{}) {
+	if user.ID == 0 {
+		initializers.DB.Model(&models.LoginAttempt{}).
+			Where("id = ?", attemptID).
+			Update("failure_reason", "User does not exist")
+		return
+	}
+
+	if err := internal.SendPasswordReset(user, ip); err != nil {
+		fmt.Println(err.Error())
+		initializers.DB.Model(&models.LoginAttempt{}).
+			Where("id = ?", attemptID).
+			Updates(map[string]interface{}{"user_id": user.ID, "failure_reason": err.Error()})
+		return
+	}
+
+	initializers.DB.Model(&models.LoginAttempt{}).
+		Where("id = ?", attemptID).
+		Updates(map[string]interface{}{"user_id": user.ID, "failure_reason": "None", "successful": true})
+}
+
+// POST /password/reset
+// sets a new password with the token from the mail, and logs the user out everywhere
+func ResetPassword(c *gin.Context) {
+	attemptID, _ := c.Get("attemptID")
+
+	var body struct {
+		Token       string `json:"token" binding:"required"`
+		NewPassword string `json:"new_password" binding:"required"`
+	}
+	if err := c.ShouldBindBodyWithJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid payload"})
+		return
+	}
+
+	user, err := internal.PeekPasswordReset(body.Token)
+	if err != nil {
+		initializers.DB.Model(&models.LoginAttempt{}).
+			Where("id = ?", attemptID).
+			Update("failure_reason", "Invalid token")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// check the password before the token is used, so a rejected password does not burn the link
+	if err := internal.ValidatePassword(initializers.DB, user, body.NewPassword); err != nil {
+		initializers.DB.Model(&models.LoginAttempt{}).
+			Where("id = ?", attemptID).
+			Updates(map[string]interface{}{"user_id": user.ID, "failure_reason": "Weak password"})
+		passwordPolicyResponse(c, err)
+		return
+	}
+
+	user, err = internal.ConsumePasswordReset(body.Token)
+	if err != nil {
+		initializers.DB.Model(&models.LoginAttempt{}).
+			Where("id = ?", attemptID).
+			Update("failure_reason", "Invalid token")
+		if errors.Is(err, internal.ErrResetTokenInvalid) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	olduser := user
+	if err := internal.StorePassword(initializers.DB, &user, body.NewPassword); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "Error with Database",
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	internal.RevokeUserSessions(user.ID, 0, "password reset")
+	internal.LogUserPatch(user, olduser, user)
+
+	initializers.DB.Model(&models.LoginAttempt{}).
+		Where("id = ?", attemptID).
+		Updates(map[string]interface{}{
+			"user_id":        user.ID,
+			"username":       user.Username,
+			"failure_reason": "None",
+			"successful":     true,
+		})
+	c.JSON(http.StatusOK, gin.H{"message": "password has been reset, log in with the new password"})
+}
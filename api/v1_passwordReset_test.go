@@ -0,0 +1,145 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/markuskjeldsen/mop-backend-api/initializers"
+	"github.com/markuskjeldsen/mop-backend-api/internal/mail"
+	"github.com/markuskjeldsen/mop-backend-api/internal/testdb"
+	"github.com/markuskjeldsen/mop-backend-api/models"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const newPassword = "Kaffe-Kop-7731"
+
+func setupPasswordReset(t *testing.T) (*mail.MemorySender, models.User) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	testdb.Use(t, &models.User{}, &models.PasswordResetToken{}, &models.PasswordHistory{},
+		&models.Session{}, &models.ActivityLog{}, &models.LoginAttempt{})
+
+	sender := &mail.MemorySender{}
+	mail.SetDefault(sender)
+
+	user := models.User{Name: "Bo Jensen", Username: "bo", Password: "old-hash", Email: "bo@firma.dk"}
+	if err := initializers.DB.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	return sender, user
+}
+
+func post(handler gin.HandlerFunc, body interface{}) *httptest.ResponseRecorder {
+	raw, _ := json.Marshal(body)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(raw))
+	c.Request.Header.Set("Content-Type", "application/json")
+	handler(c)
+	// a reset link is mailed after the response
+	passwordResetMails.Wait()
+	return w
+}
+
+var resetLink = regexp.MustCompile(`reset-password\?token=(\S+)`)
+
+// mailedToken is the token in the last reset mail
+func mailedToken(t *testing.T, sender *mail.MemorySender) string {
+	t.Helper()
+	sent := sender.Sent()
+	if len(sent) == 0 {
+		t.Fatal("no reset mail was sent")
+	}
+	m := resetLink.FindStringSubmatch(sent[len(sent)-1].Body)
+	if m == nil {
+		t.Fatalf("no reset link in %q", sent[len(sent)-1].Body)
+	}
+	token, err := url.QueryUnescape(m[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestForgotPasswordDoesNotRevealUsers(t *testing.T) {
+	sender, _ := setupPasswordReset(t)
+	noEmail := models.User{Name: "Uden Mail", Username: "nomail", Password: "hash"}
+	initializers.DB.Create(&noEmail)
+
+	known := post(ForgotPassword, gin.H{"username": "bo"})
+	for _, username := range []string{"ukendt", "nomail"} {
+		w := post(ForgotPassword, gin.H{"username": username})
+		if w.Code != known.Code || w.Body.String() != known.Body.String() {
+			t.Errorf("%s got %d %s, want the same as a known user: %d %s", username, w.Code, w.Body, known.Code, known.Body)
+		}
+	}
+	if sent := sender.Sent(); len(sent) != 1 || sent[0].To != "bo@firma.dk" {
+		t.Errorf("sent %v, want one mail to bo@firma.dk", sent)
+	}
+}
+
+func TestResetPasswordTokenWorksOnce(t *testing.T) {
+	sender, user := setupPasswordReset(t)
+	post(ForgotPassword, gin.H{"username": "bo"})
+	token := mailedToken(t, sender)
+
+	if w := post(ResetPassword, gin.H{"token": token, "new_password": newPassword}); w.Code != http.StatusOK {
+		t.Fatalf("reset got %d %s, want 200", w.Code, w.Body)
+	}
+	var stored models.User
+	initializers.DB.First(&stored, user.ID)
+	if bcrypt.CompareHashAndPassword([]byte(stored.Password), []byte(newPassword)) != nil {
+		t.Error("the new password was not stored")
+	}
+
+	if w := post(ResetPassword, gin.H{"token": token, "new_password": "Andet-Kodeord-9"}); w.Code != http.StatusBadRequest {
+		t.Errorf("second reset with the same token got %d %s, want 400", w.Code, w.Body)
+	}
+}
+
+func TestResetPasswordRejectedPasswordKeepsToken(t *testing.T) {
+	sender, _ := setupPasswordReset(t)
+	post(ForgotPassword, gin.H{"username": "bo"})
+	token := mailedToken(t, sender)
+
+	if w := post(ResetPassword, gin.H{"token": token, "new_password": "kort"}); w.Code != http.StatusBadRequest {
+		t.Fatalf("weak password got %d %s, want 400", w.Code, w.Body)
+	}
+	if w := post(ResetPassword, gin.H{"token": token, "new_password": newPassword}); w.Code != http.StatusOK {
+		t.Errorf("reset after a rejected password got %d %s, want 200", w.Code, w.Body)
+	}
+}
+
+func TestResetPasswordExpiredToken(t *testing.T) {
+	sender, _ := setupPasswordReset(t)
+
+	t.Run("expired", func(t *testing.T) {
+		post(ForgotPassword, gin.H{"username": "bo"})
+		token := mailedToken(t, sender)
+		initializers.DB.Model(&models.PasswordResetToken{}).Where("used_at IS NULL").Update("expires_at", time.Now().Add(-time.Minute))
+
+		if w := post(ResetPassword, gin.H{"token": token, "new_password": newPassword}); w.Code != http.StatusBadRequest {
+			t.Errorf("expired token got %d %s, want 400", w.Code, w.Body)
+		}
+	})
+
+	t.Run("replaced by a newer link", func(t *testing.T) {
+		post(ForgotPassword, gin.H{"username": "bo"})
+		older := mailedToken(t, sender)
+		post(ForgotPassword, gin.H{"username": "bo"})
+
+		if w := post(ResetPassword, gin.H{"token": older, "new_password": newPassword}); w.Code != http.StatusBadRequest {
+			t.Errorf("older token got %d %s, want 400", w.Code, w.Body)
+		}
+		if w := post(ResetPassword, gin.H{"token": mailedToken(t, sender), "new_password": newPassword}); w.Code != http.StatusOK {
+			t.Errorf("newest token got %d %s, want 200", w.Code, w.Body)
+		}
+	})
+}
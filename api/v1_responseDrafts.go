@@ -0,0 +1,146 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/markuskjeldsen/mop-backend-api/initializers"
+	"github.com/markuskjeldsen/mop-backend-api/internal"
+	"github.com/markuskjeldsen/mop-backend-api/middleware"
+	"github.com/markuskjeldsen/mop-backend-api/models"
+	"gorm.io/gorm"
+)
+
+// draftErrorResponse sends the error of working on a draft with a fitting status, refused status changes as transitionErrorResponse does
+func draftErrorResponse(c *gin.Context, err error) {
+	var validationErr internal.ValidationError
+	var transitionErr *internal.TransitionError
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+	case errors.As(err, &validationErr):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, internal.ErrDraftForbidden):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, internal.ErrVisitHasResponse), errors.Is(err, internal.ErrDraftStale):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.As(err, &transitionErr):
+		transitionErrorResponse(c, err)
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// draftFields reads the fields of the body, an empty body is no fields
+func draftFields(c *gin.Context) (map[string]json.RawMessage, bool) {
+	fields := map[string]json.RawMessage{}
+	if c.Request.ContentLength == 0 {
+		return fields, true
+	}
+	if err := c.ShouldBindJSON(&fields); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return fields, true
+}
+
+// GET /visits/:id/draft
+func GetResponseDraft(c *gin.Context) {
+	user, _ := getVerifyUser(c)
+	visitID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	draft, err := internal.GetResponseDraft(user, uint(visitID))
+	if err != nil {
+		draftErrorResponse(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, draft)
+}
+
+// PUT /visits/:id/draft?revision=3
+// saves the fields in the body to the draft, the others are kept, so the form can save as it is filled out.
+// With ?revision the save is refused with 409 if the draft was saved from somewhere else since
+func SaveResponseDraft(c *gin.Context) {
+	user, _ := getVerifyUser(c)
+	visitID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	var revision *int
+	if r := c.Query("revision"); r != "" {
+		n, err := strconv.Atoi(r)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid revision"})
+			return
+		}
+		revision = &n
+	}
+	fields, ok := draftFields(c)
+	if !ok {
+		return
+	}
+
+	draft, err := internal.SaveResponseDraft(user, uint(visitID), fields, revision)
+	if err != nil {
+		draftErrorResponse(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, draft)
+}
+
+// DELETE /visits/:id/draft
+func DiscardResponseDraft(c *gin.Context) {
+	user, _ := getVerifyUser(c)
+	visitID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	if err := internal.DiscardResponseDraft(user, uint(visitID)); err != nil {
+		draftErrorResponse(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Draft discarded"})
+}
+
+// POST /visits/:id/draft/submit
+// the body can carry the last fields. The draft becomes the response and the visit goes to review,
+// the required fields are checked here and the draft is kept if anything is missing
+func SubmitResponseDraft(c *gin.Context) {
+	user, _ := getVerifyUser(c)
+	visitID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	fields, ok := draftFields(c)
+	if !ok {
+		return
+	}
+
+	can := func(permission string) bool {
+		return middleware.Allowed(c, middleware.Permission(permission))
+	}
+	var response models.VisitResponse
+	err = initializers.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		response, err = internal.SubmitResponseDraft(tx, user, can, uint(visitID), fields)
+		return err
+	})
+	if err != nil {
+		draftErrorResponse(c, err)
+		return
+	}
+	internal.ProposeFollowUpsQuietly(response.VisitID)
+	internal.AwardAchievementsQuietly(response.VisitID)
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,157 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/markuskjeldsen/mop-backend-api/initializers"
+	"github.com/markuskjeldsen/mop-backend-api/internal"
+	"github.com/markuskjeldsen/mop-backend-api/middleware"
+	"github.com/markuskjeldsen/mop-backend-api/models"
+	"gorm.io/gorm"
+)
+
+// responseEditErrorResponse sends the error of an edit, or of deciding on one, with a fitting status
+func responseEditErrorResponse(c *gin.Context, err error) {
+	var validationErr internal.ValidationError
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+	case errors.As(err, &validationErr):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, internal.ErrResponseForbidden):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, internal.ErrResponseEditPending), errors.Is(err, internal.ErrResponseEditDecided),
+		errors.Is(err, internal.ErrResponseEditOwn), errors.Is(err, internal.ErrResponseEditStale):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// PATCH /visit-response/:id
+// only the fields in the body are changed, each edit is kept as a version.
+// Once the visit is exported the edit waits for the office and 202 is returned with the edit
+func PatchVisitResponse(c *gin.Context) {
+	actingUser, _ := getVerifyUser(c)
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	var patch map[string]json.RawMessage
+	if err := c.ShouldBindJSON(&patch); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	can := func(permission string) bool {
+		return middleware.Allowed(c, middleware.Permission(permission))
+	}
+	result, err := internal.EditVisitResponse(actingUser, can, uint(id), patch)
+	if err != nil {
+		responseEditErrorResponse(c, err)
+		return
+	}
+	if result.Edit != nil {
+		c.JSON(http.StatusAccepted, result)
+		return
+	}
+	// the debitor was not home after all, or the other way, so the follow-ups are looked at again
+	if internal.VersionChanged(*result.Version, "debitor_is_home") {
+		internal.ProposeFollowUpsQuietly(result.Response.VisitID)
+	}
+	internal.AwardAchievementsQuietly(result.Response.VisitID)
+	c.JSON(http.StatusOK, result)
+}
+
+// GET /visit-response/:id/versions
+// every version of the response with what changed, for the konsulent of the visit and the office
+func GetVisitResponseVersions(c *gin.Context) {
+	user, _ := getVerifyUser(c)
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	var response models.VisitResponse
+	if err := initializers.DB.First(&response, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Response not found"})
+		return
+	}
+	var visit models.Visit
+	initializers.DB.Unscoped().First(&visit, response.VisitID)
+	if visit.UserID != user.ID && !middleware.Allowed(c, middleware.PermVisitsRead) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You cannot see this response"})
+		return
+	}
+
+	versions, err := internal.ResponseVersions(response.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	edits := []models.VisitResponseEdit{}
+	initializers.DB.Where("visit_response_id = ?", response.ID).Order("id").Find(&edits)
+	c.JSON(http.StatusOK, gin.H{"current_version": response.Version, "versions": versions, "edits": edits})
+}
+
+// GET /visit-response/edits?status=pending
+// edits of exported responses, the pending ones wait for the office
+func GetResponseEdits(c *gin.Context) {
+	edits, err := internal.ResponseEdits(models.ResponseEditStatus(c.DefaultQuery("status", string(models.ResponseEditPending))))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, edits)
+}
+
+// POST /visit-response/edits/:id/approve
+func ApproveResponseEdit(c *gin.Context) {
+	actingUser, _ := getVerifyUser(c)
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	edit, version, err := internal.ApproveResponseEdit(actingUser, uint(id))
+	if err != nil {
+		responseEditErrorResponse(c, err)
+		return
+	}
+	if internal.VersionChanged(version, "debitor_is_home") {
+		internal.ProposeFollowUpsQuietly(edit.VisitID)
+	}
+	internal.AwardAchievementsQuietly(edit.VisitID)
+	c.JSON(http.StatusOK, gin.H{"edit": edit, "version": version})
+}
+
+// POST /visit-response/edits/:id/reject
+func RejectResponseEdit(c *gin.Context) {
+	actingUser, _ := getVerifyUser(c)
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	edit, err := internal.RejectResponseEdit(actingUser, uint(id), body.Reason)
+	if err != nil {
+		responseEditErrorResponse(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, edit)
+}
@@ -0,0 +1,216 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/markuskjeldsen/mop-backend-api/initializers"
+	"github.com/markuskjeldsen/mop-backend-api/internal"
+	"github.com/markuskjeldsen/mop-backend-api/middleware"
+	"github.com/markuskjeldsen/mop-backend-api/models"
+)
+
+// the refresh cookie is only sent to the api, not to the static frontend
+const refreshCookiePath = "/api"
+
+func getSessionID(c *gin.Context) (uint, bool) {
+	s, ok := c.Get("sessionID")
+	if !ok {
+		return 0, false
+	}
+	sessionID, ok := s.(uint)
+	return sessionID, ok
+}
+
+// setSessionCookies sets the token cookies and a new csrf token, which is returned so it can also be put in the response body.
+// The csrf cookie is not http only, the frontend has to read it and send it back in the X-CSRF-Token header.
+func setSessionCookies(c *gin.Context, tokens internal.SessionTokens) (string, error) {
+	csrfToken, err := middleware.NewCSRFToken()
+	if err != nil {
+		return "", err
+	}
+
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie("Authorization", tokens.AccessToken, int(internal.AccessTokenTTL.Seconds()), "/", os.Getenv("DOMAIN"), true, true)
+	c.SetCookie("Refresh", tokens.RefreshToken, int(internal.RefreshTokenTTL.Seconds()), refreshCookiePath, os.Getenv("DOMAIN"), true, true)
+	c.SetCookie(middleware.CSRFCookieName, csrfToken, int(internal.RefreshTokenTTL.Seconds()), "/", os.Getenv("DOMAIN"), true, false)
+	return csrfToken, nil
+}
+
+func clearSessionCookies(c *gin.Context) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie("Authorization", "", -1, "/", os.Getenv("DOMAIN"), true, true)
+	c.SetCookie("Refresh", "", -1, refreshCookiePath, os.Getenv("DOMAIN"), true, true)
+	c.SetCookie(middleware.CSRFCookieName, "", -1, "/", os.Getenv("DOMAIN"), true, false)
+}
+
+// startSession creates a session for a user who has passed every login step and sets the cookies.
+// It returns the tokens for the response body, on failure the error response has already been written.
+func startSession(c *gin.Context, user models.User) (gin.H, bool) {
+	tokens, err := internal.CreateSession(user, c.ClientIP(), c.Request.UserAgent())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"Status": "failed to create token",
+			"error":  err.Error(),
+		})
+		return nil, false
+	}
+
+	csrfToken, err := setSessionCookies(c, tokens)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"Status": "failed to create token",
+			"error":  err.Error(),
+		})
+		return nil, false
+	}
+
+	user.Password = ""
+	return gin.H{
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"csrf_token":    csrfToken,
+		"expires_at":    time.Now().Add(internal.AccessTokenTTL).Unix(),
+		"user":          user,
+	}, true
+}
+
+// POST /refresh
+// takes the refresh token from the cookie, or from the body for clients that do not use cookies
+func Refresh(c *gin.Context) {
+	refreshToken, err := c.Cookie("Refresh")
+	if err == nil && refreshToken != "" {
+		// the cookie is sent by the browser on its own, so it needs the same csrf check as the other endpoints
+		if !middleware.ValidCSRF(c) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Missing or invalid CSRF token"})
+			return
+		}
+	} else {
+		var body struct {
+			RefreshToken string `json:"refresh_token" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "No refresh token provided"})
+			return
+		}
+		refreshToken = body.RefreshToken
+	}
+
+	tokens, err := internal.RefreshSession(refreshToken, c.ClientIP(), c.Request.UserAgent())
+	if err != nil {
+		if errors.Is(err, internal.ErrSessionInvalid) {
+			clearSessionCookies(c)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	csrfToken, err := setSessionCookies(c, tokens)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"csrf_token":    csrfToken,
+		"expires_at":    time.Now().Add(internal.AccessTokenTTL).Unix(),
+	})
+}
+
+// canManageSessions lets users see their own sessions, and admins see everyones
+func canManageSessions(actingUser models.User, userID uint) bool {
+	return actingUser.ID == userID || middleware.HasPermission(actingUser.Rights, middleware.PermUsersSessions)
+}
+
+// GET /users/:id/sessions
+func GetSessions(c *gin.Context) {
+	actingUser, _ := getVerifyUser(c)
+	userID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	if !canManageSessions(actingUser, uint(userID)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot see another users sessions"})
+		return
+	}
+
+	sessions, err := internal.ActiveSessions(uint(userID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	currentID, _ := getSessionID(c)
+	c.JSON(http.StatusOK, gin.H{
+		"sessions":        sessions,
+		"current_session": currentID,
+	})
+}
+
+// DELETE /users/:id/sessions/:sessionId
+func RevokeSession(c *gin.Context) {
+	actingUser, _ := getVerifyUser(c)
+	userID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	sessionID, err := strconv.ParseUint(c.Param("sessionId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session ID"})
+		return
+	}
+
+	if !canManageSessions(actingUser, uint(userID)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot revoke another users sessions"})
+		return
+	}
+
+	var session models.Session
+	if err := initializers.DB.Where("id = ? AND user_id = ?", sessionID, userID).First(&session).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+
+	if err := internal.RevokeSession(session.ID, "revoked by user "+strconv.Itoa(int(actingUser.ID))); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// DELETE /users/:id/sessions
+// logs the user out everywhere
+func RevokeAllSessions(c *gin.Context) {
+	actingUser, _ := getVerifyUser(c)
+	userID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	if !canManageSessions(actingUser, uint(userID)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot revoke another users sessions"})
+		return
+	}
+
+	if err := internal.RevokeUserSessions(uint(userID), 0, "revoked by user "+strconv.Itoa(int(actingUser.ID))); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if actingUser.ID == uint(userID) {
+		clearSessionCookies(c)
+	}
+	c.Status(http.StatusNoContent)
+}
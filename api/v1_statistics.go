@@ -0,0 +1,271 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/markuskjeldsen/mop-backend-api/initializers"
+	"github.com/markuskjeldsen/mop-backend-api/internal"
+	"github.com/markuskjeldsen/mop-backend-api/middleware"
+	"github.com/markuskjeldsen/mop-backend-api/models"
+)
+
+// dateQuery reads an optional YYYY-MM-DD query parameter, a zero time is returned when it is left out
+func dateQuery(c *gin.Context, name string) (time.Time, bool) {
+	q := c.Query(name)
+	if q == "" {
+		return time.Time{}, true
+	}
+	t, err := time.Parse("2006-01-02", q)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + name + ". Use YYYY-MM-DD"})
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// GET /users/:id/stats?from=2024-01-01&to=2024-12-31&period=month
+// without from the last twelve months are shown, period is day, week or month
+func GetUserStats(c *gin.Context) {
+	actingUser, _ := getVerifyUser(c)
+	userID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	if actingUser.ID != uint(userID) && !middleware.HasPermission(actingUser.Rights, middleware.PermUsersRead) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot see the statistics of another user"})
+		return
+	}
+
+	from, ok := dateQuery(c, "from")
+	if !ok {
+		return
+	}
+	to, ok := dateQuery(c, "to")
+	if !ok {
+		return
+	}
+	if to.IsZero() {
+		to = time.Now()
+	}
+	if from.IsZero() {
+		from = time.Date(to.Year(), to.Month()-11, 1, 0, 0, 0, 0, time.UTC)
+	}
+	period := internal.StatsPeriod(c.DefaultQuery("period", string(internal.PeriodMonth)))
+	if !internal.ValidStatsPeriod(period) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "period must be day, week or month"})
+		return
+	}
+
+	total, periods, err := internal.UserStats(uint(userID), from, to, period)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	achievements, err := internal.UserAchievements(uint(userID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"user_id":      userID,
+		"from":         from.Format("2006-01-02"),
+		"to":           to.Format("2006-01-02"),
+		"period":       period,
+		"total":        total,
+		"periods":      periods,
+		"achievements": achievements,
+	})
+}
+
+// PATCH /users/:id/leaderboard
+// only the user themself can choose to be shown on the leaderboard
+func SetLeaderboardOptIn(c *gin.Context) {
+	actingUser, _ := getVerifyUser(c)
+	userID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	if actingUser.ID != uint(userID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the user can choose to be on the leaderboard"})
+		return
+	}
+
+	var body struct {
+		OptIn *bool `json:"opt_in" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var user models.User
+	if err := initializers.DB.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	olduser := user
+	if err := initializers.DB.Model(&user).Update("leaderboard_opt_in", *body.OptIn).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	internal.LogUserPatch(actingUser, olduser, user)
+
+	c.JSON(http.StatusOK, gin.H{"leaderboard_opt_in": user.LeaderboardOptIn})
+}
+
+// GET /leaderboard?metric=visits&from=2024-07-01&to=2024-07-31
+// the konsulenter who have opted in, ranked by the metric, without from and to the current month is used
+func GetLeaderboard(c *gin.Context) {
+	actingUser, _ := getVerifyUser(c)
+
+	metric := models.StatsMetric(c.DefaultQuery("metric", string(models.MetricVisits)))
+	if !internal.ValidStatsMetric(metric) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown metric " + string(metric)})
+		return
+	}
+	from, ok := dateQuery(c, "from")
+	if !ok {
+		return
+	}
+	to, ok := dateQuery(c, "to")
+	if !ok {
+		return
+	}
+	if to.IsZero() {
+		to = time.Now()
+	}
+	if from.IsZero() {
+		from = time.Date(to.Year(), to.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+
+	entries, err := internal.Leaderboard(metric, from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"metric":    metric,
+		"from":      from.Format("2006-01-02"),
+		"to":        to.Format("2006-01-02"),
+		"opted_in":  actingUser.LeaderboardOptIn,
+		"standings": entries,
+	})
+}
+
+// GET /achievements
+func GetAchievements(c *gin.Context) {
+	var achievements []models.Achievement
+	if err := initializers.DB.Order("metric, threshold").Find(&achievements).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, achievements)
+}
+
+type achievementBody struct {
+	Key         string             `json:"key" binding:"required"`
+	Name        string             `json:"name" binding:"required"`
+	Description string             `json:"description"`
+	Badge       string             `json:"badge"`
+	Metric      models.StatsMetric `json:"metric" binding:"required"`
+	Threshold   float64            `json:"threshold" binding:"required,gt=0"`
+	Active      *bool              `json:"active"`
+}
+
+func bindAchievement(c *gin.Context, achievement *models.Achievement) bool {
+	var body achievementBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	if !internal.ValidStatsMetric(body.Metric) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown metric " + string(body.Metric)})
+		return false
+	}
+	achievement.Key = body.Key
+	achievement.Name = body.Name
+	achievement.Description = body.Description
+	achievement.Badge = body.Badge
+	achievement.Metric = body.Metric
+	achievement.Threshold = body.Threshold
+	achievement.Active = body.Active == nil || *body.Active
+	return true
+}
+
+// POST /achievements
+func CreateAchievement(c *gin.Context) {
+	var achievement models.Achievement
+	if !bindAchievement(c, &achievement) {
+		return
+	}
+	if err := initializers.DB.Create(&achievement).Error; err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "an achievement with that key already exists"})
+		return
+	}
+	c.JSON(http.StatusCreated, achievement)
+}
+
+// PUT /achievements/:id
+// users keep the achievement even if the threshold is raised afterwards
+func UpdateAchievement(c *gin.Context) {
+	var achievement models.Achievement
+	if err := initializers.DB.First(&achievement, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Achievement not found"})
+		return
+	}
+	if !bindAchievement(c, &achievement) {
+		return
+	}
+	if err := initializers.DB.Save(&achievement).Error; err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "an achievement with that key already exists"})
+		return
+	}
+	c.JSON(http.StatusOK, achievement)
+}
+
+// POST /users/:id/achievements
+// awards what the user has earned but not got yet, e.g. after a new achievement is added or a threshold lowered.
+// Achievements are otherwise awarded when a response is saved or exported.
+func AwardUserAchievements(c *gin.Context) {
+	userID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	if err := initializers.DB.First(&models.User{}, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err := internal.AwardAchievements(uint(userID)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	achievements, err := internal.UserAchievements(uint(userID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, achievements)
+}
+
+// DELETE /achievements/:id
+// turns the achievement off, users who have it keep the badge
+func DeleteAchievement(c *gin.Context) {
+	result := initializers.DB.Model(&models.Achievement{}).Where("id = ?", c.Param("id")).Update("active", false)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error.Error()})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Achievement not found"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,411 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/markuskjeldsen/mop-backend-api/initializers"
+	"github.com/markuskjeldsen/mop-backend-api/internal"
+	"github.com/markuskjeldsen/mop-backend-api/middleware"
+	"github.com/markuskjeldsen/mop-backend-api/models"
+)
+
+// after this many wrong codes the user has to wait before trying again
+const maxFailedTOTPAttempts = 5
+const failedTOTPWindow = 15 * time.Minute
+
+func recordLoginStep(c *gin.Context, user models.User, step string, successful bool, reason string) {
+	attempt := models.LoginAttempt{
+		UserID:        user.ID,
+		Username:      user.Username,
+		IP:            c.ClientIP(),
+		Successful:    successful,
+		FailureReason: reason,
+		Step:          step,
+	}
+	initializers.DB.Create(&attempt)
+}
+
+func tooManyTOTPAttempts(user models.User) bool {
+	var failed int64
+	initializers.DB.Model(&models.LoginAttempt{}).
+		Where("user_id = ? AND step IN ? AND successful = ? AND created_at > ?",
+			user.ID,
+			[]string{models.LoginStepTOTP, models.LoginStepRecoveryCode, models.LoginStepTOTPEnrol},
+			false,
+			time.Now().Add(-failedTOTPWindow)).
+		Count(&failed)
+	return failed >= maxFailedTOTPAttempts
+}
+
+// mfaUser finds the user from the mfa token handed out by Login
+func mfaUser(c *gin.Context, mfaToken string) (models.User, bool) {
+	userID, err := internal.ParseMFAToken(mfaToken)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired mfa token, log in again"})
+		return models.User{}, false
+	}
+
+	var user models.User
+	if err := initializers.DB.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired mfa token, log in again"})
+		return models.User{}, false
+	}
+	return user, true
+}
+
+// errCodeUsed is returned when a code or recovery code was used by another request at the same time
+var errCodeUsed = errors.New("the code has already been used")
+
+// useTOTPStep records the step of an accepted code. Only one request can record a step,
+// so the same code sent twice at once logs in once.
+func useTOTPStep(user models.User, matched int64) error {
+	result := initializers.DB.Model(&user).Where("totp_last_step < ?", matched).Update("totp_last_step", matched)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errCodeUsed
+	}
+	return nil
+}
+
+// useRecoveryCode stores the recovery codes that are left, only if no other request used one in the meantime
+func useRecoveryCode(user models.User, remaining []byte) error {
+	result := initializers.DB.Model(&user).
+		Where("totp_recovery_codes = ?", []byte(user.TOTPRecoveryCodes)).
+		Update("totp_recovery_codes", remaining)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errCodeUsed
+	}
+	return nil
+}
+
+// beginTOTPSetup stores a new secret on the user. It is not used to log in until enableTOTP has confirmed it.
+func beginTOTPSetup(user models.User) (gin.H, error) {
+	if user.TOTPEnabled {
+		return nil, errors.New("two factor is already enabled")
+	}
+
+	secret, err := internal.GenerateTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+	if err := initializers.DB.Model(&user).Update("totp_secret", secret).Error; err != nil {
+		return nil, err
+	}
+
+	return gin.H{
+		"secret":           secret,
+		"provisioning_uri": internal.TOTPProvisioningURI(user, secret),
+	}, nil
+}
+
+// enableTOTP turns on two factor once the user has shown that their app produces the right codes.
+// The recovery codes are returned in clear text this one time only.
+func enableTOTP(user models.User, code string) ([]string, error) {
+	if user.TOTPEnabled {
+		return nil, errors.New("two factor is already enabled")
+	}
+	if user.TOTPSecret == "" {
+		return nil, errors.New("two factor setup has not been started")
+	}
+
+	step, ok := internal.ValidateTOTP(user.TOTPSecret, code, user.TOTPLastStep, time.Now())
+	if !ok {
+		return nil, errors.New("incorrect code")
+	}
+
+	codes, hashes, err := internal.GenerateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	// only one request can enable it with this secret and code, the others get errCodeUsed
+	result := initializers.DB.Model(&user).
+		Where("totp_enabled = ? AND totp_secret = ? AND totp_last_step < ?", false, user.TOTPSecret, step).
+		Updates(map[string]interface{}{
+			"totp_enabled":        true,
+			"totp_last_step":      step,
+			"totp_recovery_codes": hashes,
+		})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, errCodeUsed
+	}
+	return codes, nil
+}
+
+// POST /login/2fa
+// second login step, takes the mfa token from Login and either a code from the app or a recovery code
+func LoginTOTP(c *gin.Context) {
+	var body struct {
+		MFAToken     string `json:"mfa_token" binding:"required"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, ok := mfaUser(c, body.MFAToken)
+	if !ok {
+		return
+	}
+
+	step := models.LoginStepTOTP
+	if body.RecoveryCode != "" {
+		step = models.LoginStepRecoveryCode
+	}
+
+	if !user.TOTPEnabled {
+		recordLoginStep(c, user, step, false, "Two factor not enrolled")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "two factor is not set up for this user, enrol first"})
+		return
+	}
+
+	if tooManyTOTPAttempts(user) {
+		recordLoginStep(c, user, step, false, "Too many requests")
+		c.AbortWithStatus(http.StatusTooManyRequests)
+		return
+	}
+
+	if step == models.LoginStepRecoveryCode {
+		remaining, ok := internal.UseRecoveryCode(user.TOTPRecoveryCodes, body.RecoveryCode)
+		if !ok {
+			recordLoginStep(c, user, step, false, "Incorrect recovery code")
+			c.JSON(http.StatusBadRequest, gin.H{"error": "incorrect code"})
+			return
+		}
+		if err := useRecoveryCode(user, remaining); err != nil {
+			recordLoginStep(c, user, step, false, err.Error())
+			c.JSON(http.StatusBadRequest, gin.H{"error": "incorrect code"})
+			return
+		}
+	} else {
+		matched, ok := internal.ValidateTOTP(user.TOTPSecret, body.Code, user.TOTPLastStep, time.Now())
+		if !ok {
+			recordLoginStep(c, user, step, false, "Incorrect code")
+			c.JSON(http.StatusBadRequest, gin.H{"error": "incorrect code"})
+			return
+		}
+		if err := useTOTPStep(user, matched); err != nil {
+			recordLoginStep(c, user, step, false, err.Error())
+			c.JSON(http.StatusBadRequest, gin.H{"error": "incorrect code"})
+			return
+		}
+	}
+
+	resp, ok := startSession(c, user)
+	if !ok {
+		recordLoginStep(c, user, step, false, "failure to create token")
+		return
+	}
+	recordLoginStep(c, user, step, true, "None")
+
+	resp["message"] = "sucessfully logged in"
+	resp["password_expired"] = internal.PasswordExpired(user)
+	c.JSON(http.StatusOK, resp)
+}
+
+// POST /login/2fa/setup
+// for users who must have two factor but have not set it up yet, they only have the mfa token from Login
+func LoginTOTPSetup(c *gin.Context) {
+	var body struct {
+		MFAToken string `json:"mfa_token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, ok := mfaUser(c, body.MFAToken)
+	if !ok {
+		return
+	}
+
+	resp, err := beginTOTPSetup(user)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// POST /login/2fa/enable
+// confirms the enrolment started by LoginTOTPSetup and finishes the login
+func LoginTOTPEnable(c *gin.Context) {
+	var body struct {
+		MFAToken string `json:"mfa_token" binding:"required"`
+		Code     string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, ok := mfaUser(c, body.MFAToken)
+	if !ok {
+		return
+	}
+
+	if tooManyTOTPAttempts(user) {
+		recordLoginStep(c, user, models.LoginStepTOTPEnrol, false, "Too many requests")
+		c.AbortWithStatus(http.StatusTooManyRequests)
+		return
+	}
+
+	codes, err := enableTOTP(user, body.Code)
+	if err != nil {
+		recordLoginStep(c, user, models.LoginStepTOTPEnrol, false, err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	resp, ok := startSession(c, user)
+	if !ok {
+		recordLoginStep(c, user, models.LoginStepTOTPEnrol, false, "failure to create token")
+		return
+	}
+	recordLoginStep(c, user, models.LoginStepTOTPEnrol, true, "None")
+
+	resp["message"] = "two factor enabled, sucessfully logged in"
+	resp["recovery_codes"] = codes
+	resp["password_expired"] = internal.PasswordExpired(user)
+	c.JSON(http.StatusOK, resp)
+}
+
+// the self service endpoints below are for a logged in user, and only for their own account
+
+func ownAccount(c *gin.Context) (models.User, bool) {
+	actingUser, _ := getVerifyUser(c)
+	userID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return models.User{}, false
+	}
+	if actingUser.ID != uint(userID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot change two factor for another user"})
+		return models.User{}, false
+	}
+	return actingUser, true
+}
+
+// POST /users/:id/2fa/setup
+func SetupTOTP(c *gin.Context) {
+	user, ok := ownAccount(c)
+	if !ok {
+		return
+	}
+
+	resp, err := beginTOTPSetup(user)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// POST /users/:id/2fa/enable
+func EnableTOTP(c *gin.Context) {
+	user, ok := ownAccount(c)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Code string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if tooManyTOTPAttempts(user) {
+		recordLoginStep(c, user, models.LoginStepTOTPEnrol, false, "Too many requests")
+		c.AbortWithStatus(http.StatusTooManyRequests)
+		return
+	}
+
+	// reload the user, the secret was stored by SetupTOTP after the middleware loaded it
+	initializers.DB.First(&user, user.ID)
+	codes, err := enableTOTP(user, body.Code)
+	if err != nil {
+		recordLoginStep(c, user, models.LoginStepTOTPEnrol, false, err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	recordLoginStep(c, user, models.LoginStepTOTPEnrol, true, "None")
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":        "two factor enabled",
+		"recovery_codes": codes,
+	})
+}
+
+// DELETE /users/:id/2fa
+// users can turn off their own two factor with a valid code, admins can reset it for a user who lost their phone.
+// Users whose rights require two factor will have to enrol again at their next login.
+func DisableTOTP(c *gin.Context) {
+	actingUser, _ := getVerifyUser(c)
+	userID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	var user models.User
+	if err := initializers.DB.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	var lastStep int64
+	if actingUser.ID == user.ID {
+		var body struct {
+			Code string `json:"code" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		matched, ok := internal.ValidateTOTP(user.TOTPSecret, body.Code, user.TOTPLastStep, time.Now())
+		if !ok || !user.TOTPEnabled {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "incorrect code"})
+			return
+		}
+		if err := useTOTPStep(user, matched); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "incorrect code"})
+			return
+		}
+		// keep the step, enableTOTP only accepts a later code when two factor is turned back on
+		lastStep = matched
+	} else if !middleware.HasPermission(actingUser.Rights, middleware.PermUsers2FAReset) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot change two factor for another user"})
+		return
+	}
+
+	olduser := user
+	err = initializers.DB.Model(&user).Updates(map[string]interface{}{
+		"totp_enabled":        false,
+		"totp_secret":         "",
+		"totp_last_step":      lastStep,
+		"totp_recovery_codes": nil,
+	}).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	internal.LogUserPatch(actingUser, olduser, user)
+	c.Status(http.StatusNoContent)
+}
@@ -1,19 +1,18 @@
 package api
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
-	"os"
 	"time"
 
-	"github.com/golang-jwt/jwt/v4"
-
 	"github.com/gin-gonic/gin"
 	"github.com/markuskjeldsen/mop-backend-api/initializers"
 	"github.com/markuskjeldsen/mop-backend-api/internal"
 	"github.com/markuskjeldsen/mop-backend-api/middleware"
 	"github.com/markuskjeldsen/mop-backend-api/models"
 	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
 )
 
 func Hello(c *gin.Context) {
@@ -44,7 +43,12 @@ func GetUserByParam(c *gin.Context) {
 }
 func GetUsers(c *gin.Context) {
 	var user []models.User
-	initializers.DB.Where("id != 1").Find(&user) // Preload visits for each user
+	query := initializers.DB.Where("id != 1")
+	// ?status=active to leave out users who have left, e.g. when picking a konsulent
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	query.Find(&user) // Preload visits for each user
 	for i := range user {
 		user[i].Password = "" // Remove password from the response
 	}
@@ -101,12 +105,13 @@ func CreateUser(c *gin.Context) {
 		return
 	}
 
-	if len(body.Password) < 8 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "password must be at least 8 characters"})
+	// the user does not exist yet, so only the name and username are checked besides the password itself
+	if err := internal.ValidatePassword(initializers.DB, models.User{Name: body.FullName, Username: body.Username}, body.Password); err != nil {
+		passwordPolicyResponse(c, err)
 		return
 	}
 
-	hash, err := bcrypt.GenerateFromPassword([]byte(body.Password), 14)
+	hash, err := internal.HashPassword(body.Password)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status": "couldnt generate password hash",
@@ -143,13 +148,21 @@ func CreateUser(c *gin.Context) {
 	user.Email = body.Email
 	user.Rights = models.UserRights(body.Rights)
 
-	user.Password = string(hash)
+	user.Password = hash
+	now := time.Now()
+	user.PasswordChangedAt = &now
 
-	result := initializers.DB.Create(&user)
-	if result.Error != nil {
+	// the user is only created together with the first password in the history
+	err = initializers.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+		return internal.RecordPasswordHistory(tx, user.ID, hash)
+	})
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status": "Error with Database",
-			"error":  result.Error.Error(),
+			"error":  err.Error(),
 		})
 		return
 	}
@@ -200,53 +213,88 @@ func Login(c *gin.Context) {
 		return
 	}
 
-	// generate JWT token
+	// only told after the password is right, so it does not reveal which usernames exist
+	if !internal.UserActive(user) {
+		initializers.DB.Model(&models.LoginAttempt{}).
+			Where("id = ?", attemptID).
+			Update("failure_reason", "User "+string(user.Status))
+		c.JSON(http.StatusForbidden, gin.H{
+			"error":  internal.ErrUserInactive.Error(),
+			"status": user.Status,
+		})
+		return
+	}
 
-	initializers.DB.Model(&models.LoginAttempt{}).
-		Where("id = ?", attemptID).
-		Update("failure_reason", "failure to create token")
+	// office, admin and developer accounts must use two factor, other users can choose to turn it on
+	if user.TOTPEnabled || middleware.MFARequired(user.Rights) {
+		initializers.DB.Model(&models.LoginAttempt{}).
+			Where("id = ?", attemptID).
+			Update("failure_reason", "failure to create mfa token")
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"sub": user.ID,
-		"exp": time.Now().Add(time.Hour * 24 * 7).Unix(),
-	})
+		mfaToken, err := internal.SignMFAToken(user.ID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"Status": "failed to create token",
+				"error":  err.Error(),
+			})
+			return
+		}
 
-	tokenString, err := token.SignedString([]byte(os.Getenv("JWT_secret")))
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"Status": "failed to create token",
-			"error":  err.Error(),
+		// the password step is done, the next step is recorded in its own LoginAttempt
+		initializers.DB.Model(&models.LoginAttempt{}).
+			Where("id = ?", attemptID).
+			Updates(map[string]interface{}{
+				"user_id":        user.ID,
+				"failure_reason": "None",
+				"successful":     true,
+			})
+
+		c.JSON(http.StatusOK, gin.H{
+			"message":                 "password accepted, two factor code required",
+			"mfa_required":            true,
+			"mfa_enrollment_required": !user.TOTPEnabled,
+			"mfa_token":               mfaToken,
 		})
 		return
 	}
 
-	c.SetCookie("Authorization", tokenString, 3600*24*7, "/", os.Getenv("DOMAIN"), true, true) // should be true, true in prod
-	c.SetSameSite(http.SameSiteLaxMode)
+	// start a session, the access token is short lived and renewed with the refresh token
+
+	initializers.DB.Model(&models.LoginAttempt{}).
+		Where("id = ?", attemptID).
+		Update("failure_reason", "failure to create token")
+
+	resp, ok := startSession(c, user)
+	if !ok {
+		return
+	}
 	datatype := c.ContentType()
 
 	switch datatype {
 	case "application/json":
-		// return JWT token
-		c.JSON(http.StatusOK, gin.H{
-			"token":   tokenString, //type tokenString if important
-			"message": "sucessfully logged in",
-			"user":    user,
-		})
+		resp["message"] = "sucessfully logged in"
+		resp["password_expired"] = internal.PasswordExpired(user)
+		c.JSON(http.StatusOK, resp)
 	case "application/x-www-form-urlencoded":
 		c.Redirect(http.StatusFound, "/profile")
 	}
 
 	initializers.DB.Model(&models.LoginAttempt{}).
 		Where("id = ?", attemptID).
-		Update("failure_reason", "None").
-		Update("successful", true)
+		Updates(map[string]interface{}{
+			"user_id":        user.ID,
+			"failure_reason": "None",
+			"successful":     true,
+		})
 }
 
 func Logout(c *gin.Context) {
-	// remove the cookie
+	// revoke the session so the tokens cannot be used again, and remove the cookies
+	if sessionID, ok := getSessionID(c); ok {
+		internal.RevokeSession(sessionID, "logout")
+	}
 
-	c.SetCookie("Authorization", "", 0, "/", os.Getenv("DOMAIN"), true, true) // should be true, true in prod
-	c.SetSameSite(http.SameSiteLaxMode)
+	clearSessionCookies(c)
 	c.JSON(http.StatusOK, gin.H{
 		"message": "sucessfully logged out",
 	})
@@ -264,6 +312,10 @@ func Patch(c *gin.Context) {
 		Rights   string `json:"rights,omitempty"`
 		Email    string `json:"email,omitempty"`
 		Phone    string `json:"phone,omitempty"`
+		// true hands the rights of a user linked to single sign-on over to the groups in the directory
+		OIDCRights *bool `json:"oidc_rights,omitempty"`
+		// the subject from the directory, for accounts that are not linked on the first login. Empty unlinks
+		OIDCSubject *string `json:"oidc_subject,omitempty"`
 	}
 	var user models.User
 
@@ -292,6 +344,16 @@ func Patch(c *gin.Context) {
 	// 3. Cleaner way to add Developer-only fields to the update map
 	if actingUser.Rights == models.RightsDeveloper {
 		updates["Rights"] = userPatch.Rights
+		if userPatch.OIDCRights != nil {
+			updates["OIDCRights"] = *userPatch.OIDCRights
+		}
+	}
+	if userPatch.OIDCSubject != nil && (actingUser.Rights == models.RightsDeveloper || actingUser.Rights == models.RightsAdmin) {
+		if *userPatch.OIDCSubject == "" {
+			updates["OIDCSubject"] = nil
+		} else {
+			updates["OIDCSubject"] = *userPatch.OIDCSubject
+		}
 	}
 
 	olduser := user
@@ -302,11 +364,18 @@ func Patch(c *gin.Context) {
 		return
 	}
 
+	// a user whose rights changed has to log in again
+	if olduser.Rights != user.Rights {
+		internal.RevokeUserSessions(user.ID, 0, "rights changed")
+	}
+
 	internal.LogUserPatch(actingUser, olduser, user)
 
 	c.JSON(200, user)
 }
 
+// DELETE /users/:id
+// users are deactivated instead of deleted, so their visit history stays intact
 func DeleteUser(c *gin.Context) {
 	actingUser, _ := getVerifyUser(c)
 	var user models.User
@@ -317,14 +386,142 @@ func DeleteUser(c *gin.Context) {
 		return
 	}
 
-	initializers.DB.Find(&user, id)
-	if err := initializers.DB.Delete(&models.User{}, id).Error; err != nil {
+	if err := initializers.DB.First(&user, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	setUserStatusResponse(c, actingUser, user, models.UserStatusDeactivated, "deleted")
+}
+
+// PATCH /users/:id/status
+// suspend, deactivate or reactivate a user, suspended and deactivated users cannot log in
+func SetUserStatus(c *gin.Context) {
+	actingUser, _ := getVerifyUser(c)
+
+	var body struct {
+		Status models.UserStatus `json:"status" binding:"required"`
+		Reason string            `json:"reason"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !internal.ValidUserStatus(body.Status) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status must be active, suspended or deactivated"})
+		return
+	}
+
+	var user models.User
+	if err := initializers.DB.First(&user, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if user.ID == actingUser.ID && body.Status != models.UserStatusActive {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "you cannot suspend or deactivate yourself"})
+		return
+	}
+
+	setUserStatusResponse(c, actingUser, user, body.Status, body.Reason)
+}
+
+func setUserStatusResponse(c *gin.Context, actingUser models.User, user models.User, status models.UserStatus, reason string) {
+	user, err := internal.SetUserStatus(actingUser, user, status, reason)
+	if errors.Is(err, internal.ErrUserHasOpenVisits) {
+		visits, _ := internal.OpenVisits(initializers.DB, user.ID)
+		c.JSON(http.StatusConflict, gin.H{
+			"error":       err.Error(),
+			"open_visits": len(visits),
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	user.Password = ""
+	c.JSON(http.StatusOK, user)
+}
+
+// POST /users/:id/restore
+// makes a suspended or deactivated user active again, also users deleted before deactivation existed
+func RestoreUser(c *gin.Context) {
+	actingUser, _ := getVerifyUser(c)
+
+	var user models.User
+	if err := initializers.DB.Unscoped().First(&user, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	user, err := internal.RestoreUser(actingUser, user)
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+
+	user.Password = ""
+	c.JSON(http.StatusOK, user)
+}
+
+// GET /users/:id/handover?to=2
+// shows which visits and groups a handover would move, and which of them fall on days the new konsulent is away, without moving them
+func PreviewHandover(c *gin.Context) {
+	handover(c, true)
+}
+
+// POST /users/:id/handover
+// moves the visits the user has not performed yet, and with them their groups, to another konsulent
+func Handover(c *gin.Context) {
+	handover(c, false)
+}
+
+func handover(c *gin.Context, dryRun bool) {
+	actingUser, _ := getVerifyUser(c)
+
+	var body struct {
+		ToUserID uint `json:"to_user_id" form:"to" binding:"required"`
+		Override bool `json:"override"` // hand over even though the new konsulent is away on some of the days
+	}
+	var err error
+	if dryRun {
+		err = c.ShouldBindQuery(&body)
+	} else {
+		err = c.ShouldBindJSON(&body)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var from, to models.User
+	if err := initializers.DB.First(&from, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err := initializers.DB.First(&to, body.ToUserID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "The user to hand over to was not found"})
+		return
+	}
+
+	result, err := internal.HandoverVisits(actingUser, from, to, dryRun, body.Override)
+	if unavailableResponse(c, err) {
+		return
+	}
+	if errors.Is(err, internal.ErrHandoverTarget) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	internal.LogUserDelete(actingUser, user)
-	c.Status(http.StatusNoContent)
+	c.JSON(http.StatusOK, gin.H{
+		"dry_run":  dryRun,
+		"handover": result,
+	})
 }
 
 func ChangePassword(c *gin.Context) {
@@ -355,35 +552,20 @@ func ChangePassword(c *gin.Context) {
 		return
 	}
 
-	/* validate password if the request was made by api TODO:make this function
-	if !validateStrength(body.NewPassword) { // implement same rules as FE
-		c.JSON(http.StatusBadRequest, gin.H{"error": "weak password"})
-		return
-	}
-	*/
-
-	// changes the users password
+	olduser := user
 
-	// calculate the hash
-	hash, err := bcrypt.GenerateFromPassword([]byte(body.NewPassword), 14)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"status": "couldnt generate password hash",
-			"error":  err.Error(),
-		})
+	// validates against the policy and stores the hash together with the password history
+	if err := internal.SetPassword(initializers.DB, &user, body.NewPassword); err != nil {
+		passwordPolicyResponse(c, err)
 		return
 	}
-	olduser := user
 
-	// assign hash to user.password and merge with database
-	result := initializers.DB.Model(&user).Update("password", string(hash))
-	if result.Error != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"status": "Error with Database",
-			"error":  result.Error.Error(),
-		})
-		return
+	// every other login must use the new password, a user changing their own password stays logged in here
+	keepSession := uint(0)
+	if actingUser.ID == user.ID {
+		keepSession, _ = getSessionID(c)
 	}
+	internal.RevokeUserSessions(user.ID, keepSession, "password changed")
 
 	internal.LogUserPatch(actingUser, olduser, user)
 	c.Status(http.StatusNoContent)
@@ -5,6 +5,7 @@ import (
 	"log"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/markuskjeldsen/mop-backend-api/initializers"
@@ -50,6 +51,25 @@ func VisitCreation(c *gin.Context) {
 		return
 	}
 
+	// the rules of the visit types are checked for every case before any visit is created
+	ruleErrors := []gin.H{}
+	for _, vd := range visitsData {
+		if vd.VisitType.ID == 0 {
+			continue
+		}
+		visitType, err := internal.FindVisitType(initializers.DB, vd.VisitType.ID)
+		if err == nil {
+			err = internal.CheckRevisit(initializers.DB, visitType, uint(vd.Sagsnr), 0, time.Now())
+		}
+		if err != nil {
+			ruleErrors = append(ruleErrors, gin.H{"sagsnr": vd.Sagsnr, "error": err.Error()})
+		}
+	}
+	if len(ruleErrors) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Some visits break the rules of their visit type", "errors": ruleErrors})
+		return
+	}
+
 	var sagsIds []uint
 	for _, vd := range visitsData {
 		sagsIds = append(sagsIds, uint(vd.Sagsnr))
@@ -144,7 +164,7 @@ func VisitCreation(c *gin.Context) {
 
 	// then get from database
 	var fullyLoadedVisits []models.Visit
-	initializers.DB.Preload("Debitors").Where("id IN ?", createdIDs).Find(&fullyLoadedVisits)
+	initializers.DB.Preload("Debitors").Preload("Type").Where("id IN ?", createdIDs).Find(&fullyLoadedVisits)
 
 	// logging
 	for _, object := range fullyLoadedVisits {
@@ -177,14 +197,14 @@ func VisitFile(c *gin.Context) {
 
 	var visits []models.Visit
 	// Efficiently fetch all visits at once
-	initializers.DB.Preload("Debitors").Where("id IN ?", planData.VisitIds).Find(&visits)
+	initializers.DB.Preload("Debitors").Preload("Type").Where("id IN ?", planData.VisitIds).Find(&visits)
 
 	f, _ := excel.GenerateVisitsExcel(visits)
 	excel.SendExcelResponse(c, f, "plan_visits.xlsx")
 }
 
 func VisitLetterSent(c *gin.Context) {
-	user, ok := getVerifyUser(c)
+	_, ok := getVerifyUser(c)
 	id := c.Query("id")
 	visitID, err := strconv.ParseInt(id, 10, 32)
 
@@ -197,5 +217,13 @@ func VisitLetterSent(c *gin.Context) {
 		return
 	}
 
-	internal.UpdateVisitStatus(uint(visitID), 3, user.ID) // now its ready to visit
+	// now its ready to visit
+	err = initializers.DB.Transaction(func(tx *gorm.DB) error {
+		return transitionVisit(c, tx, uint(visitID), models.VisitStatusReadyToVisit)
+	})
+	if err != nil {
+		transitionErrorResponse(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "letter sent, the visit is ready to visit"})
 }
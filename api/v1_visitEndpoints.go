@@ -1,6 +1,7 @@
 package api
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -117,6 +118,7 @@ func AvailableVisitCreation(c *gin.Context) {
 	})
 }
 
+// Deprecated: returns every visit at once, use GET /api/v2/visits which pages, filters and sorts.
 func GetVisits(c *gin.Context) {
 	var users []models.User
 	user, ok := getVerifyUser(c)
@@ -138,9 +140,15 @@ func GetVisits(c *gin.Context) {
 	})
 }
 
+// GET /visits/types
+// the visit types that can be used, ?all=true includes those that are turned off
 func GetVisitTypes(c *gin.Context) {
 	var visitTypes []models.VisitType
-	initializers.DB.Find(&visitTypes)
+	query := initializers.DB
+	if c.Query("all") != "true" {
+		query = query.Where("active = ?", true)
+	}
+	query.Find(&visitTypes)
 	c.JSON(http.StatusOK, visitTypes)
 }
 
@@ -207,6 +215,7 @@ func GetVisitsById(c *gin.Context) {
 	})
 }
 
+// Deprecated: returns every visit at once, use GET /api/v2/visits/byStatus which pages, filters and sorts.
 func GetVisitsByStatus(c *gin.Context) {
 	status := c.Query("status")
 	var visits []models.Visit
@@ -244,6 +253,7 @@ func GetVisitsByStatus(c *gin.Context) {
 	})
 }
 
+// Deprecated: returns every visit at once, use GET /api/v2/visit-response/all which pages, filters and sorts.
 func Visit_responses(c *gin.Context) {
 	user, ok := getVerifyUser(c)
 	if !ok {
@@ -298,21 +308,38 @@ func Visit_responses(c *gin.Context) {
 
 // POST /visit-response (form data only)
 func CreateVisitResponse(c *gin.Context) {
-	user, _ := getVerifyUser(c)
 	var visitResponse models.VisitResponse
 	if err := c.ShouldBindJSON(&visitResponse); err != nil {
 		fmt.Println(err.Error())
 		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
-
-	if err := initializers.DB.Create(&visitResponse).Error; err != nil {
-		fmt.Println(err.Error())
-		c.JSON(500, gin.H{"error": "Failed to save visit response"})
+	// the id and the version are not the client's to choose, a new response is the first version
+	visitResponse.ID = 0
+	visitResponse.Version = 1
+
+	// the response is only kept if the visit can go to review
+	err := initializers.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&visitResponse).Error; err != nil {
+			fmt.Println(err.Error())
+			return errors.New("Failed to save visit response")
+		}
+		user, _ := getVerifyUser(c)
+		if err := internal.RecordResponseVersion(tx, visitResponse, user.ID); err != nil {
+			return err
+		}
+		// a draft of the response is done with once the response is in
+		if err := tx.Unscoped().Where("visit_id = ?", visitResponse.VisitID).Delete(&models.VisitResponseDraft{}).Error; err != nil {
+			return err
+		}
+		return transitionVisit(c, tx, visitResponse.VisitID, models.VisitStatusToReview)
+	})
+	if err != nil {
+		transitionErrorResponse(c, err)
 		return
 	}
-
-	internal.UpdateVisitStatus(visitResponse.VisitID, 4, user.ID)
+	internal.ProposeFollowUpsQuietly(visitResponse.VisitID)
+	internal.AwardAchievementsQuietly(visitResponse.VisitID)
 	c.JSON(200, visitResponse)
 }
 
@@ -419,18 +446,16 @@ func DeleteVisit(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{})
 		return
 	}
-	var visit models.Visit
-	visit.ID = uint(id)
-
-	result := initializers.DB.Delete(&visit)
-	if result.Error != nil {
+	if err := internal.DeleteVisit(actinguser, uint(id)); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Visit not found"})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": result.Error.Error(),
+			"error": err.Error(),
 		})
 		return
 	}
 
-	internal.LogVisitDelete(actinguser, visit)
-
 	c.Status(http.StatusOK)
 }
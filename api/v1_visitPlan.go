@@ -1,6 +1,7 @@
 package api
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -13,6 +14,8 @@ import (
 	"github.com/markuskjeldsen/mop-backend-api/internal"
 	"github.com/markuskjeldsen/mop-backend-api/internal/excel"
 	"github.com/markuskjeldsen/mop-backend-api/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 func visitIntervalRange(arrivalTime string) string {
@@ -108,8 +111,14 @@ func PlanVisit(c *gin.Context) {
 	}
 
 	headers := rows[0]
+	rowErrors := []gin.H{}
 	userIDUint, _ := strconv.ParseUint(userID, 10, 64)
 
+	// override=true plans the route even though the konsulent is away that day
+	if !checkAvailable(c, user, uint(userIDUint), parsedDate, c.PostForm("override") == "true") {
+		return
+	}
+
 	for i, row := range rows[1:] {
 		// Create map for easy access by column name
 		rowData := make(map[string]string)
@@ -158,29 +167,41 @@ func PlanVisit(c *gin.Context) {
 		}
 
 		// 4. Database logic
-		query := initializers.DB.Model(&models.Visit{}).Where("id = ? AND sagsnr = ?", visitIDUint, sagsnrUint)
-
-		// If not developer, only allow updating visits that are still in 'New' status (status_id = 1)
-		if user.Rights != models.RightsDeveloper { // this restricts the normal user to only the normal flow. but dev can move any case to status 2
-			query = query.Where("status_id = 1")
-		}
-
-		result := query.Updates(updatedVisit)
-
-		if result.Error != nil {
-			fmt.Printf("Database error row %d: %v\n", i+2, result.Error)
-			continue
-		}
-
-		if result.RowsAffected > 0 {
-			// Update the internal status to 2 (Planned/Assigned)
-			internal.UpdateVisitStatus(uint(visitIDUint), 2, user.ID)
+		// only visits that are not planned yet, the row is left as it was if the visit cannot be planned
+		err := initializers.DB.Transaction(func(tx *gorm.DB) error {
+			result := tx.Model(&models.Visit{}).
+				Where("id = ? AND sagsnr = ? AND status_id = ?", visitIDUint, sagsnrUint, models.VisitStatusNotPlanned).
+				Updates(updatedVisit)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				return fmt.Errorf("visit %d is not in status Not planned or does not match sagsnr %d", visitIDUint, sagsnrUint)
+			}
+			var planned models.Visit
+			if err := tx.First(&planned, visitIDUint).Error; err != nil {
+				return err
+			}
+			if err := internal.CheckVisitDate(tx, planned, parsedDate); err != nil {
+				return err
+			}
+			return transitionVisit(c, tx, uint(visitIDUint), models.VisitStatusPlanned)
+		})
+		if err != nil {
+			fmt.Printf("Database error row %d: %v\n", i+2, err)
+			rowErrors = append(rowErrors, gin.H{"row": i + 2, "visit_id": visitIDUint, "error": err.Error()})
 		}
 	}
 
-	c.JSON(200, gin.H{"message": "Visits processed successfully"})
+	c.JSON(200, gin.H{
+		"message":  "Visits processed successfully",
+		"errors":   rowErrors,
+		"group_id": nextGroupId,
+		"warnings": groupWarnings(nextGroupId),
+	})
 }
 
+// Deprecated: returns every planned visit at once, use GET /api/v2/visits/planned which pages, filters and sorts.
 func PlannedVisits(c *gin.Context) {
 	// this endpoint gets the visits that are planned and who is going to visit them
 	// query the database users and their visits there the visit is in status code 2
@@ -231,8 +252,11 @@ func PlannedVisitsExcel(c *gin.Context) {
 	excel.SendExcelResponse(c, file, "PlanlagteBesog.xlsx")
 }
 
+// PATCH /visits/planned/:id
+// a new konsulent or date is checked against absences and the rules of the type and logged like the group endpoints,
+// override plans it even though the konsulent is away. The type and the group cannot be changed here
 func PatchVisit(c *gin.Context) {
-	var visit models.Visit
+	actingUser, _ := getVerifyUser(c)
 	visitIDStr := c.Param("id")
 
 	visitID, err := strconv.ParseUint(visitIDStr, 10, 64)
@@ -241,10 +265,15 @@ func PatchVisit(c *gin.Context) {
 		return
 	}
 
-	if err := c.ShouldBindJSON(&visit); err != nil {
+	var body struct {
+		models.Visit
+		Override bool `json:"override"` // plan it even though the konsulent is away that day
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid data"})
 		return
 	}
+	visit := body.Visit
 
 	var existingVisit models.Visit
 	if err := initializers.DB.First(&existingVisit, visitID).Error; err != nil {
@@ -252,11 +281,92 @@ func PatchVisit(c *gin.Context) {
 		return
 	}
 
-	// Only update non-zero value fields
-	if err := initializers.DB.Model(&existingVisit).Updates(visit).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update visit"})
+	if visit.TypeID != 0 && visit.TypeID != existingVisit.TypeID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "type_id cannot be changed on a planned visit"})
+		return
+	}
+	if visit.GroupId != nil && (existingVisit.GroupId == nil || *visit.GroupId != *existingVisit.GroupId) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "group_id cannot be changed here, use PATCH /visits/:id/group"})
+		return
+	}
+
+	// the konsulent and the date are checked and logged below, the rest is updated as it is
+	newUserID := visit.UserID
+	newDate := visit.VisitDate
+	userChanged := newUserID != 0 && newUserID != existingVisit.UserID
+	dateChanged := !newDate.IsZero() && !newDate.Equal(existingVisit.VisitDate)
+	visit.UserID = 0
+	visit.VisitDate = time.Time{}
+	visit.TypeID = 0
+	visit.GroupId = nil
+
+	// the status can only change along the status graph
+	newStatusID := visit.StatusID
+	visit.StatusID = 0
+	if internal.ReasonRequired(existingVisit.StatusID, newStatusID) {
+		c.JSON(http.StatusConflict, gin.H{"error": "this change needs a reason, use the cancel or postpone endpoint"})
+		return
+	}
+
+	err = initializers.DB.Transaction(func(tx *gorm.DB) error {
+		if userChanged || dateChanged {
+			userID, date := existingVisit.UserID, existingVisit.VisitDate
+			if userChanged {
+				userID = newUserID
+			}
+			if dateChanged {
+				date = newDate
+				if err := internal.CheckVisitDate(tx, existingVisit, newDate); err != nil {
+					return err
+				}
+			}
+			if !date.IsZero() {
+				if err := internal.CheckAvailable(tx, actingUser, userID, date, body.Override); err != nil {
+					return err
+				}
+			}
+
+			// log the changes before the visit is updated
+			if userChanged {
+				if err := internal.UpdateVisitValue(tx, existingVisit.ID, fmt.Sprintf("%v", newUserID), actingUser, "user_id"); err != nil {
+					return err
+				}
+			}
+			if dateChanged {
+				if err := internal.UpdateVisitValue(tx, existingVisit.ID, newDate.Format(time.RFC3339), actingUser, "visit_date"); err != nil {
+					return err
+				}
+			}
+			if err := tx.Model(&existingVisit).Updates(map[string]interface{}{
+				"user_id":    userID,
+				"visit_date": date,
+			}).Error; err != nil {
+				return err
+			}
+		}
+
+		// Only update non-zero value fields, the nested user, type and debitors a client sends back are not saved
+		if err := tx.Model(&existingVisit).Omit(clause.Associations).Updates(visit).Error; err != nil {
+			return err
+		}
+		if newStatusID != 0 && newStatusID != existingVisit.StatusID {
+			return transitionVisit(c, tx, existingVisit.ID, newStatusID)
+		}
+		return nil
+	})
+	if unavailableResponse(c, err) {
+		return
+	}
+	var validationErr internal.ValidationError
+	if errors.As(err, &validationErr) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		transitionErrorResponse(c, err)
 		return
 	}
 
+	initializers.DB.First(&existingVisit, visitID)
 	c.JSON(http.StatusOK, existingVisit)
 }
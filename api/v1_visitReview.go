@@ -1,6 +1,7 @@
 package api
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -9,6 +10,7 @@ import (
 	"github.com/markuskjeldsen/mop-backend-api/initializers"
 	"github.com/markuskjeldsen/mop-backend-api/internal"
 	"github.com/markuskjeldsen/mop-backend-api/models"
+	"gorm.io/gorm"
 )
 
 func VisitPDF(c *gin.Context) {
@@ -51,10 +53,12 @@ func VisitPDF(c *gin.Context) {
 
 	var visit models.Visit
 	initializers.DB.First(&visit, visitID)
-	filename := "id" + strconv.Itoa(int(visit.ID)) + "_sagsnr" + strconv.Itoa(int(visit.Sagsnr)) + ".pdf"
+	version := strconv.Itoa(visitcheck.VisitResponse.Version)
+	filename := "id" + strconv.Itoa(int(visit.ID)) + "_sagsnr" + strconv.Itoa(int(visit.Sagsnr)) + "_v" + version + ".pdf"
 
 	// Set headers for PDF download
-	c.Header("Access-Control-Expose-Headers", "Content-Disposition")
+	c.Header("Access-Control-Expose-Headers", "Content-Disposition, X-Response-Version")
+	c.Header("X-Response-Version", version) // the version of the response the pdf shows
 	c.Header("Content-Type", "application/pdf")
 	c.Header("Content-Disposition", "attachment; filename="+filename)
 	c.Header("Content-Length", fmt.Sprintf("%d", len(pdfBytes)))
@@ -64,7 +68,7 @@ func VisitPDF(c *gin.Context) {
 }
 
 func ReviewedVisit(c *gin.Context) {
-	user, ok := getVerifyUser(c)
+	_, ok := getVerifyUser(c)
 	if !ok {
 		c.JSON(http.StatusUnauthorized, nil)
 		return
@@ -80,19 +84,24 @@ func ReviewedVisit(c *gin.Context) {
 	}
 
 	type iErr struct {
-		Err string `json:"err"`
-		ID  uint   `json:"id"`
+		Err        string                    `json:"err"`
+		ID         uint                      `json:"id"`
+		Transition *internal.TransitionError `json:"transition,omitempty"`
 	}
 
 	var iErrs []iErr
 
 	for _, visitId := range body.ReviewedIds {
 		item := iErr{ID: visitId}
-		err := internal.UpdateVisitStatus(visitId, 5, user.ID)
+		err := initializers.DB.Transaction(func(tx *gorm.DB) error {
+			return transitionVisit(c, tx, visitId, models.VisitStatusExported)
+		})
 		if err != nil {
 			item.Err = err.Error()
+			errors.As(err, &item.Transition)
 		} else {
 			item.Err = "no error"
+			internal.AwardAchievementsQuietly(visitId)
 		}
 
 		iErrs = append(iErrs, item)
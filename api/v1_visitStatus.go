@@ -0,0 +1,82 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/markuskjeldsen/mop-backend-api/initializers"
+	"github.com/markuskjeldsen/mop-backend-api/internal"
+	"github.com/markuskjeldsen/mop-backend-api/middleware"
+	"github.com/markuskjeldsen/mop-backend-api/models"
+	"gorm.io/gorm"
+)
+
+// transitionVisit changes the status of a visit as the user of the request, see internal/visitStatus.go
+func transitionVisit(c *gin.Context, tx *gorm.DB, visitID uint, to uint) error {
+	user, _ := getVerifyUser(c)
+	can := func(permission string) bool {
+		return middleware.Allowed(c, middleware.Permission(permission))
+	}
+	return internal.TransitionVisit(tx, user, can, visitID, to)
+}
+
+// transitionErrorResponse sends a refused status change with the reason, and any other error as a 500
+func transitionErrorResponse(c *gin.Context, err error) {
+	var transitionErr *internal.TransitionError
+	if !errors.As(err, &transitionErr) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	status := http.StatusConflict
+	switch transitionErr.Code {
+	case internal.TransitionNotFound:
+		status = http.StatusNotFound
+	case internal.TransitionForbidden:
+		status = http.StatusForbidden
+	}
+	c.JSON(status, gin.H{
+		"error":      transitionErr.Message,
+		"transition": transitionErr,
+	})
+}
+
+// GET /visits/statuses/transitions
+// the status graph, which status a visit can go to from which and who may do it
+func GetVisitTransitions(c *gin.Context) {
+	c.JSON(http.StatusOK, internal.VisitTransitions())
+}
+
+// PATCH /visits/:id/status
+// moves a visit along the status graph, e.g. back to planned or reopened after review
+func ChangeVisitStatus(c *gin.Context) {
+	visitID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	var body struct {
+		StatusID uint `json:"status_id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var visit models.Visit
+	if err := initializers.DB.First(&visit, visitID).Error; err == nil && internal.ReasonRequired(visit.StatusID, body.StatusID) {
+		c.JSON(http.StatusConflict, gin.H{"error": "this change needs a reason, use the cancel or postpone endpoint"})
+		return
+	}
+
+	err = initializers.DB.Transaction(func(tx *gorm.DB) error {
+		return transitionVisit(c, tx, uint(visitID), body.StatusID)
+	})
+	if err != nil {
+		transitionErrorResponse(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "status changed", "visit_id": visitID, "status_id": body.StatusID})
+}
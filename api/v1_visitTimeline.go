@@ -0,0 +1,51 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/markuskjeldsen/mop-backend-api/initializers"
+	"github.com/markuskjeldsen/mop-backend-api/internal"
+	"github.com/markuskjeldsen/mop-backend-api/middleware"
+	"github.com/markuskjeldsen/mop-backend-api/models"
+	"gorm.io/gorm"
+)
+
+// GET /visits/:id/timeline
+// everything that happened to the visit, oldest first, also when the visit is deleted
+func GetVisitTimeline(c *gin.Context) {
+	actingUser, _ := getVerifyUser(c)
+	visitID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	var visit models.Visit
+	if err := initializers.DB.Unscoped().First(&visit, visitID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Visit not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	isOwner := actingUser.APIKeyID == nil && actingUser.ID == visit.UserID
+	if !isOwner && !middleware.Allowed(c, middleware.PermVisitsRead) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot see the history of another konsulent's visit"})
+		return
+	}
+
+	events, err := internal.VisitTimeline(visit.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"visit_id": visit.ID,
+		"deleted":  visit.DeletedAt.Valid,
+		"events":   events,
+	})
+}
@@ -0,0 +1,67 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/markuskjeldsen/mop-backend-api/internal"
+	"gorm.io/gorm"
+)
+
+// GET /visits/trash
+// the deleted visits with who deleted them, they can be restored until they are purged
+func GetVisitTrash(c *gin.Context) {
+	trash, err := internal.TrashedVisits()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, trash)
+}
+
+// POST /visits/trash/:id/restore
+func RestoreVisit(c *gin.Context) {
+	actingUser, _ := getVerifyUser(c)
+	visitID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	visit, err := internal.RestoreVisit(actingUser, uint(visitID))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Visit not found"})
+		return
+	}
+	if errors.Is(err, internal.ErrVisitNotDeleted) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, visit)
+}
+
+// DELETE /visits/trash?days=30
+// removes the visits deleted more than days ago for good, days cannot be less than the retention period
+func PurgeVisitTrash(c *gin.Context) {
+	actingUser, _ := getVerifyUser(c)
+	minDays := int(internal.VisitTrashRetention.Hours() / 24)
+	days, err := strconv.Atoi(c.DefaultQuery("days", strconv.Itoa(minDays)))
+	if err != nil || days < minDays {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "days must be a number of at least " + strconv.Itoa(minDays)})
+		return
+	}
+
+	result, err := internal.PurgeVisits(actingUser, time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
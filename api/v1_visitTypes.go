@@ -0,0 +1,122 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/markuskjeldsen/mop-backend-api/initializers"
+	"github.com/markuskjeldsen/mop-backend-api/internal"
+	"github.com/markuskjeldsen/mop-backend-api/models"
+)
+
+type visitTypeBody struct {
+	Text               string `json:"text" binding:"required"`
+	Description        string `json:"description"`
+	Unannounced        bool   `json:"unannounced"`
+	MinNoticeDays      int    `json:"min_notice_days"`
+	Revisit            bool   `json:"revisit"`
+	RevisitOfAnnounced bool   `json:"revisit_of_announced"`
+	RevisitMinDays     int    `json:"revisit_min_days"`
+	RevisitMaxDays     int    `json:"revisit_max_days"`
+	ServiceMinutes     int    `json:"service_minutes"`
+	Active             *bool  `json:"active"`
+}
+
+func bindVisitType(c *gin.Context, visitType *models.VisitType) bool {
+	var body visitTypeBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	visitType.Text = body.Text
+	visitType.Description = body.Description
+	visitType.Unannounced = body.Unannounced
+	visitType.MinNoticeDays = body.MinNoticeDays
+	visitType.Revisit = body.Revisit
+	visitType.RevisitOfAnnounced = body.RevisitOfAnnounced
+	visitType.RevisitMinDays = body.RevisitMinDays
+	visitType.RevisitMaxDays = body.RevisitMaxDays
+	visitType.ServiceMinutes = body.ServiceMinutes
+	visitType.Active = body.Active == nil || *body.Active
+	if err := internal.ValidateVisitType(*visitType); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+// POST /visits/types
+func CreateVisitType(c *gin.Context) {
+	var visitType models.VisitType
+	if !bindVisitType(c, &visitType) {
+		return
+	}
+	if err := initializers.DB.Create(&visitType).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, visitType)
+}
+
+// PUT /visits/types/:id
+// the new rules apply when visits are created or planned, existing visits are not checked again
+func UpdateVisitType(c *gin.Context) {
+	var visitType models.VisitType
+	if err := initializers.DB.First(&visitType, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Visit type not found"})
+		return
+	}
+	if !bindVisitType(c, &visitType) {
+		return
+	}
+	if err := initializers.DB.Save(&visitType).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, visitType)
+}
+
+// DELETE /visits/types/:id
+// turns the type off, visits that already have it keep it
+func DeleteVisitType(c *gin.Context) {
+	result := initializers.DB.Model(&models.VisitType{}).Where("id = ?", c.Param("id")).Update("active", false)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error.Error()})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Visit type not found"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// GET /visits/types/eligible?sagsnr=123&date=2024-07-01
+// the visit types a case can get, e.g. whether an unannounced revisit is still possible, date defaults to today
+func GetEligibleVisitTypes(c *gin.Context) {
+	sagsnr, err := strconv.ParseUint(c.Query("sagsnr"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sagsnr is required"})
+		return
+	}
+	date, ok := dateQuery(c, "date")
+	if !ok {
+		return
+	}
+	if date.IsZero() {
+		date = time.Now()
+	}
+
+	types, err := internal.EligibleVisitTypes(uint(sagsnr), date)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"sagsnr": sagsnr,
+		"date":   date.Format("2006-01-02"),
+		"types":  types,
+	})
+}
@@ -0,0 +1,166 @@
+package api2
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/markuskjeldsen/mop-backend-api/internal"
+	"github.com/markuskjeldsen/mop-backend-api/middleware"
+	"github.com/markuskjeldsen/mop-backend-api/models"
+)
+
+// the listings below share the query parameters
+// ?status=2,3 &from=2024-01-01 &to=2024-01-31 &userId= &sagsnr= &klient= &groupId= &typeId= &include_unassigned=true
+// ?sort=-visit_date &limit=50 and either &offset=100 or &cursor=<next_cursor of the page before>
+// and they answer with the page envelope from internal.Page
+
+func uintQuery(c *gin.Context, name string) (uint, bool) {
+	q := c.Query(name)
+	if q == "" {
+		return 0, true
+	}
+	v, err := strconv.ParseUint(q, 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + name})
+		return 0, false
+	}
+	return uint(v), true
+}
+
+func dateQuery(c *gin.Context, name string) (time.Time, bool) {
+	q := c.Query(name)
+	if q == "" {
+		return time.Time{}, true
+	}
+	t, err := time.Parse("2006-01-02", q)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + name + ". Use YYYY-MM-DD"})
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// parseVisitQuery reads the filter and page from the query, it has answered the request when ok is false
+func parseVisitQuery(c *gin.Context) (filter internal.VisitFilter, page internal.PageRequest, ok bool) {
+	if status := c.Query("status"); status != "" {
+		for _, s := range strings.Split(status, ",") {
+			id, err := strconv.ParseUint(strings.TrimSpace(s), 10, 64)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status"})
+				return filter, page, false
+			}
+			filter.StatusIDs = append(filter.StatusIDs, uint(id))
+		}
+	}
+	if filter.From, ok = dateQuery(c, "from"); !ok {
+		return
+	}
+	if filter.To, ok = dateQuery(c, "to"); !ok {
+		return
+	}
+	if filter.UserID, ok = uintQuery(c, "userId"); !ok {
+		return
+	}
+	if filter.Sagsnr, ok = uintQuery(c, "sagsnr"); !ok {
+		return
+	}
+	if filter.GroupID, ok = uintQuery(c, "groupId"); !ok {
+		return
+	}
+	if filter.TypeID, ok = uintQuery(c, "typeId"); !ok {
+		return
+	}
+	filter.Klient = c.Query("klient")
+	filter.IncludeUnassigned = c.Query("include_unassigned") == "true"
+
+	var limit, offset uint
+	if limit, ok = uintQuery(c, "limit"); !ok {
+		return
+	}
+	if offset, ok = uintQuery(c, "offset"); !ok {
+		return
+	}
+	page = internal.PageRequest{
+		Limit:  int(limit),
+		Offset: int(offset),
+		Cursor: c.Query("cursor"),
+		Sort:   c.Query("sort"),
+	}
+	return filter, page, true
+}
+
+// listVisits answers with one page of the visits that match the query and the filter the endpoint adds.
+// Every visit is listed when the request has one of the permissions, otherwise only the visits of the user
+func listVisits(c *gin.Context, seeAllWith []middleware.Permission, filter internal.VisitFilter, page internal.PageRequest, preloads ...string) {
+	user, _ := getVerifyUser(c)
+	seeAll := false
+	for _, permission := range seeAllWith {
+		seeAll = seeAll || middleware.Allowed(c, permission)
+	}
+	result, err := internal.ListVisits(user, seeAll, filter, page, preloads...)
+	var validationErr internal.ValidationError
+	if errors.As(err, &validationErr) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	for i := range result.Items {
+		result.Items[i].User.Password = ""
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// GET /api/v2/visits
+// without visits:read only the visits of the user are listed
+func GetVisits(c *gin.Context) {
+	filter, page, ok := parseVisitQuery(c)
+	if !ok {
+		return
+	}
+	listVisits(c, []middleware.Permission{middleware.PermVisitsRead}, filter, page, "Debitors", "Type", "Status", "User")
+}
+
+// GET /api/v2/visit-response/all
+// the visits that have a response, with the response, ?sort=-act_date sorts by when the visit was made
+func GetVisitResponses(c *gin.Context) {
+	filter, page, ok := parseVisitQuery(c)
+	if !ok {
+		return
+	}
+	filter.HasResponse = true
+	listVisits(c, []middleware.Permission{middleware.PermVisitsRead}, filter, page, "Debitors", "Type", "Status", "User", "VisitResponse")
+}
+
+// GET /api/v2/visits/byStatus?status=4
+func GetVisitsByStatus(c *gin.Context) {
+	filter, page, ok := parseVisitQuery(c)
+	if !ok {
+		return
+	}
+	if len(filter.StatusIDs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status is required"})
+		return
+	}
+	listVisits(c, []middleware.Permission{middleware.PermVisitsRead}, filter, page, "Debitors", "Type", "Status", "User", "VisitResponse")
+}
+
+// GET /api/v2/visits/planned
+// the planned visits with their konsulent, by default sorted by date and stop. Planning sees every konsulent
+func GetPlannedVisits(c *gin.Context) {
+	filter, page, ok := parseVisitQuery(c)
+	if !ok {
+		return
+	}
+	filter.StatusIDs = []uint{models.VisitStatusPlanned}
+	if page.Sort == "" {
+		page.Sort = "visit_date"
+	}
+	listVisits(c, []middleware.Permission{middleware.PermVisitsRead, middleware.PermVisitsPlan}, filter, page, "Debitors", "User")
+}
@@ -1,9 +1,11 @@
 package initializers
 
 import (
+	"database/sql"
 	"io"
 	"log"
 
+	"github.com/mattn/go-sqlite3"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
@@ -11,10 +13,34 @@ import (
 
 var DB *gorm.DB
 
+// sqliteDriver is sqlite with the functions of sqliteFunctions added to every connection
+const sqliteDriver = "sqlite3_mop"
+
+var sqliteFunctions = map[string]any{}
+
+// RegisterSQLiteFunction makes a go function callable from sql, e.g. to rank search results in the query.
+// It has to be called from an init function, before the database is connected.
+func RegisterSQLiteFunction(name string, fn any) {
+	sqliteFunctions[name] = fn
+}
+
+func init() {
+	sql.Register(sqliteDriver, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			for name, fn := range sqliteFunctions {
+				if err := conn.RegisterFunc(name, fn, true); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+}
+
 func ConnectToDB() {
 	var err error
 
-	DB, err = gorm.Open(sqlite.Open("data.db"), &gorm.Config{
+	DB, err = gorm.Open(sqlite.New(sqlite.Config{DriverName: sqliteDriver, DSN: "data.db"}), &gorm.Config{
 		Logger: logger.New(log.New(io.Discard, "", 0), logger.Config{
 			LogLevel:                  logger.Silent,
 			IgnoreRecordNotFoundError: true,
@@ -0,0 +1,126 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/markuskjeldsen/mop-backend-api/initializers"
+	"github.com/markuskjeldsen/mop-backend-api/models"
+)
+
+// APIKeyPrefix starts every key, so a key can never be mistaken for a jwt
+const APIKeyPrefix = "mop_"
+
+// last_used_at is only written when it is older than this, a busy integration should not write on every request
+const apiKeyTouchInterval = time.Minute
+
+var ErrAPIKeyInvalid = errors.New("invalid, expired or revoked api key")
+
+// IsAPIKey tells an api key apart from an access token.
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, APIKeyPrefix)
+}
+
+// CreateAPIKey stores a new key and returns it in clear text, this is the only time it can be read.
+func CreateAPIKey(actingUser models.User, name string, permissions []string, expiresAt *time.Time) (string, models.APIKey, error) {
+	random, err := newRandomToken()
+	if err != nil {
+		return "", models.APIKey{}, err
+	}
+	key := APIKeyPrefix + random
+
+	perms, err := json.Marshal(permissions)
+	if err != nil {
+		return "", models.APIKey{}, err
+	}
+
+	apiKey := models.APIKey{
+		Name:        name,
+		Prefix:      key[:len(APIKeyPrefix)+8],
+		KeyHash:     hashToken(key),
+		Permissions: perms,
+		ExpiresAt:   expiresAt,
+		CreatedByID: actingUser.ID,
+	}
+	if err := initializers.DB.Create(&apiKey).Error; err != nil {
+		return "", models.APIKey{}, err
+	}
+
+	logAPIKey(actingUser, apiKey, nil, "CREATE API KEY")
+	return key, apiKey, nil
+}
+
+// AuthenticateAPIKey finds the key and records that it was used.
+func AuthenticateAPIKey(key string, ip string) (models.APIKey, error) {
+	var apiKey models.APIKey
+	err := initializers.DB.Where("key_hash = ? AND revoked_at IS NULL", hashToken(key)).First(&apiKey).Error
+	if err != nil {
+		return models.APIKey{}, ErrAPIKeyInvalid
+	}
+	if apiKey.ExpiresAt != nil && apiKey.ExpiresAt.Before(time.Now()) {
+		return models.APIKey{}, ErrAPIKeyInvalid
+	}
+
+	if apiKey.LastUsedAt == nil || time.Since(*apiKey.LastUsedAt) > apiKeyTouchInterval || apiKey.LastUsedIP != ip {
+		now := time.Now()
+		initializers.DB.Model(&apiKey).Updates(map[string]interface{}{
+			"last_used_at": &now,
+			"last_used_ip": ip,
+		})
+	}
+	return apiKey, nil
+}
+
+// APIKeyPermissions returns the permission names the key is scoped to.
+func APIKeyPermissions(apiKey models.APIKey) []string {
+	var permissions []string
+	json.Unmarshal(apiKey.Permissions, &permissions)
+	return permissions
+}
+
+// APIKeyPrincipal is the stand-in user for requests made with the key,
+// it has no rights of its own and carries the key id so the ActivityLog can name the key.
+func APIKeyPrincipal(apiKey models.APIKey) models.User {
+	return models.User{
+		Name:     apiKey.Name,
+		Username: "apikey:" + apiKey.Prefix,
+		APIKeyID: &apiKey.ID,
+	}
+}
+
+// RevokeAPIKey stops the key from working, the row is kept for the ActivityLog.
+func RevokeAPIKey(actingUser models.User, id uint) (models.APIKey, error) {
+	var apiKey models.APIKey
+	if err := initializers.DB.First(&apiKey, id).Error; err != nil {
+		return models.APIKey{}, err
+	}
+	if apiKey.RevokedAt != nil {
+		return apiKey, nil
+	}
+	prev := apiKey
+	now := time.Now()
+	if err := initializers.DB.Model(&apiKey).Update("revoked_at", &now).Error; err != nil {
+		return models.APIKey{}, err
+	}
+
+	logAPIKey(actingUser, apiKey, &prev, "REVOKE API KEY")
+	return apiKey, nil
+}
+
+func logAPIKey(actingUser models.User, apiKey models.APIKey, prev *models.APIKey, action string) {
+	activity := models.ActivityLog{
+		ActingUserID:   actingUser.ID,
+		APIKeyID:       actingUser.APIKeyID,
+		ImpersonatorID: actingUser.ImpersonatorID,
+		TargetID:       apiKey.ID,
+		TargetIDType:   "api_key",
+		ActionType:     action,
+	}
+	if prev != nil {
+		activity.PrevVal, _ = json.Marshal(prev)
+	}
+	activity.CurrentVal, _ = json.Marshal(apiKey)
+	initializers.DB.Create(&activity)
+}
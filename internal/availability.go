@@ -0,0 +1,243 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/markuskjeldsen/mop-backend-api/initializers"
+	"github.com/markuskjeldsen/mop-backend-api/models"
+	"gorm.io/gorm"
+)
+
+// ErrKonsulentUnavailable is returned when visits are put on a day the konsulent is absent and the planner did not override it.
+var ErrKonsulentUnavailable = errors.New("the konsulent is not available on that day, send override to plan it anyway")
+
+// UnavailableError is ErrKonsulentUnavailable with the absences that cover the day.
+type UnavailableError struct {
+	Absences []models.Absence
+}
+
+func (e UnavailableError) Error() string { return ErrKonsulentUnavailable.Error() }
+
+func (e UnavailableError) Unwrap() error { return ErrKonsulentUnavailable }
+
+func ValidAbsenceType(t models.AbsenceType) bool {
+	switch t {
+	case models.AbsenceVacation, models.AbsenceSick, models.AbsenceBlocked, models.AbsenceOther:
+		return true
+	}
+	return false
+}
+
+func validateAbsence(absence models.Absence) error {
+	if !ValidAbsenceType(absence.Type) {
+		return ValidationError{"type must be vacation, sick, blocked or other"}
+	}
+	if absence.StartDate.IsZero() || absence.EndDate.IsZero() {
+		return ValidationError{"start_date and end_date are required"}
+	}
+	if absence.EndDate.Before(absence.StartDate) {
+		return ValidationError{"end_date is before start_date"}
+	}
+	return nil
+}
+
+// Absences of the user that overlap the days from and to, both included. A zero from or to leaves that end open.
+func Absences(userID uint, from time.Time, to time.Time) ([]models.Absence, error) {
+	return absencesBetween(initializers.DB, userID, from, to)
+}
+
+func absencesBetween(db *gorm.DB, userID uint, from time.Time, to time.Time) ([]models.Absence, error) {
+	query := db.Where("user_id = ?", userID)
+	if !from.IsZero() {
+		query = query.Where("DATE(end_date) >= ?", from.Format("2006-01-02"))
+	}
+	if !to.IsZero() {
+		query = query.Where("DATE(start_date) <= ?", to.Format("2006-01-02"))
+	}
+	var absences []models.Absence
+	err := query.Order("start_date").Find(&absences).Error
+	return absences, err
+}
+
+// AbsentOn returns the absences of the user that cover the day, it is empty when they are available.
+func AbsentOn(userID uint, date time.Time) []models.Absence {
+	absences, _ := Absences(userID, date, date)
+	return absences
+}
+
+// CheckAvailable refuses a konsulent who is absent on the day with an UnavailableError, unless the planner overrides it.
+// An override is written to the activity log in the same transaction, so it is only logged when the visits are planned.
+func CheckAvailable(tx *gorm.DB, actingUser models.User, userID uint, date time.Time, override bool) error {
+	absences, err := absencesBetween(tx, userID, date, date)
+	if err != nil {
+		return err
+	}
+	if len(absences) == 0 {
+		return nil
+	}
+	if !override {
+		return UnavailableError{absences}
+	}
+
+	currJSON, _ := json.Marshal(map[string]interface{}{
+		"date":     date.Format("2006-01-02"),
+		"absences": absences,
+	})
+	return tx.Create(&models.ActivityLog{
+		ActingUserID:   actingUser.ID,
+		APIKeyID:       actingUser.APIKeyID,
+		ImpersonatorID: actingUser.ImpersonatorID,
+		TargetID:       userID,
+		TargetIDType:   "user",
+		ActionType:     "OVERRIDE ABSENCE",
+		CurrentVal:     currJSON,
+	}).Error
+}
+
+func CreateAbsence(actingUser models.User, absence models.Absence) (models.Absence, error) {
+	if err := validateAbsence(absence); err != nil {
+		return models.Absence{}, err
+	}
+	absence.ID = 0
+	absence.CreatedByID = actingUser.ID
+	if err := initializers.DB.Create(&absence).Error; err != nil {
+		return models.Absence{}, err
+	}
+	logAbsence(actingUser, models.Absence{}, absence, "CREATE ABSENCE")
+	return absence, nil
+}
+
+func UpdateAbsence(actingUser models.User, previous models.Absence, absence models.Absence) (models.Absence, error) {
+	if err := validateAbsence(absence); err != nil {
+		return models.Absence{}, err
+	}
+	err := initializers.DB.Model(&absence).Updates(map[string]interface{}{
+		"type":       absence.Type,
+		"start_date": absence.StartDate,
+		"end_date":   absence.EndDate,
+		"note":       absence.Note,
+	}).Error
+	if err != nil {
+		return models.Absence{}, err
+	}
+	logAbsence(actingUser, previous, absence, "UPDATE ABSENCE")
+	return absence, nil
+}
+
+func DeleteAbsence(actingUser models.User, absence models.Absence) error {
+	if err := initializers.DB.Delete(&absence).Error; err != nil {
+		return err
+	}
+	logAbsence(actingUser, absence, models.Absence{}, "DELETE ABSENCE")
+	return nil
+}
+
+func logAbsence(actingUser models.User, previous models.Absence, current models.Absence, action string) {
+	var prevJSON, currJSON []byte
+	targetID := current.UserID
+	if previous.ID != 0 {
+		prevJSON, _ = json.Marshal(previous)
+		targetID = previous.UserID
+	}
+	if current.ID != 0 {
+		currJSON, _ = json.Marshal(current)
+	}
+	initializers.DB.Create(&models.ActivityLog{
+		ActingUserID:   actingUser.ID,
+		APIKeyID:       actingUser.APIKeyID,
+		ImpersonatorID: actingUser.ImpersonatorID,
+		TargetID:       targetID,
+		TargetIDType:   "user",
+		ActionType:     action,
+		PrevVal:        prevJSON,
+		CurrentVal:     currJSON,
+	})
+}
+
+// FreeKonsulent is a konsulent who can take visits on a day.
+type FreeKonsulent struct {
+	UserID          uint                           `json:"user_id"`
+	Name            string                         `json:"name"`
+	Initials        string                         `json:"initials"`
+	PlannedVisits   int                            `json:"planned_visits"`
+	MaxVisitsPerDay int                            `json:"max_visits_per_day"` // 0 is no limit
+	WorkingHours    []models.KonsulentWorkingHours `json:"working_hours"`
+}
+
+// FreeKonsulenter are the active users who are not absent, work on the weekday, have room for more visits
+// and cover the postnr. A postnr of 0 leaves out the region check.
+func FreeKonsulenter(date time.Time, postnr int) ([]FreeKonsulent, error) {
+	var users []models.User
+	err := initializers.DB.
+		Where("id != 1 AND rights = ? AND (status = ? OR status = '' OR status IS NULL)", models.RightsUser, models.UserStatusActive).
+		Order("name").
+		Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+
+	free := []FreeKonsulent{}
+	for _, user := range users {
+		if len(AbsentOn(user.ID, date)) > 0 {
+			continue
+		}
+
+		var planned int64
+		initializers.DB.Model(&models.Visit{}).
+			Where("user_id = ? AND DATE(visit_date) = ?", user.ID, date.Format("2006-01-02")).
+			Count(&planned)
+
+		konsulent := FreeKonsulent{
+			UserID:        user.ID,
+			Name:          user.Name,
+			Initials:      user.Initials,
+			PlannedVisits: int(planned),
+			WorkingHours:  []models.KonsulentWorkingHours{},
+		}
+
+		if profile, ok := KonsulentProfile(user.ID); ok {
+			if len(profile.WorkingHours) > 0 {
+				for _, h := range profile.WorkingHours {
+					if h.Weekday == date.Weekday() {
+						konsulent.WorkingHours = append(konsulent.WorkingHours, h)
+					}
+				}
+				if len(konsulent.WorkingHours) == 0 {
+					continue
+				}
+			}
+			if profile.MaxVisitsPerDay > 0 && int(planned) >= profile.MaxVisitsPerDay {
+				continue
+			}
+			if postnr != 0 && len(profile.Regions) > 0 && !inRegions(postnr, profile.Regions) {
+				continue
+			}
+			konsulent.MaxVisitsPerDay = profile.MaxVisitsPerDay
+		}
+
+		free = append(free, konsulent)
+	}
+	return free, nil
+}
+
+// absenceWarning is added to the assignment warnings so the check endpoint shows absences as well
+func absenceWarning(user models.User, date time.Time) (AssignmentWarning, bool) {
+	absences := AbsentOn(user.ID, date)
+	if len(absences) == 0 {
+		return AssignmentWarning{}, false
+	}
+	return AssignmentWarning{
+		Code:    "absent",
+		Message: fmt.Sprintf("%s is away on %s (%s)", user.Name, date.Format("2006-01-02"), absences[0].Type),
+	}, true
+}
+
+// FindAbsence returns the absence if it belongs to the user.
+func FindAbsence(userID uint, absenceID uint) (models.Absence, error) {
+	var absence models.Absence
+	err := initializers.DB.Where("id = ? AND user_id = ?", absenceID, userID).First(&absence).Error
+	return absence, err
+}
@@ -0,0 +1,152 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/markuskjeldsen/mop-backend-api/initializers"
+	"github.com/markuskjeldsen/mop-backend-api/models"
+	"gorm.io/gorm"
+)
+
+func ValidReasonKind(kind models.ReasonKind) bool {
+	return kind == models.ReasonCancel || kind == models.ReasonPostpone
+}
+
+// FindReasonCode returns the active reason code for the kind, the error is a ValidationError if there is none.
+func FindReasonCode(tx *gorm.DB, code string, kind models.ReasonKind) (models.VisitReasonCode, error) {
+	var reason models.VisitReasonCode
+	err := tx.Where("code = ? AND active = ?", code, true).First(&reason).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return reason, ValidationError{fmt.Sprintf("unknown reason code %q", code)}
+	}
+	if err != nil {
+		return reason, err
+	}
+	if reason.Kind != kind {
+		return reason, ValidationError{fmt.Sprintf("%s is a reason to %s, not to %s", code, reason.Kind, kind)}
+	}
+	return reason, nil
+}
+
+// takeOut records the reason and moves the visit to the status, the transition errors are returned as they are.
+func takeOut(tx *gorm.DB, actingUser models.User, can PermissionCheck, visitID uint, kind models.ReasonKind, code string, note string, to uint) (models.VisitCancellation, error) {
+	reason, err := FindReasonCode(tx, code, kind)
+	if err != nil {
+		return models.VisitCancellation{}, err
+	}
+	var visit models.Visit
+	if err := tx.First(&visit, visitID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return models.VisitCancellation{}, &TransitionError{Code: TransitionNotFound, Message: "visit not found", VisitID: visitID, To: to}
+		}
+		return models.VisitCancellation{}, err
+	}
+
+	if err := TransitionVisit(tx, actingUser, can, visitID, to); err != nil {
+		return models.VisitCancellation{}, err
+	}
+	cancellation := models.VisitCancellation{
+		VisitID:         visit.ID,
+		Kind:            kind,
+		ReasonCodeID:    reason.ID,
+		ReasonCode:      reason,
+		Note:            note,
+		PreviousStatus:  visit.StatusID,
+		PreviousDate:    visit.VisitDate,
+		PreviousGroupID: visit.GroupId,
+		CreatedByID:     actingUser.ID,
+	}
+	if err := tx.Omit("ReasonCode").Create(&cancellation).Error; err != nil {
+		return cancellation, err
+	}
+	return cancellation, nil
+}
+
+// CancelVisit takes the visit out of the pipeline for good, it is kept with the cancelled status.
+// Follow-up proposals waiting for the visit are dismissed.
+func CancelVisit(tx *gorm.DB, actingUser models.User, can PermissionCheck, visitID uint, code string, note string) (models.VisitCancellation, error) {
+	cancellation, err := takeOut(tx, actingUser, can, visitID, models.ReasonCancel, code, note, models.VisitStatusCancelled)
+	if err != nil {
+		return cancellation, err
+	}
+	err = tx.Model(&models.FollowUpProposal{}).
+		Where("visit_id = ? AND status = ?", visitID, models.FollowUpPending).
+		Updates(map[string]interface{}{
+			"status":           models.FollowUpDismissed,
+			"decided_by_id":    actingUser.ID,
+			"decided_at":       time.Now(),
+			"dismissed_reason": "the visit was cancelled: " + cancellation.ReasonCode.Text,
+		}).Error
+	return cancellation, err
+}
+
+// PostponeVisit sends a planned visit back to planning, it leaves its group and loses its date.
+func PostponeVisit(tx *gorm.DB, actingUser models.User, can PermissionCheck, visitID uint, code string, note string) (models.VisitCancellation, error) {
+	cancellation, err := takeOut(tx, actingUser, can, visitID, models.ReasonPostpone, code, note, models.VisitStatusNotPlanned)
+	if err != nil {
+		return cancellation, err
+	}
+	if err := UpdateVisitValue(tx, visitID, "0", actingUser, "group_id"); err != nil {
+		return cancellation, err
+	}
+	if err := UpdateVisitValue(tx, visitID, time.Time{}.Format(time.RFC3339), actingUser, "visit_date"); err != nil {
+		return cancellation, err
+	}
+	err = tx.Model(&models.Visit{}).Where("id = ?", visitID).Updates(map[string]interface{}{
+		"group_id":   nil,
+		"visit_date": time.Time{},
+		"stopnr":     0,
+	}).Error
+	return cancellation, err
+}
+
+// CancellationCount is one line of the cancellation report.
+type CancellationCount struct {
+	ReasonCode string `json:"reason_code"`
+	ReasonText string `json:"reason_text"`
+	Count      int    `json:"count"`
+}
+
+// ClientCancellationCount is the count of one reason for one client.
+type ClientCancellationCount struct {
+	Klient string `json:"klient"`
+	CancellationCount
+}
+
+// CancellationReport counts the cancellations or postponements made between from and to, both days included,
+// per client and reason, and per reason alone. Zero from and to means all time.
+func CancellationReport(kind models.ReasonKind, from time.Time, to time.Time) ([]ClientCancellationCount, []CancellationCount, error) {
+	base := func() *gorm.DB {
+		q := initializers.DB.Table("visit_cancellations").
+			Joins("JOIN visits ON visits.id = visit_cancellations.visit_id").
+			Joins("JOIN visit_reason_codes ON visit_reason_codes.id = visit_cancellations.reason_code_id").
+			Where("visit_cancellations.deleted_at IS NULL AND visit_cancellations.kind = ?", kind)
+		if !from.IsZero() {
+			q = q.Where("DATE(visit_cancellations.created_at) >= ?", from.Format("2006-01-02"))
+		}
+		if !to.IsZero() {
+			q = q.Where("DATE(visit_cancellations.created_at) <= ?", to.Format("2006-01-02"))
+		}
+		return q
+	}
+
+	byClient := []ClientCancellationCount{}
+	err := base().
+		Select("visits.advopro_klient AS klient, visit_reason_codes.code AS reason_code, visit_reason_codes.text AS reason_text, COUNT(*) AS count").
+		Group("visits.advopro_klient, visit_reason_codes.code, visit_reason_codes.text").
+		Order("visits.advopro_klient, count DESC").
+		Scan(&byClient).Error
+	if err != nil {
+		return nil, nil, err
+	}
+
+	byReason := []CancellationCount{}
+	err = base().
+		Select("visit_reason_codes.code AS reason_code, visit_reason_codes.text AS reason_text, COUNT(*) AS count").
+		Group("visit_reason_codes.code, visit_reason_codes.text").
+		Order("count DESC").
+		Scan(&byReason).Error
+	return byClient, byReason, err
+}
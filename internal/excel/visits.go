@@ -52,7 +52,7 @@ func GenerateVisitsExcel(visits []models.Visit) (*excelize.File, error) {
 		data := []interface{}{
 			visit.Sagsnr,
 			replacer.Replace(visit.Address),
-			"15",
+			fmt.Sprintf("%d", visit.Type.ServiceTime()),
 			strings.Join(debitorNames, ", "),
 			fmt.Sprintf("%d", visit.AdvoproStatus),
 			visit.AdvoproStatusText,
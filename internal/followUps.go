@@ -0,0 +1,267 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/markuskjeldsen/mop-backend-api/initializers"
+	"github.com/markuskjeldsen/mop-backend-api/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrFollowUpDecided = errors.New("the proposal has already been accepted or dismissed")
+
+// EscalateAfterNotHome is how many visits in a row the debitor can be away before the case goes to the office.
+const EscalateAfterNotHome = 3
+
+// followUpRule looks at a performed visit where the debitor was not home and returns a proposal, or nil.
+type followUpRule func(visit models.Visit, response models.VisitResponse) (*models.FollowUpProposal, error)
+
+// followUpRules are tried in order. Escalation comes first and stops the rest,
+// so a case that keeps failing goes to the office instead of getting yet another visit.
+var followUpRules = []followUpRule{escalateRule, revisitRule, otherTimeRule}
+
+func escalateRule(visit models.Visit, response models.VisitResponse) (*models.FollowUpProposal, error) {
+	var answers []*bool
+	err := initializers.DB.Table("visit_responses").
+		Joins("JOIN visits ON visits.id = visit_responses.visit_id AND visits.deleted_at IS NULL").
+		Where("visits.sagsnr = ? AND visit_responses.deleted_at IS NULL", visit.Sagsnr).
+		Order("visit_responses.act_date DESC, visit_responses.id DESC").
+		Limit(EscalateAfterNotHome).
+		Pluck("visit_responses.debitor_is_home", &answers).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(answers) < EscalateAfterNotHome {
+		return nil, nil
+	}
+	for _, home := range answers {
+		if home == nil || *home {
+			return nil, nil
+		}
+	}
+	return &models.FollowUpProposal{
+		Kind:   models.FollowUpEscalate,
+		Reason: fmt.Sprintf("the debitor was not home the last %d visits of case %d", EscalateAfterNotHome, visit.Sagsnr),
+	}, nil
+}
+
+func revisitRule(visit models.Visit, response models.VisitResponse) (*models.FollowUpProposal, error) {
+	types, err := EligibleVisitTypes(visit.Sagsnr, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range types {
+		if !t.Eligible || !t.Revisit || !t.Unannounced {
+			continue
+		}
+		id := t.ID
+		return &models.FollowUpProposal{
+			Kind:         models.FollowUpRevisit,
+			Reason:       fmt.Sprintf("the debitor was not home, %s is possible", t.Text),
+			VisitTypeID:  &id,
+			EarliestDate: t.EarliestDate,
+			LatestDate:   t.LatestDate,
+		}, nil
+	}
+	return nil, nil
+}
+
+func otherTimeRule(visit models.Visit, response models.VisitResponse) (*models.FollowUpProposal, error) {
+	at, err := time.Parse("15:04", response.ActTime)
+	if err != nil {
+		at, _ = time.Parse("15:04", visit.VisitTime)
+	}
+	preferred := "17:00 - 20:00"
+	if at.Hour() >= 16 {
+		preferred = "09:00 - 12:00"
+	}
+	return &models.FollowUpProposal{
+		Kind:          models.FollowUpOtherTime,
+		Reason:        fmt.Sprintf("the debitor was not home at %s, try %s", response.ActTime, preferred),
+		PreferredTime: preferred,
+	}, nil
+}
+
+// ProposeFollowUps runs the rules for a visit that just got a response, and queues what they propose.
+// Nothing is proposed when the debitor was home or it was not noted. A rule only proposes once per visit.
+func ProposeFollowUps(visitID uint) ([]models.FollowUpProposal, error) {
+	var visit models.Visit
+	if err := initializers.DB.Preload("VisitResponse").First(&visit, visitID).Error; err != nil {
+		return nil, err
+	}
+	response := visit.VisitResponse
+	if response == nil || response.DebitorIsHome == nil || *response.DebitorIsHome {
+		return nil, nil
+	}
+
+	proposals := []models.FollowUpProposal{}
+	for _, rule := range followUpRules {
+		proposal, err := rule(visit, *response)
+		if err != nil {
+			return nil, err
+		}
+		if proposal == nil {
+			continue
+		}
+		proposal.VisitID = visit.ID
+		proposal.Status = models.FollowUpPending
+		result := initializers.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(proposal)
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		if result.RowsAffected > 0 {
+			proposals = append(proposals, *proposal)
+		}
+		if proposal.Kind == models.FollowUpEscalate {
+			break
+		}
+	}
+	return proposals, nil
+}
+
+// ProposeFollowUpsQuietly is for callers where the response is already saved, a failing rule is only logged.
+func ProposeFollowUpsQuietly(visitID uint) {
+	if _, err := ProposeFollowUps(visitID); err != nil {
+		log.Printf("follow-up proposals for visit %d: %v", visitID, err)
+	}
+}
+
+func findPendingFollowUp(tx *gorm.DB, id uint) (models.FollowUpProposal, error) {
+	var proposal models.FollowUpProposal
+	if err := tx.Preload("Visit").Preload("Visit.Debitors").First(&proposal, id).Error; err != nil {
+		return proposal, err
+	}
+	if proposal.Status != models.FollowUpPending {
+		return proposal, ErrFollowUpDecided
+	}
+	return proposal, nil
+}
+
+// AcceptFollowUp creates the proposed visit, linked to the visit it follows up on, and dismisses the other
+// proposals for that visit. An escalation creates no visit. The visit is nil when none was created.
+func AcceptFollowUp(actingUser models.User, id uint) (models.FollowUpProposal, *models.Visit, error) {
+	var proposal models.FollowUpProposal
+	var created *models.Visit
+	now := time.Now()
+
+	err := initializers.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		proposal, err = findPendingFollowUp(tx, id)
+		if err != nil {
+			return err
+		}
+
+		if proposal.Kind != models.FollowUpEscalate {
+			parent := proposal.Visit
+			typeID := parent.TypeID
+			if proposal.VisitTypeID != nil {
+				visitType, err := FindVisitType(tx, *proposal.VisitTypeID)
+				if err != nil {
+					return err
+				}
+				// the visit is planned later, so it is enough that the window has not passed
+				day := now
+				if proposal.EarliestDate != nil && proposal.EarliestDate.After(day) {
+					day = *proposal.EarliestDate
+				}
+				if err := CheckRevisit(tx, visitType, parent.Sagsnr, 0, day); err != nil {
+					return err
+				}
+				typeID = visitType.ID
+			}
+
+			notes := strings.TrimSpace(fmt.Sprintf("%s\nFollow-up of visit %d: %s", parent.Notes, parent.ID, proposal.Reason))
+			visit := models.Visit{
+				UserID:              1,
+				Address:             parent.Address,
+				Latitude:            parent.Latitude,
+				Longitude:           parent.Longitude,
+				Notes:               notes,
+				Sagsnr:              parent.Sagsnr,
+				TypeID:              typeID,
+				AdvoproStatus:       parent.AdvoproStatus,
+				AdvoproStatusText:   parent.AdvoproStatusText,
+				AdvoproDeadlineDate: parent.AdvoproDeadlineDate,
+				AdvoproKlient:       parent.AdvoproKlient,
+				ParentVisitID:       &parent.ID,
+			}
+			if err := tx.Omit("Debitors").Create(&visit).Error; err != nil {
+				return err
+			}
+			if len(parent.Debitors) > 0 {
+				if err := tx.Model(&visit).Association("Debitors").Append(parent.Debitors); err != nil {
+					return err
+				}
+			}
+			created = &visit
+			proposal.CreatedVisitID = &visit.ID
+		}
+
+		result := tx.Model(&models.FollowUpProposal{}).
+			Where("id = ? AND status = ?", proposal.ID, models.FollowUpPending).
+			Updates(map[string]interface{}{
+				"status":           models.FollowUpAccepted,
+				"decided_by_id":    actingUser.ID,
+				"decided_at":       now,
+				"created_visit_id": proposal.CreatedVisitID,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrFollowUpDecided
+		}
+		proposal.Status = models.FollowUpAccepted
+		proposal.DecidedByID = &actingUser.ID
+		proposal.DecidedAt = &now
+		return tx.Model(&models.FollowUpProposal{}).
+			Where("visit_id = ? AND id != ? AND status = ?", proposal.VisitID, proposal.ID, models.FollowUpPending).
+			Updates(map[string]interface{}{
+				"status":           models.FollowUpDismissed,
+				"decided_by_id":    actingUser.ID,
+				"decided_at":       now,
+				"dismissed_reason": fmt.Sprintf("proposal %d was accepted", proposal.ID),
+			}).Error
+	})
+	if err != nil {
+		return proposal, nil, err
+	}
+	if created != nil {
+		LogVisitCreate(actingUser, *created)
+	}
+	return proposal, created, nil
+}
+
+// DismissFollowUp takes the proposal out of the queue without creating a visit.
+func DismissFollowUp(actingUser models.User, id uint, reason string) (models.FollowUpProposal, error) {
+	proposal, err := findPendingFollowUp(initializers.DB, id)
+	if err != nil {
+		return proposal, err
+	}
+	now := time.Now()
+	// only a proposal that is still pending is dismissed, so one decided in the meantime is not overwritten
+	result := initializers.DB.Model(&models.FollowUpProposal{}).
+		Where("id = ? AND status = ?", id, models.FollowUpPending).
+		Updates(map[string]interface{}{
+			"status":           models.FollowUpDismissed,
+			"decided_by_id":    actingUser.ID,
+			"decided_at":       now,
+			"dismissed_reason": reason,
+		})
+	if result.Error != nil {
+		return proposal, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return proposal, ErrFollowUpDecided
+	}
+	proposal.Status = models.FollowUpDismissed
+	proposal.DecidedByID = &actingUser.ID
+	proposal.DecidedAt = &now
+	proposal.DismissedReason = reason
+	return proposal, nil
+}
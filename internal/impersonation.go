@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/markuskjeldsen/mop-backend-api/initializers"
+	"github.com/markuskjeldsen/mop-backend-api/models"
+)
+
+const (
+	DefaultImpersonationTTL = 30 * time.Minute
+	MaxImpersonationTTL     = 2 * time.Hour
+)
+
+var ErrImpersonationNotAllowed = errors.New("developers cannot act as other developers")
+
+// StartImpersonation makes every request on the session act as the target until it expires or is ended.
+// An impersonation already running on the session is ended first.
+func StartImpersonation(realUser models.User, target models.User, sessionID uint, reason string, d time.Duration) (models.Impersonation, error) {
+	if target.Rights == models.RightsDeveloper || target.ID == realUser.ID {
+		return models.Impersonation{}, ErrImpersonationNotAllowed
+	}
+	if d <= 0 {
+		d = DefaultImpersonationTTL
+	}
+	if d > MaxImpersonationTTL {
+		d = MaxImpersonationTTL
+	}
+
+	EndImpersonation(realUser, sessionID)
+
+	impersonation := models.Impersonation{
+		SessionID:    sessionID,
+		RealUserID:   realUser.ID,
+		TargetUserID: target.ID,
+		Reason:       reason,
+		ExpiresAt:    time.Now().Add(d),
+	}
+	if err := initializers.DB.Create(&impersonation).Error; err != nil {
+		return models.Impersonation{}, err
+	}
+
+	logImpersonation(realUser, impersonation, "START IMPERSONATION")
+	return impersonation, nil
+}
+
+// ActiveImpersonation returns the impersonation running on the session, if any.
+func ActiveImpersonation(sessionID uint) (models.Impersonation, bool) {
+	var impersonation models.Impersonation
+	err := initializers.DB.
+		Where("session_id = ? AND ended_at IS NULL AND expires_at > ?", sessionID, time.Now()).
+		Order("created_at DESC").
+		First(&impersonation).Error
+	return impersonation, err == nil
+}
+
+// EndImpersonation stops the impersonation on the session, it is not an error if there is none.
+func EndImpersonation(realUser models.User, sessionID uint) (models.Impersonation, bool) {
+	impersonation, ok := ActiveImpersonation(sessionID)
+	if !ok {
+		return models.Impersonation{}, false
+	}
+	now := time.Now()
+	initializers.DB.Model(&impersonation).Update("ended_at", &now)
+	impersonation.EndedAt = &now
+
+	logImpersonation(realUser, impersonation, "END IMPERSONATION")
+	return impersonation, true
+}
+
+func logImpersonation(realUser models.User, impersonation models.Impersonation, action string) {
+	currJSON, _ := json.Marshal(impersonation)
+	initializers.DB.Create(&models.ActivityLog{
+		ActingUserID: realUser.ID,
+		TargetID:     impersonation.TargetUserID,
+		TargetIDType: "user",
+		ActionType:   action,
+		CurrentVal:   currJSON,
+	})
+}
+
+// LogImpersonatedRequest records a request made while acting as another user, reads included,
+// so it can be seen afterwards exactly what the developer looked at.
+func LogImpersonatedRequest(user models.User, method string, path string, query string, status int) {
+	if user.ImpersonatorID == nil {
+		return
+	}
+	currJSON, _ := json.Marshal(map[string]interface{}{
+		"method": method,
+		"path":   path,
+		"query":  query,
+		"status": status,
+	})
+	initializers.DB.Create(&models.ActivityLog{
+		ActingUserID:   user.ID,
+		ImpersonatorID: user.ImpersonatorID,
+		TargetID:       user.ID,
+		TargetIDType:   "user",
+		ActionType:     "IMPERSONATED REQUEST",
+		CurrentVal:     currJSON,
+	})
+}
@@ -2,7 +2,6 @@ package internal
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
 	"time"
 
@@ -11,36 +10,6 @@ import (
 	"gorm.io/gorm"
 )
 
-// Example function to update status and log the change
-func UpdateVisitStatus(visitID uint, newStatusID uint, userID uint) error {
-	var visit models.Visit
-	if err := initializers.DB.First(&visit, visitID).Error; err != nil {
-		fmt.Println(err.Error())
-		return err
-	}
-	oldStatusID := visit.StatusID
-
-	if oldStatusID == newStatusID {
-		return errors.New("the record is already in that status code")
-
-	}
-
-	// Update status
-	if err := initializers.DB.Model(&visit).Update("status_id", newStatusID).Error; err != nil {
-		fmt.Println(err.Error())
-		return err
-	}
-
-	// Log the change
-	log := models.VisitStatusLog{
-		VisitID:     visitID,
-		OldStatusID: oldStatusID,
-		NewStatusID: newStatusID,
-		ChangedByID: userID,
-	}
-	return initializers.DB.Create(&log).Error
-}
-
 func LogUserDelete(actinguser models.User, targetuser models.User) error {
 	prevJSON, err := json.Marshal(targetuser)
 	if err != nil {
@@ -48,10 +17,12 @@ func LogUserDelete(actinguser models.User, targetuser models.User) error {
 	}
 
 	activity := models.ActivityLog{
-		ActingUserID: actinguser.ID,
-		TargetID:     targetuser.ID,
-		ActionType:   "DELETE USER",
-		PrevVal:      prevJSON,
+		ActingUserID:   actinguser.ID,
+		APIKeyID:       actinguser.APIKeyID,
+		ImpersonatorID: actinguser.ImpersonatorID,
+		TargetID:       targetuser.ID,
+		ActionType:     "DELETE USER",
+		PrevVal:        prevJSON,
 	}
 	initializers.DB.Create(&activity)
 	return nil
@@ -64,10 +35,12 @@ func LogUserCreate(actinguser models.User, targetuser models.User) error {
 	}
 
 	activity := models.ActivityLog{
-		ActingUserID: actinguser.ID,
-		TargetID:     targetuser.ID,
-		CurrentVal:   currJSON,
-		ActionType:   "CREATE USER",
+		ActingUserID:   actinguser.ID,
+		APIKeyID:       actinguser.APIKeyID,
+		ImpersonatorID: actinguser.ImpersonatorID,
+		TargetID:       targetuser.ID,
+		CurrentVal:     currJSON,
+		ActionType:     "CREATE USER",
 	}
 
 	initializers.DB.Create(&activity)
@@ -85,8 +58,10 @@ func LogUserPatch(actinguser models.User, targetuserPrev models.User, targetuser
 	}
 
 	activity := models.ActivityLog{
-		ActingUserID: actinguser.ID,
-		TargetID:     targetuserPrev.ID,
+		ActingUserID:   actinguser.ID,
+		APIKeyID:       actinguser.APIKeyID,
+		ImpersonatorID: actinguser.ImpersonatorID,
+		TargetID:       targetuserPrev.ID,
 
 		PrevVal:    prevJSON,
 		CurrentVal: currJSON,
@@ -105,10 +80,13 @@ func LogVisitDelete(actinguser models.User, targetVisit models.Visit) error {
 	}
 
 	activity := models.ActivityLog{
-		ActingUserID: actinguser.ID,
-		TargetID:     targetVisit.ID,
-		ActionType:   "DELETE VISIT",
-		PrevVal:      prevJSON,
+		ActingUserID:   actinguser.ID,
+		APIKeyID:       actinguser.APIKeyID,
+		ImpersonatorID: actinguser.ImpersonatorID,
+		TargetID:       targetVisit.ID,
+		TargetIDType:   "visit",
+		ActionType:     "DELETE VISIT",
+		PrevVal:        prevJSON,
 	}
 
 	initializers.DB.Create(&activity)
@@ -122,10 +100,13 @@ func LogVisitCreate(actinguser models.User, targetVisit models.Visit) error {
 	}
 
 	activity := models.ActivityLog{
-		ActingUserID: actinguser.ID,
-		TargetID:     targetVisit.ID,
-		CurrentVal:   currJSON,
-		ActionType:   "CREATE VISIT",
+		ActingUserID:   actinguser.ID,
+		APIKeyID:       actinguser.APIKeyID,
+		ImpersonatorID: actinguser.ImpersonatorID,
+		TargetID:       targetVisit.ID,
+		TargetIDType:   "visit",
+		CurrentVal:     currJSON,
+		ActionType:     "CREATE VISIT",
 	}
 
 	initializers.DB.Create(&activity)
@@ -134,7 +115,7 @@ func LogVisitCreate(actinguser models.User, targetVisit models.Visit) error {
 
 // Function that logs when a visit changes groupid, remember to use snake_case for the field name, the input is a string.
 // Pass the DB instance as the first argument
-func UpdateVisitValue(db *gorm.DB, visitID uint, newVal string, userID uint, fieldName string) error {
+func UpdateVisitValue(db *gorm.DB, visitID uint, newVal string, actingUser models.User, fieldName string) error {
 	var visit models.Visit
 	// Use the passed-in 'db' instead of the global 'initializers.DB'
 	if err := db.First(&visit, visitID).Error; err != nil {
@@ -160,7 +141,8 @@ func UpdateVisitValue(db *gorm.DB, visitID uint, newVal string, userID uint, fie
 		PreviousVal: oldVal,
 		NewVal:      newVal,
 		ValType:     fieldName,
-		ChangedByID: userID,
+		ChangedByID: actingUser.ID,
+		APIKeyID:    actingUser.APIKeyID,
 	}
 
 	// Use the passed-in 'db' here too
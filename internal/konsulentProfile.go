@@ -0,0 +1,271 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/markuskjeldsen/mop-backend-api/initializers"
+	"github.com/markuskjeldsen/mop-backend-api/models"
+	"gorm.io/gorm"
+)
+
+// ValidationError is input that does not make sense, e.g. a profile or absence, the message can be shown to the user.
+type ValidationError struct {
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	return e.Message
+}
+
+// KonsulentProfile returns the profile of the user with working hours and regions, ok is false if they have none.
+func KonsulentProfile(userID uint) (models.KonsulentProfile, bool) {
+	var profile models.KonsulentProfile
+	err := initializers.DB.
+		Preload("WorkingHours", func(db *gorm.DB) *gorm.DB { return db.Order("weekday, start") }).
+		Preload("Regions", func(db *gorm.DB) *gorm.DB { return db.Order("postnr_from") }).
+		Where("user_id = ?", userID).
+		First(&profile).Error
+	return profile, err == nil
+}
+
+func validateProfile(profile models.KonsulentProfile) error {
+	if profile.MaxVisitsPerDay < 0 {
+		return ValidationError{"max_visits_per_day cannot be negative"}
+	}
+	for _, h := range profile.WorkingHours {
+		if h.Weekday < time.Sunday || h.Weekday > time.Saturday {
+			return ValidationError{"weekday must be between 0 (sunday) and 6 (saturday)"}
+		}
+		start, err1 := time.Parse("15:04", h.Start)
+		end, err2 := time.Parse("15:04", h.End)
+		if err1 != nil || err2 != nil {
+			return ValidationError{"working hours must be of the form 15:04"}
+		}
+		if !end.After(start) {
+			return ValidationError{fmt.Sprintf("working hours on %s end before they start", h.Weekday)}
+		}
+	}
+	for _, r := range profile.Regions {
+		if r.PostnrFrom < 1000 || r.PostnrTo > 9999 || r.PostnrFrom > r.PostnrTo {
+			return ValidationError{fmt.Sprintf("%d-%d is not a range of postnr", r.PostnrFrom, r.PostnrTo)}
+		}
+	}
+	return nil
+}
+
+// SaveKonsulentProfile creates or replaces the profile of the user, the working hours and regions are replaced as a whole.
+func SaveKonsulentProfile(actingUser models.User, userID uint, profile models.KonsulentProfile) (models.KonsulentProfile, error) {
+	if err := validateProfile(profile); err != nil {
+		return models.KonsulentProfile{}, err
+	}
+	previous, _ := KonsulentProfile(userID)
+
+	err := initializers.DB.Transaction(func(tx *gorm.DB) error {
+		var existing models.KonsulentProfile
+		tx.Where("user_id = ?", userID).First(&existing)
+
+		profile.ID = existing.ID
+		profile.CreatedAt = existing.CreatedAt
+		profile.UserID = userID
+		for i := range profile.WorkingHours {
+			profile.WorkingHours[i].ID = 0
+		}
+		for i := range profile.Regions {
+			profile.Regions[i].ID = 0
+		}
+
+		if existing.ID != 0 {
+			if err := tx.Unscoped().Where("profile_id = ?", existing.ID).Delete(&models.KonsulentWorkingHours{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Unscoped().Where("profile_id = ?", existing.ID).Delete(&models.KonsulentRegion{}).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Save(&profile).Error
+	})
+	if err != nil {
+		return models.KonsulentProfile{}, err
+	}
+
+	saved, _ := KonsulentProfile(userID)
+	logProfile(actingUser, userID, previous, saved, "UPDATE KONSULENT PROFILE")
+	return saved, nil
+}
+
+// DeleteKonsulentProfile removes the profile, planning then no longer warns about the user.
+func DeleteKonsulentProfile(actingUser models.User, userID uint) error {
+	previous, ok := KonsulentProfile(userID)
+	if !ok {
+		return gorm.ErrRecordNotFound
+	}
+	if err := initializers.DB.Unscoped().Select("WorkingHours", "Regions").Delete(&previous).Error; err != nil {
+		return err
+	}
+	logProfile(actingUser, userID, previous, models.KonsulentProfile{}, "DELETE KONSULENT PROFILE")
+	return nil
+}
+
+func logProfile(actingUser models.User, userID uint, previous models.KonsulentProfile, current models.KonsulentProfile, action string) {
+	var prevJSON, currJSON []byte
+	if previous.ID != 0 {
+		prevJSON, _ = json.Marshal(previous)
+	}
+	if current.ID != 0 {
+		currJSON, _ = json.Marshal(current)
+	}
+	initializers.DB.Create(&models.ActivityLog{
+		ActingUserID:   actingUser.ID,
+		APIKeyID:       actingUser.APIKeyID,
+		ImpersonatorID: actingUser.ImpersonatorID,
+		TargetID:       userID,
+		TargetIDType:   "user",
+		ActionType:     action,
+		PrevVal:        prevJSON,
+		CurrentVal:     currJSON,
+	})
+}
+
+// a danish postnr comes after the street, four digits followed by the town, e.g. "Vestergade 1, 8000 Aarhus C".
+// The comma is needed so a house number like "1337 Main St" is not taken for a postnr.
+var postnrPattern = regexp.MustCompile(`,\s*(?:DK-)?(\d{4})\s+\pL`)
+
+// PostnrOf finds the postnr in an address, ok is false when there is none.
+func PostnrOf(address string) (int, bool) {
+	matches := postnrPattern.FindAllStringSubmatch(address, -1)
+	if len(matches) == 0 {
+		return 0, false
+	}
+	postnr, err := strconv.Atoi(matches[len(matches)-1][1])
+	return postnr, err == nil
+}
+
+// AssignmentWarning is a reason a konsulent may not be the right one for some visits.
+// The assignment is still made, it is up to the planner to act on it.
+type AssignmentWarning struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	VisitID *uint  `json:"visit_id,omitempty"`
+}
+
+// CheckAssignment compares visits on a date against the status and profile of the konsulent they are given to.
+// Visits of the konsulent already planned that day count towards the daily maximum.
+func CheckAssignment(userID uint, date time.Time, visits []models.Visit) ([]AssignmentWarning, error) {
+	warnings := []AssignmentWarning{}
+
+	var user models.User
+	if err := initializers.DB.First(&user, userID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return append(warnings, AssignmentWarning{Code: "unknown_konsulent", Message: "the konsulent does not exist"}), nil
+		}
+		return nil, err
+	}
+	if !UserActive(user) {
+		warnings = append(warnings, AssignmentWarning{
+			Code:    "inactive",
+			Message: fmt.Sprintf("%s is %s", user.Name, user.Status),
+		})
+	}
+
+	if warning, absent := absenceWarning(user, date); absent {
+		warnings = append(warnings, warning)
+	}
+
+	profile, ok := KonsulentProfile(userID)
+	if !ok {
+		return warnings, nil
+	}
+
+	if len(profile.WorkingHours) > 0 {
+		var hours []models.KonsulentWorkingHours
+		for _, h := range profile.WorkingHours {
+			if h.Weekday == date.Weekday() {
+				hours = append(hours, h)
+			}
+		}
+		if len(hours) == 0 {
+			warnings = append(warnings, AssignmentWarning{
+				Code:    "day_off",
+				Message: fmt.Sprintf("%s does not work on %s", user.Name, date.Weekday()),
+			})
+		} else {
+			for i := range visits {
+				if visits[i].VisitTime != "" && !withinHours(visits[i].VisitTime, hours) {
+					warnings = append(warnings, AssignmentWarning{
+						Code:    "outside_hours",
+						Message: fmt.Sprintf("the visit at %s is outside the working hours of %s", visits[i].VisitTime, user.Name),
+						VisitID: &visits[i].ID,
+					})
+				}
+			}
+		}
+	}
+
+	if profile.MaxVisitsPerDay > 0 {
+		ids := make([]uint, 0, len(visits))
+		for _, v := range visits {
+			ids = append(ids, v.ID)
+		}
+		var others int64
+		query := initializers.DB.Model(&models.Visit{}).
+			Where("user_id = ? AND DATE(visit_date) = ?", userID, date.Format("2006-01-02"))
+		if len(ids) > 0 {
+			query = query.Where("id NOT IN ?", ids)
+		}
+		query.Count(&others)
+
+		if total := int(others) + len(visits); total > profile.MaxVisitsPerDay {
+			warnings = append(warnings, AssignmentWarning{
+				Code:    "too_many_visits",
+				Message: fmt.Sprintf("%s would have %d visits on %s, at most %d", user.Name, total, date.Format("2006-01-02"), profile.MaxVisitsPerDay),
+			})
+		}
+	}
+
+	if len(profile.Regions) > 0 {
+		for i := range visits {
+			postnr, found := PostnrOf(visits[i].Address)
+			if !found {
+				continue
+			}
+			if !inRegions(postnr, profile.Regions) {
+				warnings = append(warnings, AssignmentWarning{
+					Code:    "outside_region",
+					Message: fmt.Sprintf("%d is not in the regions of %s", postnr, user.Name),
+					VisitID: &visits[i].ID,
+				})
+			}
+		}
+	}
+
+	return warnings, nil
+}
+
+func withinHours(visitTime string, hours []models.KonsulentWorkingHours) bool {
+	t, err := time.Parse("15:04", visitTime)
+	if err != nil {
+		return true // nothing to compare against
+	}
+	for _, h := range hours {
+		start, _ := time.Parse("15:04", h.Start)
+		end, _ := time.Parse("15:04", h.End)
+		if !t.Before(start) && !t.After(end) {
+			return true
+		}
+	}
+	return false
+}
+
+func inRegions(postnr int, regions []models.KonsulentRegion) bool {
+	for _, r := range regions {
+		if postnr >= r.PostnrFrom && postnr <= r.PostnrTo {
+			return true
+		}
+	}
+	return false
+}
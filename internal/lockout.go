@@ -0,0 +1,305 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/markuskjeldsen/mop-backend-api/initializers"
+	"github.com/markuskjeldsen/mop-backend-api/models"
+)
+
+// the lockout starts after this many failed logins, every failure after that doubles the ban.
+// Failures for a username are counted since its last successful login, failures from an ip are not reset by a success,
+// so one valid account cannot be used to keep guessing at the others.
+const (
+	UsernameLockoutThreshold = 5
+	IPLockoutThreshold       = 20
+	LockoutBase              = time.Minute
+	LockoutMax               = 24 * time.Hour
+	lockoutWindow            = 24 * time.Hour
+)
+
+// FailureTooManyRequests is the failure reason of attempts rejected by a ban, they do not count towards the next ban
+const FailureTooManyRequests = "Too many requests"
+
+var ErrInvalidBan = errors.New("a ban needs a kind of ip or username and a value")
+
+// lockoutDuration is zero below the threshold, and then 1, 2, 4, 8... minutes up to LockoutMax
+func lockoutDuration(failures, threshold int64) time.Duration {
+	if failures < threshold {
+		return 0
+	}
+	d := LockoutBase
+	for i := threshold; i < failures && d < LockoutMax; i++ {
+		d *= 2
+	}
+	if d > LockoutMax {
+		d = LockoutMax
+	}
+	return d
+}
+
+// ActiveBan returns the ban with the latest expiry that is still in force for the value.
+func ActiveBan(kind models.BanKind, value string) (models.Ban, bool) {
+	var ban models.Ban
+	err := initializers.DB.
+		Where("kind = ? AND value = ? AND lifted_at IS NULL AND (expires_at IS NULL OR expires_at > ?)", kind, value, time.Now()).
+		Order("expires_at IS NULL DESC, expires_at DESC").
+		First(&ban).Error
+	return ban, err == nil
+}
+
+// failuresSince counts failed password attempts after the last success or lifted ban, at most lockoutWindow back
+func failuresSince(column string, kind models.BanKind, value string, resetOnSuccess bool) int64 {
+	since := time.Now().Add(-lockoutWindow)
+
+	if resetOnSuccess {
+		var lastSuccess models.LoginAttempt
+		initializers.DB.Where(column+" = ? AND step = ? AND successful = ?", value, models.LoginStepPassword, true).
+			Order("created_at DESC").Limit(1).Find(&lastSuccess)
+		if lastSuccess.CreatedAt.After(since) {
+			since = lastSuccess.CreatedAt
+		}
+	}
+
+	// an admin lifting the ban gives a fresh start
+	var lifted models.Ban
+	initializers.DB.Where("kind = ? AND value = ? AND lifted_at IS NOT NULL", kind, value).
+		Order("lifted_at DESC").Limit(1).Find(&lifted)
+	if lifted.LiftedAt != nil && lifted.LiftedAt.After(since) {
+		since = *lifted.LiftedAt
+	}
+
+	var failures int64
+	initializers.DB.Model(&models.LoginAttempt{}).
+		Where(column+" = ? AND step = ? AND successful = ? AND failure_reason <> ? AND created_at > ?",
+			value, models.LoginStepPassword, false, FailureTooManyRequests, since).
+		Count(&failures)
+	return failures
+}
+
+// RegisterLoginFailure is called after a failed login and bans the username and ip once they have failed too often.
+func RegisterLoginFailure(username string, ip string) {
+	if username != "" {
+		failures := failuresSince("username", models.BanKindUsername, username, true)
+		if d := lockoutDuration(failures, UsernameLockoutThreshold); d > 0 {
+			autoBan(models.BanKindUsername, username, d)
+		}
+	}
+
+	if ip != "" && !IPAllowlisted(net.ParseIP(ip)) {
+		failures := failuresSince("ip", models.BanKindIP, ip, false)
+		if d := lockoutDuration(failures, IPLockoutThreshold); d > 0 {
+			autoBan(models.BanKindIP, ip, d)
+		}
+	}
+}
+
+func autoBan(kind models.BanKind, value string, d time.Duration) {
+	if _, banned := ActiveBan(kind, value); banned {
+		return
+	}
+	expires := time.Now().Add(d)
+	initializers.DB.Create(&models.Ban{
+		Kind:      kind,
+		Value:     value,
+		Reason:    "too many failed logins",
+		ExpiresAt: &expires,
+		Automatic: true,
+	})
+	if kind == models.BanKindIP {
+		InvalidateBanCache()
+	}
+}
+
+// CreateBan bans a username or ip by hand, a zero duration bans until the ban is lifted.
+func CreateBan(actingUser models.User, kind models.BanKind, value string, reason string, d time.Duration) (models.Ban, error) {
+	value = strings.TrimSpace(value)
+	switch kind {
+	case models.BanKindIP:
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return models.Ban{}, errors.New("invalid ip address")
+		}
+		value = ip.String()
+	case models.BanKindUsername:
+		if value == "" {
+			return models.Ban{}, ErrInvalidBan
+		}
+	default:
+		return models.Ban{}, ErrInvalidBan
+	}
+
+	ban := models.Ban{
+		Kind:        kind,
+		Value:       value,
+		Reason:      reason,
+		CreatedByID: &actingUser.ID,
+	}
+	if d > 0 {
+		expires := time.Now().Add(d)
+		ban.ExpiresAt = &expires
+	}
+	if err := initializers.DB.Create(&ban).Error; err != nil {
+		return models.Ban{}, err
+	}
+	if kind == models.BanKindIP {
+		InvalidateBanCache()
+	}
+
+	logBan(actingUser, ban, nil, "CREATE BAN")
+	return ban, nil
+}
+
+// LiftBan ends a ban before it expires.
+func LiftBan(actingUser models.User, id uint) (models.Ban, error) {
+	var ban models.Ban
+	if err := initializers.DB.First(&ban, id).Error; err != nil {
+		return models.Ban{}, err
+	}
+	if ban.LiftedAt != nil {
+		return ban, nil
+	}
+
+	prev := ban
+	now := time.Now()
+	err := initializers.DB.Model(&ban).Updates(map[string]interface{}{
+		"lifted_at":    &now,
+		"lifted_by_id": actingUser.ID,
+	}).Error
+	if err != nil {
+		return models.Ban{}, err
+	}
+	ban.LiftedAt = &now
+	ban.LiftedByID = &actingUser.ID
+	if ban.Kind == models.BanKindIP {
+		InvalidateBanCache()
+	}
+
+	logBan(actingUser, ban, &prev, "LIFT BAN")
+	return ban, nil
+}
+
+// ParseAllowlistCIDR accepts a cidr range or a single ip, which becomes a range of one address
+func ParseAllowlistCIDR(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return "", errors.New("invalid ip address or cidr range")
+		}
+		if ip.To4() != nil {
+			return ip.String() + "/32", nil
+		}
+		return ip.String() + "/128", nil
+	}
+	_, ipnet, err := net.ParseCIDR(value)
+	if err != nil {
+		return "", errors.New("invalid ip address or cidr range")
+	}
+	return ipnet.String(), nil
+}
+
+func logBan(actingUser models.User, ban models.Ban, prev *models.Ban, action string) {
+	activity := models.ActivityLog{
+		ActingUserID:   actingUser.ID,
+		APIKeyID:       actingUser.APIKeyID,
+		ImpersonatorID: actingUser.ImpersonatorID,
+		TargetID:       ban.ID,
+		TargetIDType:   "ban",
+		ActionType:     action,
+	}
+	if prev != nil {
+		activity.PrevVal, _ = json.Marshal(prev)
+	}
+	activity.CurrentVal, _ = json.Marshal(ban)
+	initializers.DB.Create(&activity)
+}
+
+// the ip bans and the allowlist are checked on every request by the GeoIPBlocker,
+// so they are kept in memory and reloaded when they change or at the latest after banCacheTTL.
+// The TTL is what makes bans that simply run out disappear, and picks up changes made by another process.
+const banCacheTTL = time.Minute
+
+var banCache struct {
+	mu        sync.RWMutex
+	loadedAt  time.Time
+	bans      map[string]*time.Time // ip to expiry, nil never expires
+	allowlist []*net.IPNet
+}
+
+func InvalidateBanCache() {
+	banCache.mu.Lock()
+	banCache.loadedAt = time.Time{}
+	banCache.mu.Unlock()
+}
+
+func loadBanCache() {
+	banCache.mu.RLock()
+	fresh := time.Since(banCache.loadedAt) < banCacheTTL
+	banCache.mu.RUnlock()
+	if fresh {
+		return
+	}
+
+	var bans []models.Ban
+	initializers.DB.Where("kind = ? AND lifted_at IS NULL AND (expires_at IS NULL OR expires_at > ?)", models.BanKindIP, time.Now()).
+		Find(&bans)
+	var entries []models.AllowlistEntry
+	initializers.DB.Find(&entries)
+
+	byIP := map[string]*time.Time{}
+	for _, b := range bans {
+		current, seen := byIP[b.Value]
+		if !seen || (current != nil && (b.ExpiresAt == nil || b.ExpiresAt.After(*current))) {
+			byIP[b.Value] = b.ExpiresAt
+		}
+	}
+	var allowlist []*net.IPNet
+	for _, e := range entries {
+		if _, ipnet, err := net.ParseCIDR(e.CIDR); err == nil {
+			allowlist = append(allowlist, ipnet)
+		}
+	}
+
+	banCache.mu.Lock()
+	banCache.bans = byIP
+	banCache.allowlist = allowlist
+	banCache.loadedAt = time.Now()
+	banCache.mu.Unlock()
+}
+
+// IPAllowlisted reports whether the ip is in one of the allowlisted ranges.
+func IPAllowlisted(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	loadBanCache()
+	banCache.mu.RLock()
+	defer banCache.mu.RUnlock()
+	for _, ipnet := range banCache.allowlist {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// IPBanned reports whether the ip has an active ban, allowlisted ips are never banned.
+func IPBanned(ip net.IP) bool {
+	if ip == nil || IPAllowlisted(ip) {
+		return false
+	}
+	loadBanCache()
+	banCache.mu.RLock()
+	defer banCache.mu.RUnlock()
+	expires, banned := banCache.bans[ip.String()]
+	if !banned {
+		return false
+	}
+	return expires == nil || expires.After(time.Now())
+}
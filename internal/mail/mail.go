@@ -0,0 +1,137 @@
+package mail
+
+import (
+	"fmt"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sender delivers a message. Which one is used is chosen by the MAIL_SENDER environment variable.
+type Sender interface {
+	Send(msg Message) error
+}
+
+// SMTPSender sends through the mail server configured with the SMTP_* environment variables.
+type SMTPSender struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (s SMTPSender) Send(msg Message) error {
+	var auth smtp.Auth
+	if s.Username != "" {
+		auth = smtp.PlainAuth("", s.Username, s.Password, s.Host)
+	}
+
+	body := strings.Join([]string{
+		"From: " + s.From,
+		"To: " + msg.To,
+		"Subject: " + msg.Subject,
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=UTF-8",
+		"",
+		msg.Body,
+	}, "\r\n")
+
+	if err := smtp.SendMail(s.Host+":"+s.Port, auth, s.From, []string{msg.To}, []byte(body)); err != nil {
+		return fmt.Errorf("failed to send mail to %s: %w", msg.To, err)
+	}
+	return nil
+}
+
+// FileSender writes every message to its own file in Dir, for running locally without a mail server.
+type FileSender struct {
+	Dir string
+}
+
+func (s FileSender) Send(msg Message) error {
+	if err := os.MkdirAll(s.Dir, 0o755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s_%s.txt", time.Now().Format("20060102-150405.000000000"), strings.ReplaceAll(msg.To, "@", "_at_"))
+	content := fmt.Sprintf("To: %s\nSubject: %s\n\n%s\n", msg.To, msg.Subject, msg.Body)
+	return os.WriteFile(filepath.Join(s.Dir, name), []byte(content), 0o600)
+}
+
+// MemorySender keeps the messages in memory, for tests.
+type MemorySender struct {
+	mu       sync.Mutex
+	Messages []Message
+}
+
+func (s *MemorySender) Send(msg Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Messages = append(s.Messages, msg)
+	return nil
+}
+
+func (s *MemorySender) Sent() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Message(nil), s.Messages...)
+}
+
+var (
+	defaultSender Sender
+	defaultOnce   sync.Once
+)
+
+// Default returns the sender configured in the environment.
+// It is created on first use, after the .env file has been loaded.
+//
+//	MAIL_SENDER=smtp   uses SMTP_HOST, SMTP_PORT, SMTP_USER, SMTP_PASS and MAIL_FROM
+//	MAIL_SENDER=file   writes to MAIL_DIR, default ./mail
+//	MAIL_SENDER=memory keeps the messages in memory
+func Default() Sender {
+	defaultOnce.Do(func() {
+		if defaultSender == nil {
+			defaultSender = fromEnv()
+		}
+	})
+	return defaultSender
+}
+
+// SetDefault replaces the sender, tests use it to install a MemorySender.
+func SetDefault(s Sender) {
+	defaultOnce.Do(func() {})
+	defaultSender = s
+}
+
+func fromEnv() Sender {
+	switch os.Getenv("MAIL_SENDER") {
+	case "smtp":
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		return SMTPSender{
+			Host:     os.Getenv("SMTP_HOST"),
+			Port:     port,
+			Username: os.Getenv("SMTP_USER"),
+			Password: os.Getenv("SMTP_PASS"),
+			From:     os.Getenv("MAIL_FROM"),
+		}
+	case "memory":
+		return &MemorySender{}
+	default:
+		dir := os.Getenv("MAIL_DIR")
+		if dir == "" {
+			dir = "./mail"
+		}
+		return FileSender{Dir: dir}
+	}
+}
@@ -0,0 +1,382 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/markuskjeldsen/mop-backend-api/initializers"
+	"github.com/markuskjeldsen/mop-backend-api/models"
+	"golang.org/x/oauth2"
+)
+
+// the user has this long at the identity provider before the login has to be started again
+const OIDCStateTTL = 10 * time.Minute
+
+var (
+	ErrOIDCDisabled  = errors.New("single sign-on is not configured")
+	ErrOIDCState     = errors.New("the single sign-on login has expired or was already used, try again")
+	ErrOIDCNoRights  = errors.New("your account is not in a group that has access")
+	ErrOIDCNoAccount = errors.New("no user is linked to your account, ask an administrator to create one")
+	ErrOIDCLink      = errors.New("your account here has to be linked to single sign-on by an administrator")
+)
+
+// OIDCLinkError is a login with the email of an account that is not linked automatically,
+// the subject is what an administrator links to the user.
+type OIDCLinkError struct {
+	User    models.User
+	Subject string
+}
+
+func (e *OIDCLinkError) Error() string {
+	return ErrOIDCLink.Error()
+}
+
+func (e *OIDCLinkError) Unwrap() error {
+	return ErrOIDCLink
+}
+
+// OIDCConfig is read from the environment, single sign-on is off when OIDC_ISSUER is not set.
+//
+//	OIDC_ISSUER         e.g. https://login.microsoftonline.com/<tenant>/v2.0
+//	OIDC_CLIENT_ID
+//	OIDC_CLIENT_SECRET  can be left out for a public client, the login always uses pkce
+//	OIDC_REDIRECT_URL   the callback of this api, e.g. https://api.example.dk/api/v1/oidc/callback
+//	OIDC_SCOPES         default openid,email,profile
+//	OIDC_GROUPS_CLAIM   the claim with the users groups, default groups
+//	OIDC_GROUP_RIGHTS   which group gives which rights, e.g. mop-office=office,mop-admins=admin
+//	OIDC_PROVISION      true creates users on their first login, otherwise they must exist with the same email
+type OIDCConfig struct {
+	Issuer        string
+	ClientID      string
+	ClientSecret  string
+	RedirectURL   string
+	Scopes        []string
+	GroupsClaim   string
+	RightsByGroup map[string]models.UserRights
+	Provision     bool
+}
+
+func OIDCConfigFromEnv() (OIDCConfig, error) {
+	cfg := OIDCConfig{
+		Issuer:        os.Getenv("OIDC_ISSUER"),
+		ClientID:      os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret:  os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:   os.Getenv("OIDC_REDIRECT_URL"),
+		GroupsClaim:   os.Getenv("OIDC_GROUPS_CLAIM"),
+		RightsByGroup: map[string]models.UserRights{},
+		Provision:     os.Getenv("OIDC_PROVISION") == "true",
+	}
+	if cfg.Issuer == "" {
+		return cfg, ErrOIDCDisabled
+	}
+	if cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return cfg, errors.New("OIDC_CLIENT_ID and OIDC_REDIRECT_URL must be set when OIDC_ISSUER is")
+	}
+	if cfg.GroupsClaim == "" {
+		cfg.GroupsClaim = "groups"
+	}
+
+	cfg.Scopes = []string{oidc.ScopeOpenID, "email", "profile"}
+	if scopes := os.Getenv("OIDC_SCOPES"); scopes != "" {
+		cfg.Scopes = nil
+		for _, scope := range strings.Split(scopes, ",") {
+			if scope = strings.TrimSpace(scope); scope != "" {
+				cfg.Scopes = append(cfg.Scopes, scope)
+			}
+		}
+	}
+
+	for _, pair := range strings.Split(os.Getenv("OIDC_GROUP_RIGHTS"), ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		group, rights, found := strings.Cut(pair, "=")
+		if !found {
+			return cfg, fmt.Errorf("OIDC_GROUP_RIGHTS: %q must be group=rights", pair)
+		}
+		cfg.RightsByGroup[strings.TrimSpace(group)] = models.UserRights(strings.TrimSpace(rights))
+	}
+	return cfg, nil
+}
+
+// the provider is discovered on first use, so the api still starts when the identity provider is down
+var oidcClient struct {
+	mu       sync.Mutex
+	cfg      OIDCConfig
+	provider *oidc.Provider
+}
+
+func oidcProvider(ctx context.Context) (*oidc.Provider, OIDCConfig, error) {
+	oidcClient.mu.Lock()
+	defer oidcClient.mu.Unlock()
+	if oidcClient.provider != nil {
+		return oidcClient.provider, oidcClient.cfg, nil
+	}
+
+	cfg, err := OIDCConfigFromEnv()
+	if err != nil {
+		return nil, cfg, err
+	}
+	provider, err := oidc.NewProvider(ctx, cfg.Issuer)
+	if err != nil {
+		return nil, cfg, fmt.Errorf("failed to reach the identity provider: %w", err)
+	}
+	oidcClient.provider = provider
+	oidcClient.cfg = cfg
+	return provider, cfg, nil
+}
+
+func OIDCEnabled() bool {
+	return os.Getenv("OIDC_ISSUER") != ""
+}
+
+func oauth2Config(provider *oidc.Provider, cfg OIDCConfig) oauth2.Config {
+	return oauth2.Config{
+		ClientID:     cfg.ClientID,
+		ClientSecret: cfg.ClientSecret,
+		RedirectURL:  cfg.RedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       cfg.Scopes,
+	}
+}
+
+// BeginOIDCLogin stores the state of a new login and returns the url of the identity provider to send the user to.
+// The state is also returned so it can be bound to the browser with a cookie.
+func BeginOIDCLogin(ctx context.Context, redirectTo string) (string, string, error) {
+	provider, cfg, err := oidcProvider(ctx)
+	if err != nil {
+		return "", "", err
+	}
+
+	state, err := newRandomToken()
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := newRandomToken()
+	if err != nil {
+		return "", "", err
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	// only paths on the frontend, so the login cannot be used to redirect somewhere else
+	if !strings.HasPrefix(redirectTo, "/") || strings.HasPrefix(redirectTo, "//") {
+		redirectTo = "/"
+	}
+
+	initializers.DB.Unscoped().Where("expires_at < ?", time.Now()).Delete(&models.OIDCLoginState{})
+	err = initializers.DB.Create(&models.OIDCLoginState{
+		StateHash:    hashToken(state),
+		CodeVerifier: verifier,
+		Nonce:        nonce,
+		RedirectTo:   redirectTo,
+		ExpiresAt:    time.Now().Add(OIDCStateTTL),
+	}).Error
+	if err != nil {
+		return "", "", err
+	}
+
+	conf := oauth2Config(provider, cfg)
+	authURL := conf.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+	return authURL, state, nil
+}
+
+// oidcClaims are the claims used from the id token, groups are read separately since their claim name is configurable
+type oidcClaims struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified *bool  `json:"email_verified"`
+	Name          string `json:"name"`
+}
+
+// FinishOIDCLogin exchanges the code from the identity provider and returns the user to log in,
+// together with the frontend path the login was started from.
+// mfaRequired tells which rights must have two factor, their accounts are never linked by email.
+func FinishOIDCLogin(ctx context.Context, state string, code string, mfaRequired func(models.UserRights) bool) (models.User, string, error) {
+	provider, cfg, err := oidcProvider(ctx)
+	if err != nil {
+		return models.User{}, "", err
+	}
+
+	var loginState models.OIDCLoginState
+	err = initializers.DB.Where("state_hash = ? AND expires_at > ?", hashToken(state), time.Now()).First(&loginState).Error
+	if err != nil {
+		return models.User{}, "", ErrOIDCState
+	}
+	// the state can only be used once, also when the rest of the login fails
+	result := initializers.DB.Unscoped().Delete(&loginState)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return models.User{}, "", ErrOIDCState
+	}
+
+	conf := oauth2Config(provider, cfg)
+	token, err := conf.Exchange(ctx, code, oauth2.VerifierOption(loginState.CodeVerifier))
+	if err != nil {
+		return models.User{}, "", fmt.Errorf("failed to exchange the code: %w", err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return models.User{}, "", errors.New("the identity provider did not return an id token")
+	}
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: cfg.ClientID}).Verify(ctx, rawIDToken)
+	if err != nil {
+		return models.User{}, "", fmt.Errorf("invalid id token: %w", err)
+	}
+	if idToken.Nonce != loginState.Nonce {
+		return models.User{}, "", errors.New("invalid id token: nonce does not match")
+	}
+
+	var claims oidcClaims
+	var allClaims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return models.User{}, "", err
+	}
+	if err := idToken.Claims(&allClaims); err != nil {
+		return models.User{}, "", err
+	}
+
+	// some providers only put the groups in the userinfo
+	if _, ok := allClaims[cfg.GroupsClaim]; !ok {
+		if info, err := provider.UserInfo(ctx, oauth2.StaticTokenSource(token)); err == nil {
+			var infoClaims map[string]interface{}
+			if info.Claims(&infoClaims) == nil {
+				allClaims[cfg.GroupsClaim] = infoClaims[cfg.GroupsClaim]
+			}
+		}
+	}
+
+	rights, ok := rightsFromGroups(cfg, allClaims[cfg.GroupsClaim])
+	if !ok {
+		return models.User{}, "", ErrOIDCNoRights
+	}
+
+	user, err := oidcUser(cfg, claims, rights, mfaRequired)
+	if err != nil {
+		return models.User{}, "", err
+	}
+	return user, loginState.RedirectTo, nil
+}
+
+// the highest rights win when a user is in more than one mapped group
+var rightsRank = []models.UserRights{
+	models.RightsDeveloper,
+	models.RightsAdmin,
+	models.RightsOfficeWorker,
+	models.RightsAuditor,
+	models.RightsUser,
+}
+
+func rightsFromGroups(cfg OIDCConfig, claim interface{}) (models.UserRights, bool) {
+	var groups []string
+	switch v := claim.(type) {
+	case string:
+		groups = []string{v}
+	case []interface{}:
+		for _, g := range v {
+			if s, ok := g.(string); ok {
+				groups = append(groups, s)
+			}
+		}
+	}
+
+	granted := map[models.UserRights]bool{}
+	for _, g := range groups {
+		if rights, ok := cfg.RightsByGroup[g]; ok {
+			granted[rights] = true
+		}
+	}
+	for _, rights := range rightsRank {
+		if granted[rights] {
+			return rights, true
+		}
+	}
+	return "", false
+}
+
+// oidcUser finds the user linked to the subject, links a user with the same email on the first login,
+// or creates one if provisioning is on. The rights follow the groups in the directory only for users it created,
+// a user who had an account here keeps the rights an admin gave them.
+// An account is only linked by email when the directory says the email is verified, and never when the account
+// has or needs two factor, since the directory login would skip it. Those an administrator links.
+func oidcUser(cfg OIDCConfig, claims oidcClaims, rights models.UserRights, mfaRequired func(models.UserRights) bool) (models.User, error) {
+	var user models.User
+	initializers.DB.Where("oidc_subject = ?", claims.Subject).First(&user)
+
+	if user.ID == 0 && claims.Email != "" {
+		var local models.User
+		initializers.DB.Where("LOWER(email) = LOWER(?) AND oidc_subject IS NULL", claims.Email).First(&local)
+		if local.ID != 0 {
+			verified := claims.EmailVerified != nil && *claims.EmailVerified
+			if !verified || local.TOTPEnabled || mfaRequired(local.Rights) {
+				return models.User{}, &OIDCLinkError{User: local, Subject: claims.Subject}
+			}
+			user = local
+		}
+	}
+
+	// the issuer is the company directory, so an email is trusted for a new user unless it says it is not verified
+	emailTrusted := claims.Email != "" && (claims.EmailVerified == nil || *claims.EmailVerified)
+
+	if user.ID == 0 {
+		if !cfg.Provision || !emailTrusted {
+			return models.User{}, ErrOIDCNoAccount
+		}
+		name := claims.Name
+		if name == "" {
+			name = claims.Email
+		}
+		user = models.User{
+			Initials:    initialsOf(name),
+			Name:        name,
+			Username:    claims.Email,
+			Email:       claims.Email,
+			Rights:      rights,
+			OIDCSubject: &claims.Subject,
+			OIDCRights:  true,
+		}
+		// no password, these users can only log in through the directory
+		if err := initializers.DB.Create(&user).Error; err != nil {
+			return models.User{}, err
+		}
+		LogUserCreate(user, user)
+		return user, nil
+	}
+
+	// the directory account may still exist after the user has been deactivated here
+	if !UserActive(user) {
+		return models.User{}, ErrUserInactive
+	}
+
+	updates := map[string]interface{}{}
+	if user.OIDCSubject == nil {
+		updates["oidc_subject"] = claims.Subject
+	}
+	if user.OIDCRights && user.Rights != rights {
+		updates["rights"] = rights
+	}
+	if len(updates) > 0 {
+		olduser := user
+		if err := initializers.DB.Model(&user).Updates(updates).Error; err != nil {
+			return models.User{}, err
+		}
+		user.OIDCSubject = &claims.Subject
+		if user.OIDCRights {
+			user.Rights = rights
+		}
+		LogUserPatch(user, olduser, user)
+	}
+	return user, nil
+}
+
+func initialsOf(name string) string {
+	initials := ""
+	for _, part := range strings.Fields(name) {
+		initials += strings.ToLower(string([]rune(part)[0]))
+	}
+	return initials
+}
@@ -0,0 +1,344 @@
+package internal
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/markuskjeldsen/mop-backend-api/initializers"
+	"github.com/markuskjeldsen/mop-backend-api/internal/testdb"
+	"github.com/markuskjeldsen/mop-backend-api/models"
+)
+
+// testIssuer is an identity provider with discovery, the signing keys and a token endpoint.
+// The token endpoint hands out an id token with the claims set for the next login.
+type testIssuer struct {
+	srv    *httptest.Server
+	key    *rsa.PrivateKey
+	claims map[string]interface{}
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iss := &testIssuer{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                iss.srv.URL,
+			"authorization_endpoint":                iss.srv.URL + "/authorize",
+			"token_endpoint":                        iss.srv.URL + "/token",
+			"jwks_uri":                              iss.srv.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"alg": "RS256",
+				"use": "sig",
+				"kid": "test",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "code" || r.FormValue("code_verifier") == "" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     iss.sign(t, iss.claims),
+		})
+	})
+	iss.srv = httptest.NewServer(mux)
+	t.Cleanup(iss.srv.Close)
+	return iss
+}
+
+func (iss *testIssuer) sign(t *testing.T, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, iss.key, crypto.SHA256, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// login goes through BeginOIDCLogin and FinishOIDCLogin, the id token has the claims
+func (iss *testIssuer) login(t *testing.T, claims map[string]interface{}) (models.User, error) {
+	t.Helper()
+	ctx := context.Background()
+	authURL, state, err := BeginOIDCLogin(ctx, "/visits")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	iss.claims = map[string]interface{}{
+		"iss":   iss.srv.URL,
+		"aud":   "mop",
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": u.Query().Get("nonce"),
+	}
+	for k, v := range claims {
+		iss.claims[k] = v
+	}
+
+	user, redirectTo, err := FinishOIDCLogin(ctx, state, "code", mfaRequired)
+	if err == nil && redirectTo != "/visits" {
+		t.Errorf("redirect to %q, want /visits", redirectTo)
+	}
+	return user, err
+}
+
+// mfaRequired is the rule of the api, the office and up must have two factor
+func mfaRequired(rights models.UserRights) bool {
+	return rights == models.RightsDeveloper || rights == models.RightsAdmin || rights == models.RightsOfficeWorker
+}
+
+func storedUser(t *testing.T, id uint) models.User {
+	t.Helper()
+	var user models.User
+	if err := initializers.DB.First(&user, id).Error; err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func setupOIDC(t *testing.T, provision bool) *testIssuer {
+	t.Helper()
+	testdb.Use(t, &models.User{}, &models.ActivityLog{}, &models.OIDCLoginState{})
+	iss := newTestIssuer(t)
+	t.Setenv("OIDC_ISSUER", iss.srv.URL)
+	t.Setenv("OIDC_CLIENT_ID", "mop")
+	t.Setenv("OIDC_REDIRECT_URL", "http://localhost/api/v1/oidc/callback")
+	t.Setenv("OIDC_GROUP_RIGHTS", "mop-office=office,mop-admins=admin,mop-konsulenter=user")
+	if provision {
+		t.Setenv("OIDC_PROVISION", "true")
+	} else {
+		t.Setenv("OIDC_PROVISION", "")
+	}
+
+	// the provider is kept between logins, every test has its own issuer
+	oidcClient.provider = nil
+	t.Cleanup(func() { oidcClient.provider = nil })
+	return iss
+}
+
+func TestOIDCProvisionedUserFollowsGroups(t *testing.T) {
+	iss := setupOIDC(t, true)
+
+	user, err := iss.login(t, map[string]interface{}{
+		"sub":    "subject-1",
+		"email":  "ny@firma.dk",
+		"name":   "Ny Konsulent",
+		"groups": []string{"mop-konsulenter"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ID == 0 || user.Rights != models.RightsUser || !user.OIDCRights {
+		t.Fatalf("got user %d with rights %q and oidc rights %v, want a new user with user rights from the directory", user.ID, user.Rights, user.OIDCRights)
+	}
+	if user.Initials != "nk" {
+		t.Errorf("initials %q, want nk", user.Initials)
+	}
+
+	again, err := iss.login(t, map[string]interface{}{
+		"sub":    "subject-1",
+		"email":  "ny@firma.dk",
+		"groups": []string{"mop-konsulenter", "mop-office"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ID != user.ID || again.Rights != models.RightsOfficeWorker {
+		t.Errorf("got user %d with rights %q, want user %d with office rights", again.ID, again.Rights, user.ID)
+	}
+}
+
+func TestOIDCLinkedUserKeepsRights(t *testing.T) {
+	iss := setupOIDC(t, false)
+
+	local := models.User{Name: "Anna", Username: "anna", Password: "hash", Email: "Anna@Firma.dk", Rights: models.RightsAuditor}
+	if err := initializers.DB.Create(&local).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := iss.login(t, map[string]interface{}{
+		"sub":            "subject-anna",
+		"email":          "anna@firma.dk",
+		"email_verified": true,
+		"groups":         []string{"mop-konsulenter"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ID != local.ID {
+		t.Fatalf("logged in as user %d, want the local user %d", user.ID, local.ID)
+	}
+	if user.Rights != models.RightsAuditor || user.OIDCRights {
+		t.Errorf("rights %q and oidc rights %v, want the local auditor rights to be kept", user.Rights, user.OIDCRights)
+	}
+	stored := storedUser(t, local.ID)
+	if stored.Rights != models.RightsAuditor || stored.OIDCSubject == nil || *stored.OIDCSubject != "subject-anna" {
+		t.Errorf("stored rights %q and subject %v, want auditor linked to subject-anna", stored.Rights, stored.OIDCSubject)
+	}
+
+	// once linked the subject is used, also when the email in the directory changes
+	again, err := iss.login(t, map[string]interface{}{
+		"sub":    "subject-anna",
+		"email":  "anna.hansen@firma.dk",
+		"groups": []string{"mop-admins"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ID != local.ID || again.Rights != models.RightsAuditor {
+		t.Errorf("got user %d with rights %q, want user %d still auditor", again.ID, again.Rights, local.ID)
+	}
+}
+
+func TestOIDCNotLinkedByEmail(t *testing.T) {
+	tests := []struct {
+		name     string
+		user     models.User
+		verified interface{} // the email_verified claim, nil leaves it out
+	}{
+		{name: "two factor enabled", user: models.User{Rights: models.RightsUser, TOTPEnabled: true}, verified: true},
+		{name: "rights that need two factor", user: models.User{Rights: models.RightsDeveloper}, verified: true},
+		{name: "email not said to be verified", user: models.User{Rights: models.RightsUser}},
+		{name: "email not verified", user: models.User{Rights: models.RightsUser}, verified: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// provisioning must not make a second account with the email either
+			iss := setupOIDC(t, true)
+			local := tt.user
+			local.Name, local.Username, local.Password, local.Email = "Anna", "anna", "hash", "anna@firma.dk"
+			if err := initializers.DB.Create(&local).Error; err != nil {
+				t.Fatal(err)
+			}
+
+			claims := map[string]interface{}{"sub": "someone", "email": "anna@firma.dk", "groups": []string{"mop-office"}}
+			if tt.verified != nil {
+				claims["email_verified"] = tt.verified
+			}
+			_, err := iss.login(t, claims)
+			var linkErr *OIDCLinkError
+			if !errors.As(err, &linkErr) || linkErr.User.ID != local.ID || linkErr.Subject != "someone" {
+				t.Fatalf("got %v, want an OIDCLinkError for user %d and subject someone", err, local.ID)
+			}
+			if stored := storedUser(t, local.ID); stored.OIDCSubject != nil {
+				t.Errorf("the local user was linked to %q", *stored.OIDCSubject)
+			}
+			var count int64
+			initializers.DB.Model(&models.User{}).Count(&count)
+			if count != 1 {
+				t.Errorf("%d users, want no new user", count)
+			}
+		})
+	}
+}
+
+func TestOIDCLinkedByAdmin(t *testing.T) {
+	iss := setupOIDC(t, false)
+	subject := "subject-dev"
+	local := models.User{Name: "Dev", Username: "dev", Password: "hash", Email: "dev@firma.dk", Rights: models.RightsDeveloper, TOTPEnabled: true, OIDCSubject: &subject}
+	if err := initializers.DB.Create(&local).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := iss.login(t, map[string]interface{}{"sub": subject, "email": "dev@firma.dk", "groups": []string{"mop-konsulenter"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ID != local.ID || user.Rights != models.RightsDeveloper {
+		t.Errorf("got user %d with rights %q, want user %d still developer", user.ID, user.Rights, local.ID)
+	}
+}
+
+func TestOIDCRefusedLogins(t *testing.T) {
+	tests := []struct {
+		name      string
+		provision bool
+		claims    map[string]interface{}
+		want      error
+	}{
+		{
+			name:   "no group with access",
+			claims: map[string]interface{}{"sub": "s", "email": "a@firma.dk", "groups": []string{"everyone"}},
+			want:   ErrOIDCNoRights,
+		},
+		{
+			name:   "unknown email without provisioning",
+			claims: map[string]interface{}{"sub": "s", "email": "ukendt@firma.dk", "groups": []string{"mop-office"}},
+			want:   ErrOIDCNoAccount,
+		},
+		{
+			name:      "unverified email is not provisioned",
+			provision: true,
+			claims:    map[string]interface{}{"sub": "s", "email": "a@firma.dk", "email_verified": false, "groups": []string{"mop-office"}},
+			want:      ErrOIDCNoAccount,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			iss := setupOIDC(t, tt.provision)
+			if _, err := iss.login(t, tt.claims); !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestOIDCStateIsUsedOnce(t *testing.T) {
+	iss := setupOIDC(t, true)
+	ctx := context.Background()
+	authURL, state, err := BeginOIDCLogin(ctx, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(authURL)
+	iss.claims = map[string]interface{}{
+		"iss": iss.srv.URL, "aud": "mop", "sub": "s", "email": "a@firma.dk", "groups": []string{"mop-office"},
+		"iat": time.Now().Unix(), "exp": time.Now().Add(time.Hour).Unix(), "nonce": u.Query().Get("nonce"),
+	}
+
+	if _, _, err := FinishOIDCLogin(ctx, state, "code", mfaRequired); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := FinishOIDCLogin(ctx, state, "code", mfaRequired); !errors.Is(err, ErrOIDCState) {
+		t.Errorf("second use of the state got %v, want %v", err, ErrOIDCState)
+	}
+}
@@ -0,0 +1,280 @@
+package internal
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/markuskjeldsen/mop-backend-api/models"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// PasswordPolicy is shared by user creation, password change and password reset,
+// the frontend gets the same values from GET /password/policy so it can show the rules up front.
+type PasswordPolicy struct {
+	MinLength   int                       `json:"min_length"`
+	MinClasses  int                       `json:"min_classes"`  // out of lower case, upper case, digits and symbols
+	HistorySize int                       `json:"history_size"` // the new password may not match any of the last HistorySize passwords
+	MaxAgeDays  map[models.UserRights]int `json:"max_age_days"` // rights not in the map never have to change their password
+}
+
+// Policy is the one in use, the server sets MaxAgeDays from the environment with PasswordPolicyFromEnv
+var Policy = PasswordPolicy{
+	MinLength:   10,
+	MinClasses:  3,
+	HistorySize: 5,
+	MaxAgeDays:  map[models.UserRights]int{},
+}
+
+// PasswordPolicyFromEnv returns the policy with the password ages from the environment.
+//
+//	PASSWORD_MAX_AGE_DAYS  days before a password must be changed per rights, e.g. admin=180,developer=90
+func PasswordPolicyFromEnv() (PasswordPolicy, error) {
+	policy := Policy
+	policy.MaxAgeDays = map[models.UserRights]int{}
+	for _, pair := range strings.Split(os.Getenv("PASSWORD_MAX_AGE_DAYS"), ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		rights, value, found := strings.Cut(pair, "=")
+		days, err := strconv.Atoi(strings.TrimSpace(value))
+		if !found || err != nil || days <= 0 {
+			return policy, fmt.Errorf("PASSWORD_MAX_AGE_DAYS: %q must be rights=days", pair)
+		}
+		policy.MaxAgeDays[models.UserRights(strings.TrimSpace(rights))] = days
+	}
+	return policy, nil
+}
+
+// the rules a password can break, the frontend uses them as keys for its messages
+const (
+	RuleMinLength = "min_length"
+	RuleClasses   = "character_classes"
+	RuleCommon    = "common_password"
+	RulePersonal  = "contains_name"
+	RuleReused    = "reused"
+)
+
+type PasswordViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// PasswordPolicyError lists every rule the password breaks, not just the first one.
+type PasswordPolicyError struct {
+	Violations []PasswordViolation `json:"violations"`
+}
+
+func (e *PasswordPolicyError) Error() string {
+	msgs := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		msgs[i] = v.Message
+	}
+	return "password does not meet the policy: " + strings.Join(msgs, ", ")
+}
+
+//go:embed common_passwords.txt
+var commonPasswordsFile string
+
+var commonPasswords = loadCommonPasswords()
+
+func loadCommonPasswords() map[string]bool {
+	passwords := map[string]bool{}
+	scanner := bufio.NewScanner(strings.NewReader(commonPasswordsFile))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		passwords[strings.ToLower(line)] = true
+	}
+	return passwords
+}
+
+// isCommonPassword also catches the usual "Sommer2024!" by stripping digits and symbols from the end
+func isCommonPassword(password string) bool {
+	lower := strings.ToLower(password)
+	if commonPasswords[lower] {
+		return true
+	}
+	stripped := strings.TrimRightFunc(lower, func(r rune) bool {
+		return unicode.IsDigit(r) || unicode.IsPunct(r) || unicode.IsSymbol(r)
+	})
+	return stripped != "" && commonPasswords[stripped]
+}
+
+func characterClasses(password string) int {
+	var lower, upper, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	count := 0
+	for _, b := range []bool{lower, upper, digit, symbol} {
+		if b {
+			count++
+		}
+	}
+	return count
+}
+
+// containsPersonalInfo checks the username and each part of the name, short parts like initials are ignored
+func containsPersonalInfo(user models.User, password string) bool {
+	lower := strings.ToLower(password)
+	parts := append(strings.Fields(user.Name), user.Username)
+	for _, part := range parts {
+		part = strings.ToLower(part)
+		if len([]rune(part)) >= 3 && strings.Contains(lower, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// reusesPassword compares against the current password and the stored history.
+func reusesPassword(db *gorm.DB, user models.User, password string) bool {
+	hashes := []string{}
+	if user.Password != "" {
+		hashes = append(hashes, user.Password)
+	}
+
+	var history []models.PasswordHistory
+	db.Where("user_id = ?", user.ID).Order("created_at DESC").Limit(Policy.HistorySize).Find(&history)
+	for _, h := range history {
+		if h.Hash != user.Password {
+			hashes = append(hashes, h.Hash)
+		}
+	}
+
+	for _, hash := range hashes {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidatePassword checks the password against every rule of the policy.
+// The user is used for the name and history checks, for a user that is not created yet only the name is used.
+// The returned error is a *PasswordPolicyError when the password breaks one or more rules.
+func ValidatePassword(db *gorm.DB, user models.User, password string) error {
+	var violations []PasswordViolation
+
+	if len([]rune(password)) < Policy.MinLength {
+		violations = append(violations, PasswordViolation{
+			Rule:    RuleMinLength,
+			Message: fmt.Sprintf("password must be at least %d characters", Policy.MinLength),
+		})
+	}
+	if characterClasses(password) < Policy.MinClasses {
+		violations = append(violations, PasswordViolation{
+			Rule:    RuleClasses,
+			Message: fmt.Sprintf("password must contain %d of: lower case, upper case, digits and symbols", Policy.MinClasses),
+		})
+	}
+	if isCommonPassword(password) {
+		violations = append(violations, PasswordViolation{
+			Rule:    RuleCommon,
+			Message: "password is too common",
+		})
+	}
+	if containsPersonalInfo(user, password) {
+		violations = append(violations, PasswordViolation{
+			Rule:    RulePersonal,
+			Message: "password must not contain your name or username",
+		})
+	}
+	// the bcrypt comparisons are slow, so they are only done for an otherwise valid password
+	if len(violations) == 0 && user.ID != 0 && reusesPassword(db, user, password) {
+		violations = append(violations, PasswordViolation{
+			Rule:    RuleReused,
+			Message: fmt.Sprintf("password must not be one of your last %d passwords", Policy.HistorySize),
+		})
+	}
+
+	if len(violations) > 0 {
+		return &PasswordPolicyError{Violations: violations}
+	}
+	return nil
+}
+
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), 14)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// RecordPasswordHistory stores the hash and forgets the ones older than the policy needs.
+func RecordPasswordHistory(db *gorm.DB, userID uint, hash string) error {
+	if err := db.Create(&models.PasswordHistory{UserID: userID, Hash: hash}).Error; err != nil {
+		return err
+	}
+
+	var keep []uint
+	db.Model(&models.PasswordHistory{}).
+		Where("user_id = ?", userID).
+		Order("created_at DESC").
+		Limit(Policy.HistorySize).
+		Pluck("id", &keep)
+	if len(keep) == 0 {
+		return nil
+	}
+	return db.Unscoped().Where("user_id = ? AND id NOT IN ?", userID, keep).Delete(&models.PasswordHistory{}).Error
+}
+
+// SetPassword validates the password, and stores its hash on the user together with the history.
+func SetPassword(db *gorm.DB, user *models.User, password string) error {
+	if err := ValidatePassword(db, *user, password); err != nil {
+		return err
+	}
+	return StorePassword(db, user, password)
+}
+
+// StorePassword stores the hash of a password that has already been validated.
+func StorePassword(db *gorm.DB, user *models.User, password string) error {
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		if err := tx.Model(user).Updates(map[string]interface{}{
+			"password":            hash,
+			"password_changed_at": &now,
+		}).Error; err != nil {
+			return err
+		}
+		return RecordPasswordHistory(tx, user.ID, hash)
+	})
+}
+
+// PasswordExpired reports whether the user has to change their password before doing anything else.
+func PasswordExpired(user models.User) bool {
+	days, ok := Policy.MaxAgeDays[user.Rights]
+	// users from single sign-on have no password here
+	if !ok || days <= 0 || user.Password == "" {
+		return false
+	}
+	changed := user.CreatedAt
+	if user.PasswordChangedAt != nil {
+		changed = *user.PasswordChangedAt
+	}
+	return time.Since(changed) > time.Duration(days)*24*time.Hour
+}
@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/markuskjeldsen/mop-backend-api/initializers"
+	"github.com/markuskjeldsen/mop-backend-api/internal/mail"
+	"github.com/markuskjeldsen/mop-backend-api/models"
+	"gorm.io/gorm"
+)
+
+const PasswordResetTTL = time.Hour
+
+var ErrResetTokenInvalid = errors.New("the reset link is invalid or has expired")
+
+// SendPasswordReset creates a reset token for the user and mails them a link with it.
+// Any older token the user has not used yet stops working.
+func SendPasswordReset(user models.User, ip string) error {
+	if user.Email == "" {
+		return fmt.Errorf("user %d has no email", user.ID)
+	}
+
+	token, err := newRandomToken()
+	if err != nil {
+		return err
+	}
+
+	err = initializers.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.PasswordResetToken{}).
+			Where("user_id = ? AND used_at IS NULL", user.ID).
+			Update("expires_at", time.Now()).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.PasswordResetToken{
+			UserID:    user.ID,
+			TokenHash: hashToken(token),
+			ExpiresAt: time.Now().Add(PasswordResetTTL),
+			IP:        ip,
+		}).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	link := os.Getenv("FRONTEND_URL") + "/reset-password?token=" + url.QueryEscape(token)
+	return mail.Default().Send(mail.Message{
+		To:      user.Email,
+		Subject: "Nulstil din adgangskode",
+		Body: fmt.Sprintf(
+			"Hej %s\n\nDer er bedt om at nulstille adgangskoden til din konto.\nBrug linket herunder inden for en time:\n\n%s\n\nHar du ikke bedt om det, kan du se bort fra denne mail.\n",
+			user.Name, link),
+	})
+}
+
+// PeekPasswordReset returns the user a valid token belongs to without using it,
+// so the new password can be checked against the policy before the link is spent.
+func PeekPasswordReset(token string) (models.User, error) {
+	var reset models.PasswordResetToken
+	err := initializers.DB.Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", hashToken(token), time.Now()).
+		First(&reset).Error
+	if err != nil {
+		return models.User{}, ErrResetTokenInvalid
+	}
+
+	var user models.User
+	if err := initializers.DB.First(&user, reset.UserID).Error; err != nil {
+		return models.User{}, ErrResetTokenInvalid
+	}
+	return user, nil
+}
+
+// ConsumePasswordReset checks the token and marks it as used, so it only works once.
+// The user the token belongs to is returned.
+func ConsumePasswordReset(token string) (models.User, error) {
+	var user models.User
+	err := initializers.DB.Transaction(func(tx *gorm.DB) error {
+		var reset models.PasswordResetToken
+		err := tx.Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", hashToken(token), time.Now()).
+			First(&reset).Error
+		if err != nil {
+			return ErrResetTokenInvalid
+		}
+
+		// guard against two requests using the token at the same time
+		result := tx.Model(&models.PasswordResetToken{}).
+			Where("id = ? AND used_at IS NULL", reset.ID).
+			Update("used_at", time.Now())
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrResetTokenInvalid
+		}
+
+		if err := tx.First(&user, reset.UserID).Error; err != nil {
+			return ErrResetTokenInvalid
+		}
+		return nil
+	})
+	return user, err
+}
@@ -261,7 +261,10 @@ func pdfHeader(pdf *fpdf.Fpdf, v models.Visit) {
 	pdf.CellFormat(20, 6, "Dato", "", 0, "", false, 0, "")
 	pdf.CellFormat(30, 6, v.VisitDate.Format("2006-01-02"), "", 0, "", false, 0, "")
 	pdf.CellFormat(10, 6, "Kl:", "", 0, "", false, 0, "")
-	pdf.CellFormat(40, 6, v.VisitResponse.ActTime[5:], "", 1, "", false, 0, "")
+	pdf.CellFormat(40, 6, v.VisitResponse.ActTime[5:], "", 0, "", false, 0, "")
+	// the version of the response the pdf is made from, so a printed report can be matched with the history
+	pdf.CellFormat(15, 6, "Version:", "", 0, "", false, 0, "")
+	pdf.CellFormat(75, 6, fmt.Sprintf("%d, %s", v.VisitResponse.Version, v.VisitResponse.UpdatedAt.Format("2006-01-02 15:04")), "", 1, "R", false, 0, "")
 
 	pdf.Ln(2) // Small gap
 	pdf.CellFormat(40, 6, "Debitorer:", "", 1, "", false, 0, "")
@@ -538,6 +541,9 @@ func GeneratePDFVisit(visitID uint) ([]byte, error) {
 	sanitizedAddress := re.ReplaceAllString(visit.Address, "_")
 	sanitizedAddress = strings.ReplaceAll(sanitizedAddress, "__", "_")
 	filename := fmt.Sprintf("pdfs/visit_%d_%s.pdf", visitID, sanitizedAddress)
+	if visit.VisitResponse != nil {
+		filename = fmt.Sprintf("pdfs/visit_%d_%s_v%d.pdf", visitID, sanitizedAddress, visit.VisitResponse.Version)
+	}
 	os.MkdirAll("pdfs", os.ModePerm)
 
 	pdfBuf := fpdf.New("P", "mm", "A4", "")
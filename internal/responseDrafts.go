@@ -0,0 +1,157 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/gin-gonic/gin/binding"
+	"github.com/markuskjeldsen/mop-backend-api/initializers"
+	"github.com/markuskjeldsen/mop-backend-api/models"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrDraftForbidden   = errors.New("only the konsulent of the visit can fill out its response")
+	ErrVisitHasResponse = errors.New("the visit already has a response, edit it instead")
+	ErrDraftStale       = errors.New("the draft was saved from somewhere else since, get it again before saving")
+)
+
+// draftVisit returns the visit of a draft when the user may fill out its response
+func draftVisit(tx *gorm.DB, actingUser models.User, visitID uint) (models.Visit, error) {
+	var visit models.Visit
+	if err := tx.Preload("VisitResponse").First(&visit, visitID).Error; err != nil {
+		return visit, err
+	}
+	if visit.UserID != actingUser.ID {
+		return visit, ErrDraftForbidden
+	}
+	if visit.VisitResponse != nil {
+		return visit, ErrVisitHasResponse
+	}
+	return visit, nil
+}
+
+// mergeDraft adds the fields to the data of the draft, a field sent as null is cleared.
+// The error is a ValidationError for fields a response does not have or values of the wrong type.
+func mergeDraft(data []byte, fields map[string]json.RawMessage) ([]byte, error) {
+	merged := map[string]json.RawMessage{}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &merged); err != nil {
+			return nil, err
+		}
+	}
+	for field, value := range fields {
+		if !editableResponseFields[field] {
+			return nil, ValidationError{fmt.Sprintf("%s is not a field of the response", field)}
+		}
+		if string(value) == "null" {
+			delete(merged, field)
+			continue
+		}
+		merged[field] = value
+	}
+	raw, _ := json.Marshal(merged)
+	var check models.VisitResponse
+	if err := json.Unmarshal(raw, &check); err != nil {
+		return nil, ValidationError{err.Error()}
+	}
+	return raw, nil
+}
+
+// GetResponseDraft returns the draft of the response to the visit, gorm.ErrRecordNotFound when none is saved.
+func GetResponseDraft(actingUser models.User, visitID uint) (models.VisitResponseDraft, error) {
+	var draft models.VisitResponseDraft
+	var visit models.Visit
+	if err := initializers.DB.First(&visit, visitID).Error; err != nil {
+		return draft, err
+	}
+	if visit.UserID != actingUser.ID {
+		return draft, ErrDraftForbidden
+	}
+	err := initializers.DB.Where("visit_id = ?", visitID).First(&draft).Error
+	return draft, err
+}
+
+// SaveResponseDraft adds the fields to the draft of the response to the visit, the draft is made on the first save.
+// With a revision the save is refused if the draft has been saved since that revision.
+func SaveResponseDraft(actingUser models.User, visitID uint, fields map[string]json.RawMessage, revision *int) (models.VisitResponseDraft, error) {
+	var draft models.VisitResponseDraft
+	err := initializers.DB.Transaction(func(tx *gorm.DB) error {
+		if _, err := draftVisit(tx, actingUser, visitID); err != nil {
+			return err
+		}
+		err := tx.Where("visit_id = ?", visitID).First(&draft).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		if revision != nil && *revision != draft.Revision {
+			return ErrDraftStale
+		}
+
+		data, err := mergeDraft(draft.Data, fields)
+		if err != nil {
+			return err
+		}
+		draft.VisitID = visitID
+		draft.UserID = actingUser.ID
+		draft.Data = data
+		draft.Revision++
+		return tx.Save(&draft).Error
+	})
+	return draft, err
+}
+
+// DiscardResponseDraft throws the draft of the response to the visit away.
+func DiscardResponseDraft(actingUser models.User, visitID uint) error {
+	var visit models.Visit
+	if err := initializers.DB.First(&visit, visitID).Error; err != nil {
+		return err
+	}
+	if visit.UserID != actingUser.ID {
+		return ErrDraftForbidden
+	}
+	return initializers.DB.Unscoped().Where("visit_id = ?", visitID).Delete(&models.VisitResponseDraft{}).Error
+}
+
+// SubmitResponseDraft turns the draft, with the last fields added, into the response of the visit and sends the visit to review.
+// The required fields of a response are only checked here. Nothing is saved if the visit cannot go to review.
+func SubmitResponseDraft(tx *gorm.DB, actingUser models.User, can PermissionCheck, visitID uint, fields map[string]json.RawMessage) (models.VisitResponse, error) {
+	var response models.VisitResponse
+	if _, err := draftVisit(tx, actingUser, visitID); err != nil {
+		return response, err
+	}
+	var draft models.VisitResponseDraft
+	err := tx.Where("visit_id = ?", visitID).First(&draft).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return response, err
+	}
+	data, err := mergeDraft(draft.Data, fields)
+	if err != nil {
+		return response, err
+	}
+
+	if err := json.Unmarshal(data, &response); err != nil {
+		return response, ValidationError{err.Error()}
+	}
+	// the id and the version are not the draft's to choose, a new response is the first version
+	response.ID = 0
+	response.VisitID = visitID
+	response.Version = 1
+	if err := binding.Validator.ValidateStruct(response); err != nil {
+		return response, ValidationError{err.Error()}
+	}
+
+	if err := tx.Create(&response).Error; err != nil {
+		return response, err
+	}
+	if err := RecordResponseVersion(tx, response, actingUser.ID); err != nil {
+		return response, err
+	}
+	if draft.ID != 0 {
+		if err := tx.Unscoped().Delete(&draft).Error; err != nil {
+			return response, err
+		}
+	}
+	return response, TransitionVisit(tx, actingUser, can, visitID, models.VisitStatusToReview)
+}
@@ -0,0 +1,353 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin/binding"
+	"github.com/markuskjeldsen/mop-backend-api/initializers"
+	"github.com/markuskjeldsen/mop-backend-api/models"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrResponseForbidden   = errors.New("only the konsulent of the visit or the office can edit the response")
+	ErrResponseEditPending = errors.New("the response already has an edit waiting for approval")
+	ErrResponseEditDecided = errors.New("the edit has already been approved or rejected")
+	ErrResponseEditOwn     = errors.New("an edit has to be approved by someone other than who made it")
+	ErrResponseEditStale   = errors.New("the response was changed after the edit was made, the edit has to be made again")
+)
+
+// permReview is the permission of the office to review responses, it lets them edit any response and approve edits
+const permReview = "visits:review"
+
+// FieldChange is one field of a response that an edit changed.
+type FieldChange struct {
+	Field string          `json:"field"`
+	Old   json.RawMessage `json:"old"`
+	New   json.RawMessage `json:"new"`
+}
+
+// editableResponseFields are the json names of the fields an edit may change,
+// the visit, the images and the bookkeeping fields cannot be changed
+var editableResponseFields = func() map[string]bool {
+	fields := map[string]bool{}
+	t := reflect.TypeOf(models.VisitResponse{})
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		fields[name] = true
+	}
+	delete(fields, "visit_id")
+	delete(fields, "images")
+	delete(fields, "version")
+	return fields
+}()
+
+func responseSnapshot(response models.VisitResponse) datatypes.JSON {
+	response.Images = nil
+	snapshot, _ := json.Marshal(response)
+	return snapshot
+}
+
+// RecordResponseVersion stores the response as it is now as its current version.
+// CreateVisitResponse calls it for the first version.
+func RecordResponseVersion(tx *gorm.DB, response models.VisitResponse, userID uint) error {
+	return tx.Create(&models.VisitResponseVersion{
+		VisitResponseID: response.ID,
+		VisitID:         response.VisitID,
+		Version:         response.Version,
+		Snapshot:        responseSnapshot(response),
+		Changes:         datatypes.JSON("[]"),
+		CreatedByID:     userID,
+	}).Error
+}
+
+// ensureFirstVersion stores the current version of responses made before versions were kept, by the konsulent of the visit
+func ensureFirstVersion(tx *gorm.DB, response models.VisitResponse) error {
+	var count int64
+	if err := tx.Model(&models.VisitResponseVersion{}).Where("visit_response_id = ?", response.ID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	var visit models.Visit
+	tx.Unscoped().First(&visit, response.VisitID)
+	return RecordResponseVersion(tx, response, visit.UserID)
+}
+
+// diffResponse applies the patch to a copy of the response and returns it with the fields that changed.
+// The error is a ValidationError for fields that cannot be edited, wrong values or a required field left empty.
+func diffResponse(response models.VisitResponse, patch map[string]json.RawMessage) (models.VisitResponse, []FieldChange, error) {
+	fields := make([]string, 0, len(patch))
+	for field := range patch {
+		if !editableResponseFields[field] {
+			return response, nil, ValidationError{fmt.Sprintf("%s cannot be edited", field)}
+		}
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	var current map[string]json.RawMessage
+	raw, _ := json.Marshal(response)
+	if err := json.Unmarshal(raw, &current); err != nil {
+		return response, nil, err
+	}
+	for field, value := range patch {
+		current[field] = value
+	}
+	raw, _ = json.Marshal(current)
+
+	var updated models.VisitResponse
+	if err := json.Unmarshal(raw, &updated); err != nil {
+		return response, nil, ValidationError{err.Error()}
+	}
+	if err := binding.Validator.ValidateStruct(updated); err != nil {
+		return response, nil, ValidationError{err.Error()}
+	}
+
+	// compare the values as they come out of the struct, so 5 and 5.0 are not a change
+	var before, after map[string]json.RawMessage
+	raw, _ = json.Marshal(response)
+	json.Unmarshal(raw, &before)
+	raw, _ = json.Marshal(updated)
+	json.Unmarshal(raw, &after)
+
+	changes := []FieldChange{}
+	for _, field := range fields {
+		if !bytes.Equal(before[field], after[field]) {
+			changes = append(changes, FieldChange{Field: field, Old: before[field], New: after[field]})
+		}
+	}
+	if len(changes) == 0 {
+		return response, nil, ValidationError{"the edit does not change anything"}
+	}
+	return updated, changes, nil
+}
+
+// applyResponseEdit saves the updated response as the next version of the response
+func applyResponseEdit(tx *gorm.DB, response models.VisitResponse, updated *models.VisitResponse, changes []FieldChange, userID uint, editID *uint) (models.VisitResponseVersion, error) {
+	if err := ensureFirstVersion(tx, response); err != nil {
+		return models.VisitResponseVersion{}, err
+	}
+	updated.Version = response.Version + 1
+	if err := tx.Omit("Images").Save(updated).Error; err != nil {
+		return models.VisitResponseVersion{}, err
+	}
+	changesJSON, _ := json.Marshal(changes)
+	version := models.VisitResponseVersion{
+		VisitResponseID: updated.ID,
+		VisitID:         updated.VisitID,
+		Version:         updated.Version,
+		Snapshot:        responseSnapshot(*updated),
+		Changes:         changesJSON,
+		CreatedByID:     userID,
+		EditID:          editID,
+	}
+	return version, tx.Create(&version).Error
+}
+
+// VersionChanged tells if the field, by its json name, is among the changes of the version
+func VersionChanged(version models.VisitResponseVersion, field string) bool {
+	var changes []FieldChange
+	json.Unmarshal(version.Changes, &changes)
+	for _, change := range changes {
+		if change.Field == field {
+			return true
+		}
+	}
+	return false
+}
+
+// ResponseEditResult is what an edit became, a new version or, for an exported visit, an edit waiting for approval.
+type ResponseEditResult struct {
+	Response models.VisitResponse         `json:"response"`
+	Version  *models.VisitResponseVersion `json:"version,omitempty"`
+	Edit     *models.VisitResponseEdit    `json:"edit,omitempty"`
+}
+
+// EditVisitResponse changes the fields in the patch, keyed by their json names.
+// The konsulent of the visit and the office can edit, once the visit is exported the edit waits for the office to approve it.
+func EditVisitResponse(actingUser models.User, can PermissionCheck, responseID uint, patch map[string]json.RawMessage) (ResponseEditResult, error) {
+	var result ResponseEditResult
+	err := initializers.DB.Transaction(func(tx *gorm.DB) error {
+		var response models.VisitResponse
+		if err := tx.First(&response, responseID).Error; err != nil {
+			return err
+		}
+		var visit models.Visit
+		if err := tx.First(&visit, response.VisitID).Error; err != nil {
+			return err
+		}
+		if visit.UserID != actingUser.ID && !can(permReview) {
+			return ErrResponseForbidden
+		}
+
+		updated, changes, err := diffResponse(response, patch)
+		if err != nil {
+			return err
+		}
+
+		if visit.StatusID != models.VisitStatusExported {
+			version, err := applyResponseEdit(tx, response, &updated, changes, actingUser.ID, nil)
+			if err != nil {
+				return err
+			}
+			result = ResponseEditResult{Response: updated, Version: &version}
+			return nil
+		}
+
+		var pending int64
+		if err := tx.Model(&models.VisitResponseEdit{}).
+			Where("visit_response_id = ? AND status = ?", response.ID, models.ResponseEditPending).
+			Count(&pending).Error; err != nil {
+			return err
+		}
+		if pending > 0 {
+			return ErrResponseEditPending
+		}
+		patchJSON, _ := json.Marshal(patch)
+		changesJSON, _ := json.Marshal(changes)
+		edit := models.VisitResponseEdit{
+			VisitResponseID: response.ID,
+			VisitID:         response.VisitID,
+			BaseVersion:     response.Version,
+			Patch:           patchJSON,
+			Changes:         changesJSON,
+			Status:          models.ResponseEditPending,
+			RequestedByID:   actingUser.ID,
+		}
+		if err := tx.Create(&edit).Error; err != nil {
+			return err
+		}
+		result = ResponseEditResult{Response: response, Edit: &edit}
+		return nil
+	})
+	return result, err
+}
+
+func findPendingResponseEdit(tx *gorm.DB, id uint) (models.VisitResponseEdit, error) {
+	var edit models.VisitResponseEdit
+	if err := tx.First(&edit, id).Error; err != nil {
+		return edit, err
+	}
+	if edit.Status != models.ResponseEditPending {
+		return edit, ErrResponseEditDecided
+	}
+	return edit, nil
+}
+
+// ApproveResponseEdit applies an edit of an exported response as its next version.
+// It is refused when the response changed since the edit was made, or when the one approving made the edit.
+func ApproveResponseEdit(actingUser models.User, id uint) (models.VisitResponseEdit, models.VisitResponseVersion, error) {
+	var edit models.VisitResponseEdit
+	var version models.VisitResponseVersion
+	err := initializers.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		edit, err = findPendingResponseEdit(tx, id)
+		if err != nil {
+			return err
+		}
+		if edit.RequestedByID == actingUser.ID {
+			return ErrResponseEditOwn
+		}
+		var response models.VisitResponse
+		if err := tx.First(&response, edit.VisitResponseID).Error; err != nil {
+			return err
+		}
+		if response.Version != edit.BaseVersion {
+			return ErrResponseEditStale
+		}
+
+		var patch map[string]json.RawMessage
+		if err := json.Unmarshal(edit.Patch, &patch); err != nil {
+			return err
+		}
+		updated, changes, err := diffResponse(response, patch)
+		if err != nil {
+			return err
+		}
+		version, err = applyResponseEdit(tx, response, &updated, changes, edit.RequestedByID, &edit.ID)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		result := tx.Model(&models.VisitResponseEdit{}).
+			Where("id = ? AND status = ?", edit.ID, models.ResponseEditPending).
+			Updates(map[string]interface{}{
+				"status":        models.ResponseEditApproved,
+				"decided_by_id": actingUser.ID,
+				"decided_at":    now,
+				"version":       version.Version,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrResponseEditDecided
+		}
+		edit.Status = models.ResponseEditApproved
+		edit.DecidedByID = &actingUser.ID
+		edit.DecidedAt = &now
+		edit.Version = &version.Version
+		return nil
+	})
+	return edit, version, err
+}
+
+// RejectResponseEdit closes an edit without changing the response.
+func RejectResponseEdit(actingUser models.User, id uint, reason string) (models.VisitResponseEdit, error) {
+	edit, err := findPendingResponseEdit(initializers.DB, id)
+	if err != nil {
+		return edit, err
+	}
+	now := time.Now()
+	// only an edit that is still pending is rejected, so one decided in the meantime is not overwritten
+	result := initializers.DB.Model(&models.VisitResponseEdit{}).
+		Where("id = ? AND status = ?", id, models.ResponseEditPending).
+		Updates(map[string]interface{}{
+			"status":          models.ResponseEditRejected,
+			"decided_by_id":   actingUser.ID,
+			"decided_at":      now,
+			"rejected_reason": reason,
+		})
+	if result.Error != nil {
+		return edit, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return edit, ErrResponseEditDecided
+	}
+	edit.Status = models.ResponseEditRejected
+	edit.DecidedByID = &actingUser.ID
+	edit.DecidedAt = &now
+	edit.RejectedReason = reason
+	return edit, nil
+}
+
+// ResponseEdits lists the edits of exported responses with the status, all of them when it is empty, the newest first.
+func ResponseEdits(status models.ResponseEditStatus) ([]models.VisitResponseEdit, error) {
+	edits := []models.VisitResponseEdit{}
+	q := initializers.DB.Order("id DESC")
+	if status != "" {
+		q = q.Where("status = ?", status)
+	}
+	return edits, q.Find(&edits).Error
+}
+
+// ResponseVersions lists the versions of a response, the first first.
+func ResponseVersions(responseID uint) ([]models.VisitResponseVersion, error) {
+	versions := []models.VisitResponseVersion{}
+	err := initializers.DB.Where("visit_response_id = ?", responseID).Order("version").Find(&versions).Error
+	return versions, err
+}
@@ -0,0 +1,260 @@
+package internal
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/markuskjeldsen/mop-backend-api/initializers"
+	"github.com/markuskjeldsen/mop-backend-api/models"
+	"gorm.io/gorm"
+)
+
+// the access token is short lived, the refresh token keeps the user logged in between visits
+const AccessTokenTTL = 15 * time.Minute
+const RefreshTokenTTL = 7 * 24 * time.Hour
+
+var ErrSessionInvalid = errors.New("session is expired or revoked")
+
+type SessionTokens struct {
+	AccessToken  string
+	RefreshToken string
+	Session      models.Session
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newRandomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func signAccessToken(userID uint, sessionID uint) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub": userID,
+		"sid": sessionID,
+		"exp": time.Now().Add(AccessTokenTTL).Unix(),
+	})
+	return token.SignedString([]byte(os.Getenv("JWT_secret")))
+}
+
+// the mfa token proves the password was correct, it is exchanged for a session once the second factor is given
+const MFATokenTTL = 5 * time.Minute
+
+func SignMFAToken(userID uint) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub": userID,
+		"mfa": true,
+		"exp": time.Now().Add(MFATokenTTL).Unix(),
+	})
+	return token.SignedString([]byte(os.Getenv("JWT_secret")))
+}
+
+// ParseMFAToken returns the user an mfa token was issued to. Access tokens are not accepted.
+func ParseMFAToken(tokenString string) (uint, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		return []byte(os.Getenv("JWT_secret")), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil {
+		return 0, err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return 0, errors.New("invalid token")
+	}
+	if mfa, _ := claims["mfa"].(bool); !mfa {
+		return 0, errors.New("not an mfa token")
+	}
+	if _, ok := claims["exp"].(float64); !ok {
+		return 0, errors.New("token has no expiry")
+	}
+	sub, ok := claims["sub"].(float64)
+	if !ok {
+		return 0, errors.New("token has no subject")
+	}
+	return uint(sub), nil
+}
+
+// ParseAccessToken validates the signature and expiry of an access token and returns the user and session it was issued for.
+func ParseAccessToken(tokenString string) (userID uint, sessionID uint, err error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		return []byte(os.Getenv("JWT_secret")), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return 0, 0, errors.New("invalid token")
+	}
+
+	// jwt.Parse already checks exp when present, but tokens without one must not live forever
+	if _, ok := claims["exp"].(float64); !ok {
+		return 0, 0, errors.New("token has no expiry")
+	}
+
+	sub, ok := claims["sub"].(float64)
+	if !ok {
+		return 0, 0, errors.New("token has no subject")
+	}
+	sid, ok := claims["sid"].(float64)
+	if !ok {
+		return 0, 0, errors.New("token has no session")
+	}
+	return uint(sub), uint(sid), nil
+}
+
+// CreateSession starts a new session for the user and returns the first pair of tokens.
+func CreateSession(user models.User, ip string, userAgent string) (SessionTokens, error) {
+	if !UserActive(user) {
+		return SessionTokens{}, ErrUserInactive
+	}
+
+	refreshToken, err := newRandomToken()
+	if err != nil {
+		return SessionTokens{}, err
+	}
+
+	session := models.Session{
+		UserID:           user.ID,
+		RefreshTokenHash: hashToken(refreshToken),
+		IP:               ip,
+		UserAgent:        userAgent,
+		ExpiresAt:        time.Now().Add(RefreshTokenTTL),
+		LastUsedAt:       time.Now(),
+	}
+	if err := initializers.DB.Create(&session).Error; err != nil {
+		return SessionTokens{}, err
+	}
+
+	accessToken, err := signAccessToken(user.ID, session.ID)
+	if err != nil {
+		return SessionTokens{}, err
+	}
+
+	return SessionTokens{AccessToken: accessToken, RefreshToken: refreshToken, Session: session}, nil
+}
+
+// RefreshSession exchanges a refresh token for a new pair of tokens. The old refresh token stops working.
+// If a token that has already been rotated is presented again, it has most likely been stolen,
+// so the whole session is revoked.
+func RefreshSession(refreshToken string, ip string, userAgent string) (SessionTokens, error) {
+	hash := hashToken(refreshToken)
+
+	var session models.Session
+	err := initializers.DB.Where("refresh_token_hash = ?", hash).First(&session).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		var reused models.Session
+		if initializers.DB.Where("previous_token_hash = ?", hash).First(&reused).Error == nil {
+			RevokeSession(reused.ID, "refresh token reused")
+		}
+		return SessionTokens{}, ErrSessionInvalid
+	}
+	if err != nil {
+		return SessionTokens{}, err
+	}
+
+	if session.RevokedAt != nil || time.Now().After(session.ExpiresAt) {
+		return SessionTokens{}, ErrSessionInvalid
+	}
+
+	// the user may have been deleted since the session was created
+	var user models.User
+	if err := initializers.DB.First(&user, session.UserID).Error; err != nil {
+		RevokeSession(session.ID, "user no longer exists")
+		return SessionTokens{}, ErrSessionInvalid
+	}
+	if !UserActive(user) {
+		RevokeSession(session.ID, "user "+string(user.Status))
+		return SessionTokens{}, ErrSessionInvalid
+	}
+
+	newToken, err := newRandomToken()
+	if err != nil {
+		return SessionTokens{}, err
+	}
+
+	// only rotate if nobody else rotated the token in the meantime
+	result := initializers.DB.Model(&models.Session{}).
+		Where("id = ? AND refresh_token_hash = ?", session.ID, hash).
+		Updates(map[string]interface{}{
+			"refresh_token_hash":  hashToken(newToken),
+			"previous_token_hash": hash,
+			"ip":                  ip,
+			"user_agent":          userAgent,
+			"last_used_at":        time.Now(),
+		})
+	if result.Error != nil {
+		return SessionTokens{}, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return SessionTokens{}, ErrSessionInvalid
+	}
+
+	accessToken, err := signAccessToken(user.ID, session.ID)
+	if err != nil {
+		return SessionTokens{}, err
+	}
+
+	initializers.DB.First(&session, session.ID)
+	return SessionTokens{AccessToken: accessToken, RefreshToken: newToken, Session: session}, nil
+}
+
+// ActiveSession returns the session if it belongs to the user and has neither expired nor been revoked.
+func ActiveSession(sessionID uint, userID uint) (models.Session, error) {
+	var session models.Session
+	err := initializers.DB.
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL AND expires_at > ?", sessionID, userID, time.Now()).
+		First(&session).Error
+	if err != nil {
+		return models.Session{}, ErrSessionInvalid
+	}
+	return session, nil
+}
+
+// ActiveSessions lists the sessions of a user that can still be used.
+func ActiveSessions(userID uint) ([]models.Session, error) {
+	var sessions []models.Session
+	err := initializers.DB.
+		Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, time.Now()).
+		Order("last_used_at DESC").
+		Find(&sessions).Error
+	return sessions, err
+}
+
+func RevokeSession(sessionID uint, reason string) error {
+	return initializers.DB.Model(&models.Session{}).
+		Where("id = ? AND revoked_at IS NULL", sessionID).
+		Updates(map[string]interface{}{
+			"revoked_at":     time.Now(),
+			"revoked_reason": reason,
+		}).Error
+}
+
+// RevokeUserSessions revokes every session of the user except exceptID, pass 0 to revoke them all.
+func RevokeUserSessions(userID uint, exceptID uint, reason string) error {
+	result := initializers.DB.Model(&models.Session{}).
+		Where("user_id = ? AND id != ? AND revoked_at IS NULL", userID, exceptID).
+		Updates(map[string]interface{}{
+			"revoked_at":     time.Now(),
+			"revoked_reason": reason,
+		})
+	if result.Error != nil {
+		return fmt.Errorf("failed to revoke sessions for user %d: %w", userID, result.Error)
+	}
+	return nil
+}
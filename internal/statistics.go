@@ -0,0 +1,260 @@
+package internal
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/markuskjeldsen/mop-backend-api/initializers"
+	"github.com/markuskjeldsen/mop-backend-api/models"
+	"gorm.io/gorm/clause"
+)
+
+// StatsPeriod is how the statistics are split up over time.
+type StatsPeriod string
+
+const (
+	PeriodDay   StatsPeriod = "day"
+	PeriodWeek  StatsPeriod = "week"
+	PeriodMonth StatsPeriod = "month"
+)
+
+// VisitStats are the numbers of one konsulent, for a whole range or one period of it.
+type VisitStats struct {
+	Period          string  `json:"period,omitempty"`
+	Visits          int     `json:"visits"`
+	DebitorAnswered int     `json:"debitor_answered"` // visits where it was noted whether the debitor was home
+	DebitorHome     int     `json:"debitor_home"`
+	DebitorHomeRate float64 `json:"debitor_home_rate"` // debitor_home / debitor_answered, 0 when nothing is answered
+	Payments        int     `json:"payments"`
+	PaymentAmount   float64 `json:"payment_amount"`
+	AssetsRecovered int     `json:"assets_recovered"`
+	Exported        int     `json:"exported"`
+}
+
+// Metric returns the number an achievement or the leaderboard is based on.
+func (s VisitStats) Metric(metric models.StatsMetric) float64 {
+	switch metric {
+	case models.MetricVisits:
+		return float64(s.Visits)
+	case models.MetricDebitorHome:
+		return float64(s.DebitorHome)
+	case models.MetricPayments:
+		return float64(s.Payments)
+	case models.MetricPaymentAmount:
+		return s.PaymentAmount
+	case models.MetricAssetsRecovered:
+		return float64(s.AssetsRecovered)
+	case models.MetricExported:
+		return float64(s.Exported)
+	}
+	return 0
+}
+
+func ValidStatsMetric(metric models.StatsMetric) bool {
+	switch metric {
+	case models.MetricVisits, models.MetricDebitorHome, models.MetricPayments,
+		models.MetricPaymentAmount, models.MetricAssetsRecovered, models.MetricExported:
+		return true
+	}
+	return false
+}
+
+func ValidStatsPeriod(period StatsPeriod) bool {
+	return period == PeriodDay || period == PeriodWeek || period == PeriodMonth
+}
+
+func periodKey(t time.Time, period StatsPeriod) string {
+	switch period {
+	case PeriodDay:
+		return t.Format("2006-01-02")
+	case PeriodWeek:
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	}
+	return t.Format("2006-01")
+}
+
+func (s *VisitStats) addResponse(r models.VisitResponse) {
+	s.Visits++
+	if r.DebitorIsHome != nil {
+		s.DebitorAnswered++
+		if *r.DebitorIsHome {
+			s.DebitorHome++
+		}
+	}
+	if r.PaymentReceived != nil && *r.PaymentReceived {
+		s.Payments++
+	}
+	if r.PaymentReceivedAmount != nil {
+		s.PaymentAmount += float64(*r.PaymentReceivedAmount)
+	}
+	if r.AssetDelivered != nil && *r.AssetDelivered {
+		s.AssetsRecovered++
+	}
+}
+
+func (s *VisitStats) finish() {
+	if s.DebitorAnswered > 0 {
+		s.DebitorHomeRate = float64(s.DebitorHome) / float64(s.DebitorAnswered)
+	}
+}
+
+// UserStats counts the visits of the user between from and to, both days included, and splits them by period.
+// A visit counts on the day it was performed, an export on the day the visit was marked as exported.
+// Zero from and to means all time.
+func UserStats(userID uint, from time.Time, to time.Time, period StatsPeriod) (VisitStats, []VisitStats, error) {
+	responses := initializers.DB.
+		Joins("JOIN visits ON visits.id = visit_responses.visit_id AND visits.deleted_at IS NULL").
+		Where("visits.user_id = ?", userID)
+	exports := initializers.DB.Model(&models.VisitStatusLog{}).
+		Joins("JOIN visits ON visits.id = visit_status_logs.visit_id AND visits.deleted_at IS NULL").
+		Where("visits.user_id = ? AND visit_status_logs.new_status_id = ?", userID, 5)
+	if !from.IsZero() {
+		responses = responses.Where("DATE(visit_responses.act_date) >= ?", from.Format("2006-01-02"))
+		exports = exports.Where("DATE(visit_status_logs.changed_at) >= ?", from.Format("2006-01-02"))
+	}
+	if !to.IsZero() {
+		responses = responses.Where("DATE(visit_responses.act_date) <= ?", to.Format("2006-01-02"))
+		exports = exports.Where("DATE(visit_status_logs.changed_at) <= ?", to.Format("2006-01-02"))
+	}
+
+	var rows []models.VisitResponse
+	if err := responses.Find(&rows).Error; err != nil {
+		return VisitStats{}, nil, err
+	}
+	var exportedAt []time.Time
+	if err := exports.Pluck("visit_status_logs.changed_at", &exportedAt).Error; err != nil {
+		return VisitStats{}, nil, err
+	}
+
+	total := VisitStats{}
+	byPeriod := map[string]*VisitStats{}
+	bucket := func(t time.Time) *VisitStats {
+		key := periodKey(t, period)
+		if byPeriod[key] == nil {
+			byPeriod[key] = &VisitStats{Period: key}
+		}
+		return byPeriod[key]
+	}
+
+	for _, r := range rows {
+		total.addResponse(r)
+		bucket(r.ActDate).addResponse(r)
+	}
+	for _, t := range exportedAt {
+		total.Exported++
+		bucket(t).Exported++
+	}
+
+	total.finish()
+	periods := make([]VisitStats, 0, len(byPeriod))
+	for _, s := range byPeriod {
+		s.finish()
+		periods = append(periods, *s)
+	}
+	sort.Slice(periods, func(i, j int) bool { return periods[i].Period < periods[j].Period })
+	return total, periods, nil
+}
+
+// AwardAchievements gives the user every active achievement their all time numbers have reached.
+func AwardAchievements(userID uint) error {
+	total, _, err := UserStats(userID, time.Time{}, time.Time{}, PeriodMonth)
+	if err != nil {
+		return err
+	}
+
+	var achievements []models.Achievement
+	if err := initializers.DB.Where("active = ?", true).Find(&achievements).Error; err != nil {
+		return err
+	}
+	for _, a := range achievements {
+		if total.Metric(a.Metric) < a.Threshold {
+			continue
+		}
+		// an achievement is only given once, also when two requests award it at the same time
+		err := initializers.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.UserAchievement{
+			UserID:        userID,
+			AchievementID: a.ID,
+			AwardedAt:     time.Now(),
+		}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AwardAchievementsQuietly awards the konsulent of the visit after its response was saved or exported, a failure is only logged.
+func AwardAchievementsQuietly(visitID uint) {
+	var visit models.Visit
+	if err := initializers.DB.First(&visit, visitID).Error; err != nil {
+		log.Printf("achievements for visit %d: %v", visitID, err)
+		return
+	}
+	if err := AwardAchievements(visit.UserID); err != nil {
+		log.Printf("achievements for user %d: %v", visit.UserID, err)
+	}
+}
+
+// UserAchievements are the achievements the user has earned, the first first.
+func UserAchievements(userID uint) ([]models.UserAchievement, error) {
+	earned := []models.UserAchievement{}
+	err := initializers.DB.Preload("Achievement").Where("user_id = ?", userID).Order("awarded_at").Find(&earned).Error
+	return earned, err
+}
+
+// LeaderboardEntry is one konsulent on the leaderboard.
+type LeaderboardEntry struct {
+	Rank     int     `json:"rank"`
+	UserID   uint    `json:"user_id"`
+	Name     string  `json:"name"`
+	Initials string  `json:"initials"`
+	Value    float64 `json:"value"`
+	Badges   int     `json:"badges"`
+}
+
+// Leaderboard ranks the active users who have opted in by the metric between from and to.
+// Users with the same value share the rank.
+func Leaderboard(metric models.StatsMetric, from time.Time, to time.Time) ([]LeaderboardEntry, error) {
+	var users []models.User
+	err := initializers.DB.
+		Where("leaderboard_opt_in = ? AND (status = ? OR status = '' OR status IS NULL)", true, models.UserStatusActive).
+		Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]LeaderboardEntry, 0, len(users))
+	for _, user := range users {
+		total, _, err := UserStats(user.ID, from, to, PeriodMonth)
+		if err != nil {
+			return nil, err
+		}
+		var badges int64
+		initializers.DB.Model(&models.UserAchievement{}).Where("user_id = ?", user.ID).Count(&badges)
+		entries = append(entries, LeaderboardEntry{
+			UserID:   user.ID,
+			Name:     user.Name,
+			Initials: user.Initials,
+			Value:    total.Metric(metric),
+			Badges:   int(badges),
+		})
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Value != entries[j].Value {
+			return entries[i].Value > entries[j].Value
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	for i := range entries {
+		if i > 0 && entries[i].Value == entries[i-1].Value {
+			entries[i].Rank = entries[i-1].Rank
+		} else {
+			entries[i].Rank = i + 1
+		}
+	}
+	return entries, nil
+}
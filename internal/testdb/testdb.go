@@ -0,0 +1,37 @@
+// Package testdb gives tests an empty database in place of initializers.DB.
+package testdb
+
+import (
+	"testing"
+
+	"github.com/markuskjeldsen/mop-backend-api/initializers"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Use points initializers.DB at an empty database in memory with the tables of the models, for the length of the test
+func Use(t *testing.T, tables ...interface{}) {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every connection to :memory: is its own database, so there may only be one
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	db.Exec("PRAGMA foreign_keys = ON;")
+	if err := db.AutoMigrate(tables...); err != nil {
+		t.Fatal(err)
+	}
+
+	previous := initializers.DB
+	initializers.DB = db
+	t.Cleanup(func() {
+		initializers.DB = previous
+		sqlDB.Close()
+	})
+}
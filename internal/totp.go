@@ -0,0 +1,151 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/markuskjeldsen/mop-backend-api/models"
+)
+
+// TOTP as described in RFC 6238, with the defaults every authenticator app supports:
+// SHA1, 6 digits and a 30 second period.
+const totpPeriod = 30
+const totpDigits = 6
+
+// a code from the step before or after is accepted as well, phones are not always in sync
+const totpSkew = 1
+
+const recoveryCodeCount = 10
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func GenerateTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// TOTPProvisioningURI is the otpauth:// uri the frontend turns into a QR code for the authenticator app.
+func TOTPProvisioningURI(user models.User, secret string) string {
+	issuer := os.Getenv("TOTP_ISSUER")
+	if issuer == "" {
+		issuer = "MOP"
+	}
+
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+
+	label := url.PathEscape(issuer + ":" + user.Username)
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+func totpCode(key []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	// dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// ValidateTOTP checks the code against the secret and returns the time step it matched.
+// lastStep is the step of the last accepted code, a code is never accepted twice.
+func ValidateTOTP(secret string, code string, lastStep int64, now time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimSpace(secret)))
+	if err != nil {
+		return 0, false
+	}
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// GenerateRecoveryCodes returns the codes to show the user once, and the hashes to store on the user.
+func GenerateRecoveryCodes() ([]string, []byte, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		raw := strings.ToLower(totpEncoding.EncodeToString(b)) // 8 characters
+		code := raw[:4] + "-" + raw[4:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+
+	hashJSON, err := json.Marshal(hashes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return codes, hashJSON, nil
+}
+
+// UseRecoveryCode checks the code against the stored hashes.
+// If it matches, the remaining hashes are returned so the code cannot be used again.
+func UseRecoveryCode(stored []byte, code string) ([]byte, bool) {
+	var hashes []string
+	if err := json.Unmarshal(stored, &hashes); err != nil {
+		return stored, false
+	}
+
+	hash := hashRecoveryCode(code)
+	for i, h := range hashes {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+			remaining := append(hashes[:i:i], hashes[i+1:]...)
+			remainingJSON, err := json.Marshal(remaining)
+			if err != nil {
+				return stored, false
+			}
+			return remainingJSON, true
+		}
+	}
+	return stored, false
+}
@@ -0,0 +1,159 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/markuskjeldsen/mop-backend-api/initializers"
+	"github.com/markuskjeldsen/mop-backend-api/models"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrUserInactive      = errors.New("the account is suspended or deactivated")
+	ErrUserHasOpenVisits = errors.New("the user still has visits that are not performed, hand them over first")
+	ErrHandoverTarget    = errors.New("visits can only be handed over to another active user")
+)
+
+// visits that are not performed yet, i.e. not visited and not sent to review or exported
+const openVisitsQuery = "user_id = ? AND visited = ? AND status_id < 4"
+
+// UserActive reports whether the user may log in and use the api.
+// Users created before the status existed have an empty status and count as active.
+func UserActive(user models.User) bool {
+	return user.Status == models.UserStatusActive || user.Status == ""
+}
+
+func ValidUserStatus(status models.UserStatus) bool {
+	switch status {
+	case models.UserStatusActive, models.UserStatusSuspended, models.UserStatusDeactivated:
+		return true
+	}
+	return false
+}
+
+// OpenVisits are the visits of the user that a handover would move.
+func OpenVisits(db *gorm.DB, userID uint) ([]models.Visit, error) {
+	var visits []models.Visit
+	err := db.Where(openVisitsQuery, userID, false).Order("visit_date, id").Find(&visits).Error
+	return visits, err
+}
+
+// SetUserStatus moves the user to the status and logs them out everywhere unless they become active.
+// A user cannot be deactivated while they still have open visits, so no visit is left without a konsulent.
+func SetUserStatus(actingUser models.User, user models.User, status models.UserStatus, reason string) (models.User, error) {
+	if status == models.UserStatusDeactivated {
+		var open int64
+		initializers.DB.Model(&models.Visit{}).Where(openVisitsQuery, user.ID, false).Count(&open)
+		if open > 0 {
+			return user, ErrUserHasOpenVisits
+		}
+	}
+
+	olduser := user
+	now := time.Now()
+	err := initializers.DB.Model(&user).Updates(map[string]interface{}{
+		"status":            status,
+		"status_reason":     reason,
+		"status_changed_at": &now,
+	}).Error
+	if err != nil {
+		return user, err
+	}
+
+	if status != models.UserStatusActive {
+		RevokeUserSessions(user.ID, 0, "user "+string(status))
+	}
+
+	LogUserPatch(actingUser, olduser, user)
+	return user, nil
+}
+
+// RestoreUser makes the user active again, also users that were deleted before deleting became deactivating.
+func RestoreUser(actingUser models.User, user models.User) (models.User, error) {
+	if user.DeletedAt.Valid {
+		// the name and username may have been taken by someone else since
+		err := initializers.DB.Unscoped().Model(&user).Update("deleted_at", nil).Error
+		if err != nil {
+			return user, fmt.Errorf("could not restore the user, the name or username may be in use: %w", err)
+		}
+		user.DeletedAt = gorm.DeletedAt{}
+	}
+	return SetUserStatus(actingUser, user, models.UserStatusActive, "")
+}
+
+// HandoverResult is what was moved from one konsulent to another.
+type HandoverResult struct {
+	FromUserID uint   `json:"from_user_id"`
+	ToUserID   uint   `json:"to_user_id"`
+	VisitIDs   []uint `json:"visit_ids"`
+	GroupIDs   []uint `json:"group_ids"`
+
+	Unavailable []UnavailableVisit `json:"unavailable"` // visits on days the new konsulent is away
+}
+
+// UnavailableVisit is a visit that falls on a day the konsulent is away.
+type UnavailableVisit struct {
+	VisitID   uint             `json:"visit_id"`
+	VisitDate time.Time        `json:"visit_date"`
+	Absences  []models.Absence `json:"absences"`
+}
+
+// HandoverVisits moves the open visits of the user, and with them their groups, to another konsulent.
+// Visits that are already performed stay with the user so the history keeps showing who did them.
+// Every move is written to the visit log. With dryRun nothing is changed, so the office can see what would move.
+// Visits on days the new konsulent is away refuse the handover with an UnavailableError, unless it is overridden.
+func HandoverVisits(actingUser models.User, from models.User, to models.User, dryRun bool, override bool) (HandoverResult, error) {
+	result := HandoverResult{FromUserID: from.ID, ToUserID: to.ID, VisitIDs: []uint{}, GroupIDs: []uint{}, Unavailable: []UnavailableVisit{}}
+	if to.ID == from.ID || !UserActive(to) {
+		return result, ErrHandoverTarget
+	}
+
+	err := initializers.DB.Transaction(func(tx *gorm.DB) error {
+		visits, err := OpenVisits(tx, from.ID)
+		if err != nil {
+			return err
+		}
+
+		seenGroups := map[uint]bool{}
+		checkedDays := map[string]bool{}
+		for _, v := range visits {
+			result.VisitIDs = append(result.VisitIDs, v.ID)
+			if v.GroupId != nil && !seenGroups[*v.GroupId] {
+				seenGroups[*v.GroupId] = true
+				result.GroupIDs = append(result.GroupIDs, *v.GroupId)
+			}
+			if !v.VisitDate.IsZero() {
+				absences, err := absencesBetween(tx, to.ID, v.VisitDate, v.VisitDate)
+				if err != nil {
+					return err
+				}
+				if len(absences) > 0 {
+					result.Unavailable = append(result.Unavailable, UnavailableVisit{VisitID: v.ID, VisitDate: v.VisitDate, Absences: absences})
+				}
+			}
+			if dryRun {
+				continue
+			}
+
+			// an override is logged once per day
+			day := v.VisitDate.Format("2006-01-02")
+			if !v.VisitDate.IsZero() && !checkedDays[day] {
+				checkedDays[day] = true
+				if err := CheckAvailable(tx, actingUser, to.ID, v.VisitDate, override); err != nil {
+					return err
+				}
+			}
+
+			if err := UpdateVisitValue(tx, v.ID, fmt.Sprintf("%v", to.ID), actingUser, "user_id"); err != nil {
+				return err
+			}
+			if err := tx.Model(&v).Update("user_id", to.ID).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return result, err
+}
@@ -0,0 +1,202 @@
+package internal
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/markuskjeldsen/mop-backend-api/initializers"
+	"github.com/markuskjeldsen/mop-backend-api/models"
+	"gorm.io/gorm"
+)
+
+const (
+	DefaultPageLimit = 50
+	MaxPageLimit     = 200
+)
+
+// VisitFilter narrows a visit listing, zero values are left out.
+type VisitFilter struct {
+	StatusIDs   []uint
+	From        time.Time // visit date, both days included
+	To          time.Time
+	UserID      uint // the konsulent
+	Sagsnr      uint
+	Klient      string
+	GroupID     uint
+	TypeID      uint
+	HasResponse bool // only visits with a response, also makes act_date a sort key
+
+	IncludeUnassigned bool // also the visits of user 1, who holds the visits that have no konsulent yet
+}
+
+// PageRequest is how much of a listing to return and in which order.
+// Sort is a key from visitSortKeys, with a leading - for descending. With a cursor the offset is ignored.
+type PageRequest struct {
+	Limit  int
+	Offset int
+	Cursor string
+	Sort   string
+}
+
+// Page is the envelope every paginated listing is returned in.
+type Page[T any] struct {
+	Items      []T    `json:"items"`
+	Total      int64  `json:"total"` // all the rows that match the filter, not only this page
+	Limit      int    `json:"limit"`
+	Offset     int    `json:"offset"`
+	Sort       string `json:"sort"`
+	NextCursor string `json:"next_cursor,omitempty"` // pass as ?cursor to get the next page, empty on the last page
+}
+
+// visitSortKey is a column to sort by and how to look up its value for the visit a cursor points at
+type visitSortKey struct {
+	column   string
+	lookup   string
+	response bool // needs the join on visit_responses
+}
+
+var visitSortKeys = map[string]visitSortKey{
+	"id":         {column: "visits.id", lookup: "SELECT id FROM visits WHERE id = ?"},
+	"created_at": {column: "visits.created_at", lookup: "SELECT created_at FROM visits WHERE id = ?"},
+	"visit_date": {column: "visits.visit_date", lookup: "SELECT visit_date FROM visits WHERE id = ?"},
+	"sagsnr":     {column: "visits.sagsnr", lookup: "SELECT sagsnr FROM visits WHERE id = ?"},
+	"status":     {column: "visits.status_id", lookup: "SELECT status_id FROM visits WHERE id = ?"},
+	"konsulent":  {column: "visits.user_id", lookup: "SELECT user_id FROM visits WHERE id = ?"},
+	"stop_nr":    {column: "visits.stopnr", lookup: "SELECT stopnr FROM visits WHERE id = ?"},
+	"act_date":   {column: "visit_responses.act_date", lookup: "SELECT act_date FROM visit_responses WHERE visit_id = ?", response: true},
+}
+
+// VisitSortKeys returns the names that can be used to sort, for error messages.
+func VisitSortKeys() []string {
+	return []string{"id", "created_at", "visit_date", "sagsnr", "status", "konsulent", "stop_nr", "act_date"}
+}
+
+func encodeCursor(id uint) string {
+	return base64.RawURLEncoding.EncodeToString([]byte("v:" + strconv.FormatUint(uint64(id), 10)))
+}
+
+func decodeCursor(cursor string) (uint, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || !strings.HasPrefix(string(raw), "v:") {
+		return 0, ValidationError{"invalid cursor"}
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(string(raw), "v:"), 10, 64)
+	if err != nil {
+		return 0, ValidationError{"invalid cursor"}
+	}
+	return uint(id), nil
+}
+
+// visitScope limits the listing to the visits of the user unless seeAll is set.
+// The handler sets seeAll when the request has visits:read, which covers the office and api keys scoped to it,
+// so a konsulent or an api key without it only gets the visits assigned to it
+func visitScope(db *gorm.DB, user models.User, seeAll bool) *gorm.DB {
+	if seeAll {
+		return db
+	}
+	return db.Where("visits.user_id = ?", user.ID)
+}
+
+func applyVisitFilter(db *gorm.DB, f VisitFilter) *gorm.DB {
+	// like the v1 listings the visits without a konsulent are left out unless asked for
+	if !f.IncludeUnassigned {
+		db = db.Where("visits.user_id != 1")
+	}
+	if f.HasResponse {
+		db = db.Joins("JOIN visit_responses ON visit_responses.visit_id = visits.id AND visit_responses.deleted_at IS NULL")
+	}
+	if len(f.StatusIDs) > 0 {
+		db = db.Where("visits.status_id IN ?", f.StatusIDs)
+	}
+	if !f.From.IsZero() {
+		db = db.Where("DATE(visits.visit_date) >= ?", f.From.Format("2006-01-02"))
+	}
+	if !f.To.IsZero() {
+		db = db.Where("DATE(visits.visit_date) <= ?", f.To.Format("2006-01-02"))
+	}
+	if f.UserID != 0 {
+		db = db.Where("visits.user_id = ?", f.UserID)
+	}
+	if f.Sagsnr != 0 {
+		db = db.Where("visits.sagsnr = ?", f.Sagsnr)
+	}
+	if f.Klient != "" {
+		db = db.Where("visits.advopro_klient LIKE ?", "%"+f.Klient+"%")
+	}
+	if f.GroupID != 0 {
+		db = db.Where("visits.group_id = ?", f.GroupID)
+	}
+	if f.TypeID != 0 {
+		db = db.Where("visits.type_id = ?", f.TypeID)
+	}
+	return db
+}
+
+// ListVisits returns one page of the visits the user may see that match the filter, every visit with seeAll.
+// The preloads are applied to the visits on the page only. The error is a ValidationError for a bad sort key or cursor.
+func ListVisits(user models.User, seeAll bool, f VisitFilter, p PageRequest, preloads ...string) (Page[models.Visit], error) {
+	page := Page[models.Visit]{Items: []models.Visit{}, Limit: p.Limit, Offset: p.Offset, Sort: p.Sort}
+	if page.Limit <= 0 {
+		page.Limit = DefaultPageLimit
+	}
+	if page.Limit > MaxPageLimit {
+		page.Limit = MaxPageLimit
+	}
+	if page.Sort == "" {
+		page.Sort = "id"
+	}
+
+	name := strings.TrimPrefix(page.Sort, "-")
+	desc := strings.HasPrefix(page.Sort, "-")
+	key, ok := visitSortKeys[name]
+	if !ok {
+		return page, ValidationError{fmt.Sprintf("cannot sort by %s, use one of %s", name, strings.Join(VisitSortKeys(), ", "))}
+	}
+	if key.response && !f.HasResponse {
+		return page, ValidationError{fmt.Sprintf("%s can only be sorted by when listing responses", name)}
+	}
+
+	base := func() *gorm.DB {
+		return applyVisitFilter(visitScope(initializers.DB.Model(&models.Visit{}), user, seeAll), f)
+	}
+	if err := base().Count(&page.Total).Error; err != nil {
+		return page, err
+	}
+
+	dir, cmp := "ASC", ">"
+	if desc {
+		dir, cmp = "DESC", "<"
+	}
+	query := base().Order(fmt.Sprintf("%s %s, visits.id %s", key.column, dir, dir))
+
+	if p.Cursor != "" {
+		after, err := decodeCursor(p.Cursor)
+		if err != nil {
+			return page, err
+		}
+		// keyset pagination: the rows after the cursor in the sort order, the id breaks ties
+		query = query.Where(
+			fmt.Sprintf("(%[1]s %[2]s (%[3]s) OR (%[1]s = (%[3]s) AND visits.id %[2]s ?))", key.column, cmp, key.lookup),
+			after, after, after,
+		)
+		page.Offset = 0
+	} else if page.Offset > 0 {
+		query = query.Offset(page.Offset)
+	}
+
+	for _, preload := range preloads {
+		query = query.Preload(preload)
+	}
+	// one row more than asked for tells whether there is a next page
+	if err := query.Select("visits.*").Limit(page.Limit + 1).Find(&page.Items).Error; err != nil {
+		return page, err
+	}
+	if len(page.Items) > page.Limit {
+		page.Items = page.Items[:page.Limit]
+		page.NextCursor = encodeCursor(page.Items[len(page.Items)-1].ID)
+	}
+	return page, nil
+}
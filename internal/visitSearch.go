@@ -0,0 +1,203 @@
+package internal
+
+import (
+	"encoding/binary"
+	"strings"
+	"unicode"
+
+	"github.com/markuskjeldsen/mop-backend-api/initializers"
+	"github.com/markuskjeldsen/mop-backend-api/models"
+	"gorm.io/gorm"
+)
+
+// The search index is an FTS4 table with one row per visit, the docid is the visit id.
+// FTS4 is used and not FTS5 because go-sqlite3 only has FTS5 with the sqlite_fts5 build tag.
+// Triggers keep it in sync, so every write to the visits, their debitors and responses is indexed
+// no matter which endpoint made it. Deleted visits and debitors are left out and come back when restored.
+
+func init() {
+	// FTS4 has no ranking of its own, searchScore is called from the query so only a page leaves the database
+	initializers.RegisterSQLiteFunction("visit_search_rank", searchScore)
+}
+
+// searchColumns are the indexed columns in the order of the table, with how much a hit in them counts
+var searchColumns = []struct {
+	name   string
+	weight float64
+}{
+	{"address", 2},
+	{"notes", 1},
+	{"debitors", 3},
+	{"comments", 1},
+	{"asset_comments", 1},
+}
+
+// reindexVisits is the sql that rebuilds the rows of the visits, {visits} is an id or a select of ids
+const reindexVisits = `
+DELETE FROM visit_search WHERE docid IN ({visits});
+INSERT INTO visit_search (docid, address, notes, debitors, comments, asset_comments)
+SELECT visits.id, COALESCE(visits.address, ''), COALESCE(visits.notes, ''),
+	COALESCE((SELECT group_concat(debitors.name, ' ') FROM visit_debitors
+		JOIN debitors ON debitors.id = visit_debitors.debitor_id AND debitors.deleted_at IS NULL
+		WHERE visit_debitors.visit_id = visits.id), ''),
+	COALESCE(visit_responses.comments, ''), COALESCE(visit_responses.asset_comments, '')
+FROM visits
+LEFT JOIN visit_responses ON visit_responses.visit_id = visits.id AND visit_responses.deleted_at IS NULL
+WHERE visits.id IN ({visits}) AND visits.deleted_at IS NULL;`
+
+// searchTriggers are the writes that change what is indexed, and which visits they touch
+var searchTriggers = []struct {
+	name   string
+	event  string
+	visits string
+}{
+	{"visit_search_visit_insert", "AFTER INSERT ON visits", "NEW.id"},
+	{"visit_search_visit_update", "AFTER UPDATE OF address, notes, deleted_at ON visits", "NEW.id"},
+	{"visit_search_visit_delete", "AFTER DELETE ON visits", "OLD.id"},
+	{"visit_search_debitor_link", "AFTER INSERT ON visit_debitors", "NEW.visit_id"},
+	{"visit_search_debitor_unlink", "AFTER DELETE ON visit_debitors", "OLD.visit_id"},
+	{"visit_search_debitor_update", "AFTER UPDATE OF name, deleted_at ON debitors", "SELECT visit_id FROM visit_debitors WHERE debitor_id = NEW.id"},
+	{"visit_search_debitor_delete", "AFTER DELETE ON debitors", "SELECT visit_id FROM visit_debitors WHERE debitor_id = OLD.id"},
+	{"visit_search_response_insert", "AFTER INSERT ON visit_responses", "NEW.visit_id"},
+	{"visit_search_response_update", "AFTER UPDATE ON visit_responses", "NEW.visit_id"},
+	{"visit_search_response_delete", "AFTER DELETE ON visit_responses", "OLD.visit_id"},
+}
+
+// SetupVisitSearch creates the search index and its triggers and fills it from the visits there are.
+// It is safe to run again, the index is rebuilt each time.
+func SetupVisitSearch(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("CREATE VIRTUAL TABLE IF NOT EXISTS visit_search USING fts4(address, notes, debitors, comments, asset_comments, tokenize=unicode61)").Error; err != nil {
+			return err
+		}
+		for _, t := range searchTriggers {
+			if err := tx.Exec("DROP TRIGGER IF EXISTS " + t.name).Error; err != nil {
+				return err
+			}
+			body := strings.ReplaceAll(reindexVisits, "{visits}", t.visits)
+			if err := tx.Exec("CREATE TRIGGER " + t.name + " " + t.event + " BEGIN " + body + " END").Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Exec("DELETE FROM visit_search").Error; err != nil {
+			return err
+		}
+		return tx.Exec(strings.ReplaceAll(reindexVisits, "{visits}", "SELECT id FROM visits")).Error
+	})
+}
+
+// searchTerms turns what the user typed into an fts query where every word has to match as a prefix.
+// Only letters and digits are kept and the words are lowercased, so nothing can be read as an fts operator.
+func searchTerms(q string) string {
+	words := strings.FieldsFunc(q, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	terms := make([]string, 0, len(words))
+	for _, w := range words {
+		terms = append(terms, strings.ToLower(w)+"*")
+	}
+	return strings.Join(terms, " ")
+}
+
+// searchScore ranks a row from its matchinfo 'pcx', a hit counts more the rarer the word is in the index.
+// It is the sql function visit_search_rank
+func searchScore(info []byte) float64 {
+	ints := make([]uint32, len(info)/4)
+	for i := range ints {
+		ints[i] = binary.NativeEndian.Uint32(info[i*4:])
+	}
+	if len(ints) < 2 {
+		return 0
+	}
+	phrases, columns := int(ints[0]), int(ints[1])
+	score := 0.0
+	for p := 0; p < phrases; p++ {
+		for c := 0; c < columns && c < len(searchColumns); c++ {
+			at := 2 + 3*(p*columns+c)
+			if at+2 >= len(ints) {
+				return score
+			}
+			hitsHere, hitsAll := ints[at], ints[at+1]
+			if hitsHere > 0 {
+				score += searchColumns[c].weight * float64(hitsHere) / float64(hitsAll)
+			}
+		}
+	}
+	return score
+}
+
+// SearchHit is a visit that matched a search, with where it matched.
+type SearchHit struct {
+	Visit   models.Visit `json:"visit"`
+	Rank    float64      `json:"rank"`    // higher is better
+	Snippet string       `json:"snippet"` // the matching text with the hits in [ ]
+}
+
+// SearchVisits finds the visits the user may see, every visit with seeAll, that match every word of the query, best match first.
+func SearchVisits(user models.User, seeAll bool, q string, limit int, offset int) (Page[SearchHit], error) {
+	page := Page[SearchHit]{Items: []SearchHit{}, Limit: limit, Offset: offset, Sort: "rank"}
+	if page.Limit <= 0 {
+		page.Limit = DefaultPageLimit
+	}
+	if page.Limit > MaxPageLimit {
+		page.Limit = MaxPageLimit
+	}
+	terms := searchTerms(q)
+	if terms == "" {
+		return page, ValidationError{"q needs at least one word to search for"}
+	}
+
+	query := func() *gorm.DB {
+		return visitScope(initializers.DB.Table("visit_search"), user, seeAll).
+			Joins("JOIN visits ON visits.id = visit_search.docid AND visits.deleted_at IS NULL").
+			Where("visit_search MATCH ?", terms)
+	}
+	if err := query().Count(&page.Total).Error; err != nil {
+		return page, err
+	}
+
+	var hits []SearchHit
+	var rows []struct {
+		VisitID uint
+		Rank    float64
+		Snippet string
+	}
+	err := query().
+		Select("visit_search.docid AS visit_id, visit_search_rank(matchinfo(visit_search, 'pcx')) AS rank, snippet(visit_search, '[', ']', '…', -1, 12) AS snippet").
+		Order("rank DESC, visit_search.docid DESC").
+		Limit(page.Limit).
+		Offset(page.Offset).
+		Scan(&rows).Error
+	if err != nil {
+		return page, err
+	}
+	for _, r := range rows {
+		hits = append(hits, SearchHit{Visit: models.Visit{Model: gorm.Model{ID: r.VisitID}}, Rank: r.Rank, Snippet: r.Snippet})
+	}
+	if len(hits) == 0 {
+		return page, nil
+	}
+
+	ids := make([]uint, len(hits))
+	for i, h := range hits {
+		ids[i] = h.Visit.ID
+	}
+	var visits []models.Visit
+	err = initializers.DB.Preload("Debitors").Preload("Status").Preload("Type").Preload("User").Preload("VisitResponse").
+		Where("id IN ?", ids).Find(&visits).Error
+	if err != nil {
+		return page, err
+	}
+	byID := make(map[uint]models.Visit, len(visits))
+	for _, v := range visits {
+		v.User.Password = ""
+		byID[v.ID] = v
+	}
+	for _, h := range hits {
+		if v, ok := byID[h.Visit.ID]; ok {
+			h.Visit = v
+			page.Items = append(page.Items, h)
+		}
+	}
+	return page, nil
+}
@@ -0,0 +1,189 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/markuskjeldsen/mop-backend-api/models"
+	"gorm.io/gorm"
+)
+
+// visitGuard returns why the visit cannot go to the next status, or "" if it can
+type visitGuard func(tx *gorm.DB, visit models.Visit) string
+
+func hasDateAndKonsulent(tx *gorm.DB, visit models.Visit) string {
+	if visit.VisitDate.IsZero() {
+		return "the visit has no date"
+	}
+	if visit.UserID == 0 {
+		return "the visit has no konsulent"
+	}
+	var count int64
+	tx.Model(&models.User{}).Where("id = ?", visit.UserID).Count(&count)
+	if count == 0 {
+		return "the konsulent of the visit does not exist"
+	}
+	return ""
+}
+
+func hasResponse(tx *gorm.DB, visit models.Visit) string {
+	var count int64
+	tx.Model(&models.VisitResponse{}).Where("visit_id = ?", visit.ID).Count(&count)
+	if count == 0 {
+		return "the visit has no response"
+	}
+	return ""
+}
+
+// an announced visit is performed after the letter is sent, so only an unannounced one can be answered while planned
+func isUnannounced(tx *gorm.DB, visit models.Visit) string {
+	if visit.TypeID == 0 {
+		return ""
+	}
+	var visitType models.VisitType
+	if err := tx.Unscoped().First(&visitType, visit.TypeID).Error; err != nil {
+		return ""
+	}
+	if !visitType.Unannounced {
+		return "the letter has to be sent before an announced visit"
+	}
+	return ""
+}
+
+// VisitTransition is an allowed change of the status of a visit.
+// Permission is the name of the permission needed, see middleware/permissions.go,
+// and with Owner the konsulent of the visit may also make it.
+// A change that needs a reason can only be made through the cancel and postpone endpoints, which record it.
+type VisitTransition struct {
+	From           uint   `json:"from"`
+	To             uint   `json:"to"`
+	Name           string `json:"name"`
+	Permission     string `json:"permission"`
+	Owner          bool   `json:"owner"`
+	ReasonRequired bool   `json:"reason_required"`
+	guards         []visitGuard
+}
+
+// visitTransitions is the only place that decides how a visit moves through its statuses.
+var visitTransitions = []VisitTransition{
+	{From: models.VisitStatusNotPlanned, To: models.VisitStatusPlanned, Name: "plan", Permission: "visits:plan", guards: []visitGuard{hasDateAndKonsulent}},
+	{From: models.VisitStatusPlanned, To: models.VisitStatusNotPlanned, Name: "unplan", Permission: "visits:plan"},
+	{From: models.VisitStatusPlanned, To: models.VisitStatusReadyToVisit, Name: "letter sent", Permission: "visits:letter", guards: []visitGuard{hasDateAndKonsulent}},
+	{From: models.VisitStatusReadyToVisit, To: models.VisitStatusPlanned, Name: "back to planned", Permission: "visits:plan"},
+	{From: models.VisitStatusPlanned, To: models.VisitStatusToReview, Name: "respond", Permission: "visits:review", Owner: true, guards: []visitGuard{isUnannounced, hasResponse}},
+	{From: models.VisitStatusReadyToVisit, To: models.VisitStatusToReview, Name: "respond", Permission: "visits:review", Owner: true, guards: []visitGuard{hasResponse}},
+	{From: models.VisitStatusToReview, To: models.VisitStatusReadyToVisit, Name: "reopen", Permission: "visits:review"},
+	{From: models.VisitStatusToReview, To: models.VisitStatusExported, Name: "export", Permission: "visits:review", guards: []visitGuard{hasResponse}},
+	{From: models.VisitStatusReadyToVisit, To: models.VisitStatusNotPlanned, Name: "postpone", Permission: "visits:plan", ReasonRequired: true},
+	{From: models.VisitStatusNotPlanned, To: models.VisitStatusCancelled, Name: "cancel", Permission: "visits:plan", ReasonRequired: true},
+	{From: models.VisitStatusPlanned, To: models.VisitStatusCancelled, Name: "cancel", Permission: "visits:plan", ReasonRequired: true},
+	{From: models.VisitStatusReadyToVisit, To: models.VisitStatusCancelled, Name: "cancel", Permission: "visits:plan", ReasonRequired: true},
+	{From: models.VisitStatusCancelled, To: models.VisitStatusNotPlanned, Name: "reinstate", Permission: "visits:plan"},
+}
+
+// VisitTransitions returns the whole graph, e.g. for the frontend to draw it.
+func VisitTransitions() []VisitTransition {
+	return append([]VisitTransition(nil), visitTransitions...)
+}
+
+func findTransition(from uint, to uint) (VisitTransition, bool) {
+	for _, t := range visitTransitions {
+		if t.From == from && t.To == to {
+			return t, true
+		}
+	}
+	return VisitTransition{}, false
+}
+
+// ReasonRequired reports whether the change from one status to another has to be given a reason code.
+func ReasonRequired(from uint, to uint) bool {
+	t, ok := findTransition(from, to)
+	return ok && t.ReasonRequired
+}
+
+func reachableFrom(from uint) []uint {
+	to := []uint{}
+	for _, t := range visitTransitions {
+		if t.From == from {
+			to = append(to, t.To)
+		}
+	}
+	return to
+}
+
+// the codes of a TransitionError
+const (
+	TransitionNotFound   = "not_found"
+	TransitionSame       = "same_status"
+	TransitionNotAllowed = "not_allowed"  // there is no such edge in the graph
+	TransitionForbidden  = "forbidden"    // the user may not make the change
+	TransitionGuard      = "guard_failed" // the visit is missing something, e.g. a response
+)
+
+// TransitionError says why a visit could not change status, it is sent to the client as it is.
+type TransitionError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	VisitID uint   `json:"visit_id"`
+	From    uint   `json:"from"`
+	To      uint   `json:"to"`
+	Allowed []uint `json:"allowed"` // the statuses the visit can go to from where it is
+}
+
+func (e *TransitionError) Error() string {
+	return e.Message
+}
+
+// PermissionCheck reports whether the acting user or api key has the named permission.
+type PermissionCheck func(permission string) bool
+
+// TransitionVisit moves the visit to the status if the graph, the permissions of the user and the guards allow it,
+// and writes the change to the status log. The error is a *TransitionError when the change is refused.
+func TransitionVisit(tx *gorm.DB, actingUser models.User, can PermissionCheck, visitID uint, to uint) error {
+	var visit models.Visit
+	if err := tx.First(&visit, visitID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return &TransitionError{Code: TransitionNotFound, Message: "visit not found", VisitID: visitID, To: to}
+		}
+		return err
+	}
+
+	refuse := func(code string, message string) error {
+		return &TransitionError{
+			Code:    code,
+			Message: message,
+			VisitID: visit.ID,
+			From:    visit.StatusID,
+			To:      to,
+			Allowed: reachableFrom(visit.StatusID),
+		}
+	}
+
+	if visit.StatusID == to {
+		return refuse(TransitionSame, "the record is already in that status code")
+	}
+	transition, ok := findTransition(visit.StatusID, to)
+	if !ok {
+		return refuse(TransitionNotAllowed, fmt.Sprintf("a visit cannot go from status %d to %d", visit.StatusID, to))
+	}
+	isOwner := transition.Owner && actingUser.APIKeyID == nil && actingUser.ID == visit.UserID
+	if !isOwner && !can(transition.Permission) {
+		return refuse(TransitionForbidden, fmt.Sprintf("%s needs the permission %s", transition.Name, transition.Permission))
+	}
+	for _, guard := range transition.guards {
+		if reason := guard(tx, visit); reason != "" {
+			return refuse(TransitionGuard, reason)
+		}
+	}
+
+	if err := tx.Model(&visit).Update("status_id", to).Error; err != nil {
+		return err
+	}
+	return tx.Create(&models.VisitStatusLog{
+		VisitID:     visit.ID,
+		OldStatusID: transition.From,
+		NewStatusID: to,
+		ChangedByID: actingUser.ID,
+		APIKeyID:    actingUser.APIKeyID,
+	}).Error
+}
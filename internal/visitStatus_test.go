@@ -0,0 +1,183 @@
+package internal
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/markuskjeldsen/mop-backend-api/initializers"
+	"github.com/markuskjeldsen/mop-backend-api/internal/testdb"
+	"github.com/markuskjeldsen/mop-backend-api/models"
+	"gorm.io/gorm"
+)
+
+const (
+	notPlanned   = models.VisitStatusNotPlanned
+	planned      = models.VisitStatusPlanned
+	readyToVisit = models.VisitStatusReadyToVisit
+	toReview     = models.VisitStatusToReview
+	exported     = models.VisitStatusExported
+	cancelled    = models.VisitStatusCancelled
+)
+
+func TestVisitTransitionGraph(t *testing.T) {
+	// every edge of the graph, any pair of statuses not in here must be refused
+	allowed := map[[2]uint]string{
+		{notPlanned, planned}:      "plan",
+		{planned, notPlanned}:      "unplan",
+		{planned, readyToVisit}:    "letter sent",
+		{readyToVisit, planned}:    "back to planned",
+		{planned, toReview}:        "respond",
+		{readyToVisit, toReview}:   "respond",
+		{toReview, readyToVisit}:   "reopen",
+		{toReview, exported}:       "export",
+		{readyToVisit, notPlanned}: "postpone",
+		{notPlanned, cancelled}:    "cancel",
+		{planned, cancelled}:       "cancel",
+		{readyToVisit, cancelled}:  "cancel",
+		{cancelled, notPlanned}:    "reinstate",
+	}
+	needsReason := map[string]bool{"postpone": true, "cancel": true}
+
+	statuses := []uint{notPlanned, planned, readyToVisit, toReview, exported, cancelled}
+	for _, from := range statuses {
+		for _, to := range statuses {
+			name, want := allowed[[2]uint{from, to}]
+			transition, ok := findTransition(from, to)
+			if ok != want {
+				t.Errorf("%d -> %d allowed is %v, want %v", from, to, ok, want)
+				continue
+			}
+			if !ok {
+				continue
+			}
+			if transition.Name != name {
+				t.Errorf("%d -> %d is %q, want %q", from, to, transition.Name, name)
+			}
+			if ReasonRequired(from, to) != needsReason[name] {
+				t.Errorf("%d -> %d reason required is %v, want %v", from, to, ReasonRequired(from, to), needsReason[name])
+			}
+		}
+	}
+	if len(VisitTransitions()) != len(allowed) {
+		t.Errorf("the graph has %d edges, want %d", len(VisitTransitions()), len(allowed))
+	}
+}
+
+// seedTransitionTest makes the statuses, a konsulent with id 1, an office worker with id 2,
+// an announced visit type with id 1 and an unannounced one with id 2
+func seedTransitionTest(t *testing.T) {
+	t.Helper()
+	testdb.Use(t, &models.User{}, &models.VisitStatus{}, &models.VisitType{}, &models.Debitor{},
+		&models.Visit{}, &models.VisitResponse{}, &models.VisitResponseImage{}, &models.VisitStatusLog{})
+	for id := notPlanned; id <= cancelled; id++ {
+		initializers.DB.Create(&models.VisitStatus{Model: gorm.Model{ID: id}})
+	}
+	initializers.DB.Create(&models.User{Model: gorm.Model{ID: 1}, Name: "Konsulent", Username: "k", Password: "x", Rights: models.RightsUser})
+	initializers.DB.Create(&models.User{Model: gorm.Model{ID: 2}, Name: "Kontor", Username: "o", Password: "x", Rights: models.RightsOfficeWorker})
+	initializers.DB.Create(&models.VisitType{Model: gorm.Model{ID: 1}, Text: "anmeldt", Active: true})
+	initializers.DB.Create(&models.VisitType{Model: gorm.Model{ID: 2}, Text: "uanmeldt", Unannounced: true, Active: true})
+}
+
+func TestTransitionVisit(t *testing.T) {
+	konsulent := models.User{Model: gorm.Model{ID: 1}, Rights: models.RightsUser}
+	office := models.User{Model: gorm.Model{ID: 2}, Rights: models.RightsOfficeWorker}
+	apiKeyID := uint(7)
+	apiKey := models.User{Model: gorm.Model{ID: 1}, APIKeyID: &apiKeyID} // an api key standing in for the konsulent
+
+	tests := []struct {
+		name     string
+		from     uint
+		to       uint
+		user     models.User
+		perms    []string
+		noDate   bool
+		typeID   uint
+		response bool
+		want     string // the code of the TransitionError, "" when the change is made
+	}{
+		{name: "plan", from: notPlanned, to: planned, user: office, perms: []string{"visits:plan"}},
+		{name: "plan without the permission", from: notPlanned, to: planned, user: office, want: TransitionForbidden},
+		{name: "plan without a date", from: notPlanned, to: planned, user: office, perms: []string{"visits:plan"}, noDate: true, want: TransitionGuard},
+		{name: "letter sent", from: planned, to: readyToVisit, user: office, perms: []string{"visits:letter"}},
+		{name: "respond as the konsulent", from: readyToVisit, to: toReview, user: konsulent, response: true},
+		{name: "respond without a response", from: readyToVisit, to: toReview, user: konsulent, want: TransitionGuard},
+		{name: "respond for another konsulent", from: readyToVisit, to: toReview, user: office, response: true, want: TransitionForbidden},
+		{name: "respond with an api key of the konsulent", from: readyToVisit, to: toReview, user: apiKey, response: true, want: TransitionForbidden},
+		{name: "respond with an api key that may review", from: readyToVisit, to: toReview, user: apiKey, perms: []string{"visits:review"}, response: true},
+		{name: "respond to an announced visit before the letter", from: planned, to: toReview, user: konsulent, typeID: 1, response: true, want: TransitionGuard},
+		{name: "respond to an unannounced visit before the letter", from: planned, to: toReview, user: konsulent, typeID: 2, response: true},
+		{name: "export", from: toReview, to: exported, user: office, perms: []string{"visits:review"}, response: true},
+		{name: "export skipping review", from: readyToVisit, to: exported, user: office, perms: []string{"visits:review"}, response: true, want: TransitionNotAllowed},
+		{name: "reopen an exported visit", from: exported, to: toReview, user: office, perms: []string{"visits:review"}, response: true, want: TransitionNotAllowed},
+		{name: "cancel an exported visit", from: exported, to: cancelled, user: office, perms: []string{"visits:plan"}, want: TransitionNotAllowed},
+		{name: "reinstate", from: cancelled, to: notPlanned, user: office, perms: []string{"visits:plan"}},
+		{name: "same status", from: planned, to: planned, user: office, perms: []string{"visits:plan"}, want: TransitionSame},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seedTransitionTest(t)
+			visit := models.Visit{UserID: 1, StatusID: tt.from, TypeID: tt.typeID, VisitDate: time.Now().AddDate(0, 0, 7)}
+			if visit.TypeID == 0 {
+				visit.TypeID = 1
+			}
+			if tt.noDate {
+				visit.VisitDate = time.Time{}
+			}
+			if err := initializers.DB.Create(&visit).Error; err != nil {
+				t.Fatal(err)
+			}
+			if tt.response {
+				initializers.DB.Create(&models.VisitResponse{VisitID: visit.ID})
+			}
+			can := func(permission string) bool {
+				for _, p := range tt.perms {
+					if p == permission {
+						return true
+					}
+				}
+				return false
+			}
+
+			err := TransitionVisit(initializers.DB, tt.user, can, visit.ID, tt.to)
+
+			var stored models.Visit
+			initializers.DB.First(&stored, visit.ID)
+			var logs []models.VisitStatusLog
+			initializers.DB.Where("visit_id = ?", visit.ID).Find(&logs)
+
+			if tt.want == "" {
+				if err != nil {
+					t.Fatalf("got %v, want the change to be made", err)
+				}
+				if stored.StatusID != tt.to {
+					t.Errorf("status is %d, want %d", stored.StatusID, tt.to)
+				}
+				if len(logs) != 1 || logs[0].OldStatusID != tt.from || logs[0].NewStatusID != tt.to || logs[0].ChangedByID != tt.user.ID {
+					t.Errorf("logs %+v, want one from %d to %d by %d", logs, tt.from, tt.to, tt.user.ID)
+				}
+				if len(logs) == 1 && (logs[0].APIKeyID == nil) != (tt.user.APIKeyID == nil) {
+					t.Errorf("log api key %v, want %v", logs[0].APIKeyID, tt.user.APIKeyID)
+				}
+				return
+			}
+
+			var transitionErr *TransitionError
+			if !errors.As(err, &transitionErr) || transitionErr.Code != tt.want {
+				t.Fatalf("got %v, want a %s TransitionError", err, tt.want)
+			}
+			if stored.StatusID != tt.from || len(logs) != 0 {
+				t.Errorf("status is %d with %d logs, want it left at %d", stored.StatusID, len(logs), tt.from)
+			}
+		})
+	}
+}
+
+func TestTransitionVisitNotFound(t *testing.T) {
+	seedTransitionTest(t)
+	err := TransitionVisit(initializers.DB, models.User{}, func(string) bool { return true }, 99, planned)
+	var transitionErr *TransitionError
+	if !errors.As(err, &transitionErr) || transitionErr.Code != TransitionNotFound {
+		t.Errorf("got %v, want a %s TransitionError", err, TransitionNotFound)
+	}
+}
@@ -0,0 +1,332 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/markuskjeldsen/mop-backend-api/initializers"
+	"github.com/markuskjeldsen/mop-backend-api/models"
+	"gorm.io/gorm"
+)
+
+// the types of a TimelineEvent
+const (
+	EventCreated   = "created"
+	EventDeleted   = "deleted"
+	EventRestored  = "restored"
+	EventStatus    = "status"
+	EventGroup     = "group"
+	EventKonsulent = "konsulent"
+	EventDate      = "date"
+	EventResponse  = "response"
+	EventEdited    = "response_edited"
+	EventEditAsked = "response_edit_requested"
+	EventImage     = "image"
+	EventFollowUp  = "follow_up"
+	EventCancelled = "cancelled"
+	EventPostponed = "postponed"
+)
+
+// TimelineEvent is one thing that happened to a visit, with the values written out for people to read.
+type TimelineEvent struct {
+	At           time.Time `json:"at"`
+	Type         string    `json:"type"`
+	Summary      string    `json:"summary"`
+	From         string    `json:"from,omitempty"`
+	To           string    `json:"to,omitempty"`
+	ActorID      *uint     `json:"actor_id"`
+	Actor        string    `json:"actor,omitempty"`
+	Impersonator string    `json:"impersonator,omitempty"` // the developer who acted as the actor
+	Source       string    `json:"source"`                 // the table the event comes from
+	SourceID     uint      `json:"source_id"`
+}
+
+// timelineNames looks up the names of users, statuses and api keys once each
+type timelineNames struct {
+	users    map[uint]string
+	statuses map[uint]string
+	apiKeys  map[uint]string
+}
+
+func (n *timelineNames) user(id uint) string {
+	if id == 0 {
+		return ""
+	}
+	if name, ok := n.users[id]; ok {
+		return name
+	}
+	var user models.User
+	name := fmt.Sprintf("user %d", id)
+	if initializers.DB.Unscoped().First(&user, id).Error == nil {
+		name = user.Name
+		if name == "" {
+			name = user.Username
+		}
+	}
+	n.users[id] = name
+	return name
+}
+
+func (n *timelineNames) status(id uint) string {
+	if name, ok := n.statuses[id]; ok {
+		return name
+	}
+	var status models.VisitStatus
+	name := fmt.Sprintf("status %d", id)
+	if initializers.DB.Unscoped().First(&status, id).Error == nil {
+		name = status.Text
+	}
+	n.statuses[id] = name
+	return name
+}
+
+func (n *timelineNames) apiKey(id uint) string {
+	if name, ok := n.apiKeys[id]; ok {
+		return name
+	}
+	var key models.APIKey
+	name := fmt.Sprintf("api key %d", id)
+	if initializers.DB.Unscoped().First(&key, id).Error == nil {
+		name = "api key " + key.Name
+	}
+	n.apiKeys[id] = name
+	return name
+}
+
+// who names the one behind a log, the api key when it was made with one
+func (n *timelineNames) who(userID uint, apiKeyID *uint) (*uint, string) {
+	if apiKeyID != nil {
+		return nil, n.apiKey(*apiKeyID)
+	}
+	if userID == 0 {
+		return nil, ""
+	}
+	return &userID, n.user(userID)
+}
+
+func (n *timelineNames) actor(e *TimelineEvent, userID uint, apiKeyID *uint) {
+	e.ActorID, e.Actor = n.who(userID, apiKeyID)
+}
+
+// VisitTimeline merges everything that is logged about a visit into one list, oldest first.
+// It also works for deleted visits.
+func VisitTimeline(visitID uint) ([]TimelineEvent, error) {
+	var visit models.Visit
+	if err := initializers.DB.Unscoped().First(&visit, visitID).Error; err != nil {
+		return nil, err
+	}
+
+	names := &timelineNames{users: map[uint]string{}, statuses: map[uint]string{}, apiKeys: map[uint]string{}}
+	events := []TimelineEvent{}
+
+	var activities []models.ActivityLog
+	err := initializers.DB.
+		Where("target_id = ? AND action_type IN ?", visitID, []string{"CREATE VISIT", "DELETE VISIT", "RESTORE VISIT"}).
+		Order("created_at, id").
+		Find(&activities).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range activities {
+		e := TimelineEvent{At: a.CreatedAt, Type: EventCreated, Summary: "visit created", Source: "activity_logs", SourceID: a.ID}
+		switch a.ActionType {
+		case "DELETE VISIT":
+			e.Type = EventDeleted
+			e.Summary = "visit deleted"
+		case "RESTORE VISIT":
+			e.Type = EventRestored
+			e.Summary = "visit restored from the trash"
+		}
+		names.actor(&e, a.ActingUserID, a.APIKeyID)
+		if a.ImpersonatorID != nil {
+			e.Impersonator = names.user(*a.ImpersonatorID)
+		}
+		events = append(events, e)
+	}
+	// visits created before the activity log existed still get a start
+	created := slices.ContainsFunc(activities, func(a models.ActivityLog) bool { return a.ActionType == "CREATE VISIT" })
+	if !created {
+		events = append(events, TimelineEvent{At: visit.CreatedAt, Type: EventCreated, Summary: "visit created", Source: "visits", SourceID: visit.ID})
+	}
+
+	var statusLogs []models.VisitStatusLog
+	if err := initializers.DB.Where("visit_id = ?", visitID).Find(&statusLogs).Error; err != nil {
+		return nil, err
+	}
+	for _, l := range statusLogs {
+		from, to := names.status(l.OldStatusID), names.status(l.NewStatusID)
+		e := TimelineEvent{
+			At:       l.ChangedAt,
+			Type:     EventStatus,
+			Summary:  fmt.Sprintf("status changed from %s to %s", from, to),
+			From:     from,
+			To:       to,
+			Source:   "visit_status_logs",
+			SourceID: l.ID,
+		}
+		names.actor(&e, l.ChangedByID, l.APIKeyID)
+		events = append(events, e)
+	}
+
+	var visitLogs []models.VisitLog
+	if err := initializers.DB.Where("visit_id = ?", visitID).Find(&visitLogs).Error; err != nil {
+		return nil, err
+	}
+	for _, l := range visitLogs {
+		e := TimelineEvent{At: l.ChangedAt, Source: "visit_logs", SourceID: l.ID}
+		switch l.ValType {
+		case "user_id":
+			e.Type = EventKonsulent
+			e.From = names.user(parseID(l.PreviousVal))
+			e.To = names.user(parseID(l.NewVal))
+			e.Summary = fmt.Sprintf("konsulent changed from %s to %s", e.From, e.To)
+		case "group_id":
+			e.Type = EventGroup
+			e.From = groupName(l.PreviousVal)
+			e.To = groupName(l.NewVal)
+			e.Summary = fmt.Sprintf("moved from %s to %s", e.From, e.To)
+		case "visit_date":
+			e.Type = EventDate
+			e.From = dateName(l.PreviousVal)
+			e.To = dateName(l.NewVal)
+			e.Summary = fmt.Sprintf("date changed from %s to %s", e.From, e.To)
+		default:
+			e.Type = l.ValType
+			e.From = l.PreviousVal
+			e.To = l.NewVal
+			e.Summary = fmt.Sprintf("%s changed from %s to %s", l.ValType, l.PreviousVal, l.NewVal)
+		}
+		names.actor(&e, l.ChangedByID, l.APIKeyID)
+		events = append(events, e)
+	}
+
+	var response models.VisitResponse
+	if initializers.DB.Unscoped().Where("visit_id = ?", visitID).First(&response).Error == nil {
+		events = append(events, TimelineEvent{
+			At:       response.CreatedAt,
+			Type:     EventResponse,
+			Summary:  fmt.Sprintf("response registered, visited %s %s", response.ActDate.Format("2006-01-02"), response.ActTime),
+			Source:   "visit_responses",
+			SourceID: response.ID,
+		})
+
+		var versions []models.VisitResponseVersion
+		initializers.DB.Where("visit_response_id = ? AND version > 1", response.ID).Find(&versions)
+		for _, version := range versions {
+			e := TimelineEvent{
+				At:       version.CreatedAt,
+				Type:     EventEdited,
+				Summary:  fmt.Sprintf("response edited to version %d: %s", version.Version, changedFields(version.Changes)),
+				Source:   "visit_response_versions",
+				SourceID: version.ID,
+			}
+			names.actor(&e, version.CreatedByID, nil)
+			events = append(events, e)
+		}
+
+		var edits []models.VisitResponseEdit
+		initializers.DB.Where("visit_response_id = ?", response.ID).Find(&edits)
+		for _, edit := range edits {
+			e := TimelineEvent{
+				At:       edit.CreatedAt,
+				Type:     EventEditAsked,
+				Summary:  fmt.Sprintf("edit of the exported response requested: %s, %s", changedFields(edit.Changes), edit.Status),
+				Source:   "visit_response_edits",
+				SourceID: edit.ID,
+			}
+			if edit.Status == models.ResponseEditRejected && edit.RejectedReason != "" {
+				e.Summary += " (" + edit.RejectedReason + ")"
+			}
+			names.actor(&e, edit.RequestedByID, nil)
+			events = append(events, e)
+		}
+
+		var images []models.VisitResponseImage
+		initializers.DB.Where("visit_response_id = ?", response.ID).Find(&images)
+		for _, img := range images {
+			events = append(events, TimelineEvent{
+				At:       img.CreatedAt,
+				Type:     EventImage,
+				Summary:  "image uploaded: " + img.OriginalName,
+				Source:   "visit_response_images",
+				SourceID: img.ID,
+			})
+		}
+	}
+
+	var cancellations []models.VisitCancellation
+	initializers.DB.Preload("ReasonCode", func(db *gorm.DB) *gorm.DB { return db.Unscoped() }).
+		Where("visit_id = ?", visitID).Find(&cancellations)
+	for _, cancellation := range cancellations {
+		e := TimelineEvent{
+			At:       cancellation.CreatedAt,
+			Type:     EventCancelled,
+			Summary:  "visit cancelled: " + cancellation.ReasonCode.Text,
+			To:       cancellation.ReasonCode.Text,
+			Source:   "visit_cancellations",
+			SourceID: cancellation.ID,
+		}
+		if cancellation.Kind == models.ReasonPostpone {
+			e.Type = EventPostponed
+			e.Summary = "visit postponed: " + cancellation.ReasonCode.Text
+		}
+		if cancellation.Note != "" {
+			e.Summary += " (" + cancellation.Note + ")"
+		}
+		names.actor(&e, cancellation.CreatedByID, nil)
+		events = append(events, e)
+	}
+
+	var followUps []models.Visit
+	initializers.DB.Unscoped().Where("parent_visit_id = ?", visitID).Find(&followUps)
+	for _, f := range followUps {
+		events = append(events, TimelineEvent{
+			At:       f.CreatedAt,
+			Type:     EventFollowUp,
+			Summary:  fmt.Sprintf("follow-up visit %d created", f.ID),
+			Source:   "visits",
+			SourceID: f.ID,
+		})
+	}
+
+	sort.SliceStable(events, func(i, j int) bool { return events[i].At.Before(events[j].At) })
+	return events, nil
+}
+
+// changedFields lists the fields of the changes of a response version or edit
+func changedFields(changesJSON []byte) string {
+	var changes []FieldChange
+	json.Unmarshal(changesJSON, &changes)
+	fields := make([]string, len(changes))
+	for i, change := range changes {
+		fields[i] = change.Field
+	}
+	return strings.Join(fields, ", ")
+}
+
+func parseID(s string) uint {
+	id, _ := strconv.ParseUint(s, 10, 64)
+	return uint(id)
+}
+
+func groupName(s string) string {
+	if s == "" || s == "0" || s == "NULL" {
+		return "no group"
+	}
+	return "group " + s
+}
+
+func dateName(s string) string {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		if t.IsZero() {
+			return "no date"
+		}
+		return t.Format("2006-01-02")
+	}
+	return s
+}
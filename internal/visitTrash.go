@@ -0,0 +1,208 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"time"
+
+	"github.com/markuskjeldsen/mop-backend-api/initializers"
+	"github.com/markuskjeldsen/mop-backend-api/models"
+	"gorm.io/gorm"
+)
+
+// VisitTrashRetention is how long a deleted visit can be restored before it may be purged.
+const VisitTrashRetention = 30 * 24 * time.Hour
+
+var ErrVisitNotDeleted = errors.New("the visit is not deleted")
+
+// DeleteVisit soft deletes the visit, the log keeps a copy with the debitors so it can be restored.
+func DeleteVisit(actingUser models.User, visitID uint) error {
+	var visit models.Visit
+	if err := initializers.DB.Preload("Debitors").First(&visit, visitID).Error; err != nil {
+		return err
+	}
+	if err := initializers.DB.Delete(&visit).Error; err != nil {
+		return err
+	}
+	return LogVisitDelete(actingUser, visit)
+}
+
+// TrashedVisit is a deleted visit with who deleted it and when it can be purged.
+type TrashedVisit struct {
+	models.Visit
+	DeletedByID *uint     `json:"deleted_by_id"`
+	DeletedBy   string    `json:"deleted_by"`
+	PurgeAfter  time.Time `json:"purge_after"`
+}
+
+// deleteLog returns the newest log of the visit being deleted, ok is false for visits deleted without one
+func deleteLog(db *gorm.DB, visitID uint) (models.ActivityLog, bool) {
+	var activity models.ActivityLog
+	err := db.Where("target_id = ? AND action_type = ?", visitID, "DELETE VISIT").Order("id DESC").First(&activity).Error
+	return activity, err == nil
+}
+
+// TrashedVisits lists the deleted visits, the most recently deleted first.
+func TrashedVisits() ([]TrashedVisit, error) {
+	var visits []models.Visit
+	err := initializers.DB.Unscoped().
+		Preload("Debitors").Preload("Status").Preload("Type").Preload("User").
+		Where("deleted_at IS NOT NULL").
+		Order("deleted_at DESC").
+		Find(&visits).Error
+	if err != nil {
+		return nil, err
+	}
+
+	names := &timelineNames{users: map[uint]string{}, statuses: map[uint]string{}, apiKeys: map[uint]string{}}
+	trash := make([]TrashedVisit, 0, len(visits))
+	for _, v := range visits {
+		t := TrashedVisit{Visit: v, PurgeAfter: v.DeletedAt.Time.Add(VisitTrashRetention)}
+		if activity, ok := deleteLog(initializers.DB, v.ID); ok {
+			t.DeletedByID, t.DeletedBy = names.who(activity.ActingUserID, activity.APIKeyID)
+		}
+		trash = append(trash, t)
+	}
+	return trash, nil
+}
+
+// RestoreVisit brings a deleted visit back with the debitors it had when it was deleted.
+// The status is left as it is, a deleted visit cannot change status so it is the one it was deleted with.
+func RestoreVisit(actingUser models.User, visitID uint) (models.Visit, error) {
+	var visit models.Visit
+	err := initializers.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Preload("Debitors").First(&visit, visitID).Error; err != nil {
+			return err
+		}
+		if !visit.DeletedAt.Valid {
+			return ErrVisitNotDeleted
+		}
+		if err := tx.Unscoped().Model(&visit).Update("deleted_at", nil).Error; err != nil {
+			return err
+		}
+
+		activity, ok := deleteLog(tx, visit.ID)
+		if !ok {
+			return nil
+		}
+		var snapshot models.Visit
+		if err := json.Unmarshal(activity.PrevVal, &snapshot); err != nil {
+			return nil // an old log without a copy of the visit, it comes back as it is
+		}
+
+		linked := map[uint]bool{}
+		for _, d := range visit.Debitors {
+			linked[d.ID] = true
+		}
+		for _, d := range snapshot.Debitors {
+			if linked[d.ID] {
+				continue
+			}
+			var debitor models.Debitor
+			if tx.First(&debitor, d.ID).Error != nil {
+				continue // the debitor is gone as well
+			}
+			if err := tx.Model(&visit).Association("Debitors").Append(&debitor); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return visit, err
+	}
+
+	initializers.DB.Preload("Debitors").Preload("Status").First(&visit, visitID)
+	logVisitAction(actingUser, visit, "RESTORE VISIT")
+	return visit, nil
+}
+
+func logVisitAction(actingUser models.User, visit models.Visit, action string) {
+	currJSON, _ := json.Marshal(visit)
+	initializers.DB.Create(&models.ActivityLog{
+		ActingUserID:   actingUser.ID,
+		APIKeyID:       actingUser.APIKeyID,
+		ImpersonatorID: actingUser.ImpersonatorID,
+		TargetID:       visit.ID,
+		TargetIDType:   "visit",
+		ActionType:     action,
+		CurrentVal:     currJSON,
+	})
+}
+
+// PurgeResult is what a purge removed for good.
+type PurgeResult struct {
+	VisitIDs []uint `json:"visit_ids"`
+	Images   int    `json:"images"`
+}
+
+// PurgeVisits permanently removes the visits deleted before the cutoff, with their responses, images and logs.
+// The activity log is kept so it can still be seen who deleted what.
+func PurgeVisits(actingUser models.User, cutoff time.Time) (PurgeResult, error) {
+	result := PurgeResult{VisitIDs: []uint{}}
+	var imagePaths []string
+
+	err := initializers.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Model(&models.Visit{}).
+			Where("deleted_at IS NOT NULL AND deleted_at < ?", cutoff).
+			Pluck("id", &result.VisitIDs).Error; err != nil {
+			return err
+		}
+		if len(result.VisitIDs) == 0 {
+			return nil
+		}
+		ids := result.VisitIDs
+
+		var responseIDs []uint
+		if err := tx.Unscoped().Model(&models.VisitResponse{}).Where("visit_id IN ?", ids).Pluck("id", &responseIDs).Error; err != nil {
+			return err
+		}
+		if len(responseIDs) > 0 {
+			if err := tx.Unscoped().Model(&models.VisitResponseImage{}).Where("visit_response_id IN ?", responseIDs).Pluck("image_path", &imagePaths).Error; err != nil {
+				return err
+			}
+			if err := tx.Unscoped().Where("visit_response_id IN ?", responseIDs).Delete(&models.VisitResponseImage{}).Error; err != nil {
+				return err
+			}
+		}
+
+		for _, model := range []interface{}{
+			&models.VisitResponse{},
+			&models.VisitStatusLog{},
+			&models.VisitLog{},
+			&models.VisitCancellation{},
+			&models.FollowUpProposal{},
+			&models.VisitResponseVersion{},
+			&models.VisitResponseEdit{},
+			&models.VisitResponseDraft{},
+		} {
+			if err := tx.Unscoped().Where("visit_id IN ?", ids).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Exec("DELETE FROM visit_debitors WHERE visit_id IN ?", ids).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Model(&models.Visit{}).Where("parent_visit_id IN ?", ids).Update("parent_visit_id", nil).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Where("id IN ?", ids).Delete(&models.Visit{}).Error
+	})
+	if err != nil {
+		return PurgeResult{}, err
+	}
+
+	for _, path := range imagePaths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("purge: could not remove %s: %v", path, err)
+			continue
+		}
+		result.Images++
+	}
+	for _, id := range result.VisitIDs {
+		logVisitAction(actingUser, models.Visit{Model: gorm.Model{ID: id}}, "PURGE VISIT")
+	}
+	return result, nil
+}
@@ -0,0 +1,196 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/markuskjeldsen/mop-backend-api/initializers"
+	"github.com/markuskjeldsen/mop-backend-api/models"
+	"gorm.io/gorm"
+)
+
+// ValidateVisitType checks that the rules of a visit type fit together.
+func ValidateVisitType(t models.VisitType) error {
+	if t.Text == "" {
+		return ValidationError{"text is required"}
+	}
+	if t.MinNoticeDays < 0 || t.RevisitMinDays < 0 || t.RevisitMaxDays < 0 || t.ServiceMinutes < 0 {
+		return ValidationError{"days and minutes cannot be negative"}
+	}
+	if t.RevisitMaxDays > 0 && t.RevisitMaxDays < t.RevisitMinDays {
+		return ValidationError{"revisit_max_days cannot be before revisit_min_days"}
+	}
+	if !t.Revisit && (t.RevisitOfAnnounced || t.RevisitMinDays > 0 || t.RevisitMaxDays > 0) {
+		return ValidationError{"the revisit window is only used when revisit is set"}
+	}
+	if t.Unannounced && t.MinNoticeDays > 0 {
+		return ValidationError{"an unannounced visit has no notice period"}
+	}
+	return nil
+}
+
+// FindVisitType returns an active visit type, the error is a ValidationError if there is no such type.
+func FindVisitType(tx *gorm.DB, id uint) (models.VisitType, error) {
+	var t models.VisitType
+	err := tx.Where("active = ?", true).First(&t, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return t, ValidationError{fmt.Sprintf("visit type %d does not exist", id)}
+	}
+	return t, err
+}
+
+// PriorVisit is the visit of a case that a revisit is measured from.
+type PriorVisit struct {
+	VisitID uint      `json:"visit_id"`
+	Date    time.Time `json:"date"` // the day the visit was performed
+}
+
+// lastPerformedVisit finds the newest visit of the sagsnr that has a response, other than excludeID.
+// With announcedOnly visits of unannounced types are skipped.
+func lastPerformedVisit(tx *gorm.DB, sagsnr uint, excludeID uint, announcedOnly bool) (PriorVisit, bool, error) {
+	q := tx.Table("visits").
+		Select("visits.id AS visit_id, visit_responses.act_date AS date").
+		Joins("JOIN visit_responses ON visit_responses.visit_id = visits.id AND visit_responses.deleted_at IS NULL").
+		Joins("LEFT JOIN visit_types ON visit_types.id = visits.type_id").
+		Where("visits.deleted_at IS NULL AND visits.sagsnr = ? AND visits.id != ?", sagsnr, excludeID)
+	if announcedOnly {
+		q = q.Where("COALESCE(visit_types.unannounced, false) = false")
+	}
+
+	var prior []PriorVisit
+	if err := q.Order("visit_responses.act_date DESC").Limit(1).Scan(&prior).Error; err != nil {
+		return PriorVisit{}, false, err
+	}
+	if len(prior) == 0 {
+		return PriorVisit{}, false, nil
+	}
+	return prior[0], true, nil
+}
+
+func dayOf(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// revisitWindow returns the first and last day a revisit of the prior visit may take place, last is zero without a limit
+func revisitWindow(t models.VisitType, prior PriorVisit) (time.Time, time.Time) {
+	first := dayOf(prior.Date).AddDate(0, 0, t.RevisitMinDays)
+	var last time.Time
+	if t.RevisitMaxDays > 0 {
+		last = dayOf(prior.Date).AddDate(0, 0, t.RevisitMaxDays)
+	}
+	return first, last
+}
+
+// CheckRevisit checks that a visit of the type to the case may take place on the date.
+// It does nothing for types that are not revisits. The error is a ValidationError when the rules are broken.
+func CheckRevisit(tx *gorm.DB, t models.VisitType, sagsnr uint, excludeID uint, date time.Time) error {
+	if !t.Revisit {
+		return nil
+	}
+	prior, ok, err := lastPerformedVisit(tx, sagsnr, excludeID, t.RevisitOfAnnounced)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if t.RevisitOfAnnounced {
+			return ValidationError{fmt.Sprintf("%s needs an earlier announced visit of case %d", t.Text, sagsnr)}
+		}
+		return ValidationError{fmt.Sprintf("%s needs an earlier visit of case %d", t.Text, sagsnr)}
+	}
+
+	first, last := revisitWindow(t, prior)
+	day := dayOf(date)
+	if day.Before(first) {
+		return ValidationError{fmt.Sprintf("%s of case %d can take place from %s", t.Text, sagsnr, first.Format("2006-01-02"))}
+	}
+	if !last.IsZero() && day.After(last) {
+		return ValidationError{fmt.Sprintf("%s of case %d had to take place by %s, %d days after visit %d",
+			t.Text, sagsnr, last.Format("2006-01-02"), t.RevisitMaxDays, prior.VisitID)}
+	}
+	return nil
+}
+
+// CheckNotice checks that a visit of the type planned on plannedOn for date gives the debitor enough notice.
+func CheckNotice(t models.VisitType, plannedOn time.Time, date time.Time) error {
+	if t.Unannounced || t.MinNoticeDays == 0 {
+		return nil
+	}
+	earliest := dayOf(plannedOn).AddDate(0, 0, t.MinNoticeDays)
+	if dayOf(date).Before(earliest) {
+		return ValidationError{fmt.Sprintf("%s needs %d days notice, the earliest date is %s",
+			t.Text, t.MinNoticeDays, earliest.Format("2006-01-02"))}
+	}
+	return nil
+}
+
+// CheckVisitDate checks the rules of the type of an existing visit for a new date, planned today.
+func CheckVisitDate(tx *gorm.DB, visit models.Visit, date time.Time) error {
+	if visit.TypeID == 0 {
+		return nil
+	}
+	var t models.VisitType
+	if err := tx.Unscoped().First(&t, visit.TypeID).Error; err != nil {
+		return nil // visits of a removed type keep the date they get
+	}
+	if err := CheckNotice(t, time.Now(), date); err != nil {
+		return fmt.Errorf("visit %d: %w", visit.ID, err)
+	}
+	if err := CheckRevisit(tx, t, visit.Sagsnr, visit.ID, date); err != nil {
+		return fmt.Errorf("visit %d: %w", visit.ID, err)
+	}
+	return nil
+}
+
+// EligibleVisitType is a visit type with whether a case can get a visit of it now.
+type EligibleVisitType struct {
+	models.VisitType
+	Eligible     bool        `json:"eligible"`
+	Reason       string      `json:"reason,omitempty"`
+	PriorVisit   *PriorVisit `json:"prior_visit,omitempty"`   // the visit a revisit is measured from
+	EarliestDate *time.Time  `json:"earliest_date,omitempty"` // the first day the visit can take place
+	LatestDate   *time.Time  `json:"latest_date,omitempty"`   // the last day a revisit can take place
+}
+
+// EligibleVisitTypes lists the active visit types for a case, and which of them can be created on the date.
+func EligibleVisitTypes(sagsnr uint, date time.Time) ([]EligibleVisitType, error) {
+	var types []models.VisitType
+	if err := initializers.DB.Where("active = ?", true).Order("revisit, id").Find(&types).Error; err != nil {
+		return nil, err
+	}
+
+	result := make([]EligibleVisitType, 0, len(types))
+	for _, t := range types {
+		e := EligibleVisitType{VisitType: t, Eligible: true}
+		earliest := dayOf(date)
+		if !t.Unannounced {
+			earliest = earliest.AddDate(0, 0, t.MinNoticeDays)
+		}
+
+		if t.Revisit {
+			prior, ok, err := lastPerformedVisit(initializers.DB, sagsnr, 0, t.RevisitOfAnnounced)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				e.PriorVisit = &prior
+				first, last := revisitWindow(t, prior)
+				if first.After(earliest) {
+					earliest = first
+				}
+				if !last.IsZero() {
+					e.LatestDate = &last
+				}
+			}
+			if err := CheckRevisit(initializers.DB, t, sagsnr, 0, earliest); err != nil {
+				e.Eligible = false
+				e.Reason = err.Error()
+			}
+		}
+		if e.Eligible {
+			e.EarliestDate = &earliest
+		}
+		result = append(result, e)
+	}
+	return result, nil
+}
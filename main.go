@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"log"
 	"os"
 	"time"
 
@@ -11,6 +12,7 @@ import (
 	"github.com/markuskjeldsen/mop-backend-api/initializers"
 	"github.com/markuskjeldsen/mop-backend-api/internal"
 	"github.com/markuskjeldsen/mop-backend-api/middleware"
+	"github.com/markuskjeldsen/mop-backend-api/models"
 )
 
 func init() {
@@ -39,7 +41,24 @@ func start_server() {
 	r := gin.New() // was gin.Default()
 	r.Use(middleware.RequestLogger())
 	r.Use(middleware.CORSMiddleware)
-	r.Use(middleware.GeoIPBlocker("DK", "./static/GeoLite2-Country.mmdb"))
+
+	// the countries, trusted ranges and exempt routes are set with the GEOIP_* environment variables
+	geoPolicy, err := middleware.GeoIPPolicyFromEnv()
+	if err != nil {
+		log.Fatalf("invalid geoip policy: %v", err)
+	}
+	geoBlocker, err := middleware.GeoIPBlocker(geoPolicy)
+	if err != nil {
+		log.Fatalf("failed to start the geoip blocker: %v (set GEOIP_MODE=off to run without it)", err)
+	}
+	r.Use(geoBlocker)
+
+	// how old a password may get per rights is set with PASSWORD_MAX_AGE_DAYS
+	internal.Policy, err = internal.PasswordPolicyFromEnv()
+	if err != nil {
+		log.Fatalf("invalid password policy: %v", err)
+	}
+
 	// Trust your nginx proxy IP(s) or the private networks where your proxies live.
 	// If nginx connects from 127.0.0.1 (same host):
 	if err := r.SetTrustedProxies([]string{
@@ -55,52 +74,135 @@ func start_server() {
 	apiv1 := r.Group("/api/v1") // Grouping routes under /api/v1
 	{
 		apiv1.GET("/health", api.Hello) // just returns "hello from the api"  in JSON
-		apiv1.GET("/verifytoken", middleware.RequireAuthUser, api.Verifytoken)
-
-		apiv1.GET("/users", middleware.RequireAuthOfficeWorker, api.GetUsers)   // gets all the users
-		apiv1.GET("/user", middleware.RequireAuthUser, api.GetUser)             // gets data about acting user and their visits
-		apiv1.GET("/users/:id", middleware.RequireAuthUser, api.GetUserByParam) // get data about specific user
-		apiv1.PATCH("/users/:id", middleware.RequireAuthUser, api.Patch)
-		apiv1.PATCH("/users/:id/password", middleware.RequireAuthUser, api.ChangePassword)
-
-		apiv1.DELETE("/users/:id", middleware.RequireAuthOfficeWorker, api.DeleteUser)
-
-		apiv1.POST("/register", middleware.RequireAuthOfficeWorker, api.CreateUser)
+		apiv1.GET("/verifytoken", middleware.RequireAuth, api.Verifytoken)
+
+		apiv1.GET("/users", middleware.RequirePermission(middleware.PermUsersRead), api.GetUsers) // gets all the users
+		apiv1.GET("/user", middleware.RequireAuth, api.GetUser)                                   // gets data about acting user and their visits
+		apiv1.GET("/users/:id", middleware.RequireAuth, api.GetUserByParam)                       // get data about specific user
+		apiv1.PATCH("/users/:id", middleware.RequireAuth, api.Patch)
+		apiv1.PATCH("/users/:id/password", middleware.RequireAuth, api.ChangePassword)
+		apiv1.GET("/users/:id/sessions", middleware.RequireAuth, api.GetSessions)                 // active sessions of a user
+		apiv1.DELETE("/users/:id/sessions", middleware.RequireAuth, api.RevokeAllSessions)        // log a user out everywhere
+		apiv1.DELETE("/users/:id/sessions/:sessionId", middleware.RequireAuth, api.RevokeSession) // log a single device out
+		apiv1.POST("/users/:id/2fa/setup", middleware.RequireAuth, api.SetupTOTP)
+		apiv1.POST("/users/:id/2fa/enable", middleware.RequireAuth, api.EnableTOTP)
+		apiv1.DELETE("/users/:id/2fa", middleware.RequireAuth, api.DisableTOTP)
+
+		apiv1.DELETE("/users/:id", middleware.RequirePermission(middleware.PermUsersDelete), api.DeleteUser)               // deactivates, the history is kept
+		apiv1.PATCH("/users/:id/status", middleware.RequirePermission(middleware.PermUsersLifecycle), api.SetUserStatus)   // suspend, deactivate or reactivate
+		apiv1.POST("/users/:id/restore", middleware.RequirePermission(middleware.PermUsersLifecycle), api.RestoreUser)     // make a user active again
+		apiv1.GET("/users/:id/handover", middleware.RequirePermission(middleware.PermUsersLifecycle), api.PreviewHandover) // what a handover would move
+		apiv1.GET("/users/:id/profile", middleware.RequireAuth, api.GetKonsulentProfile)                                   // home base, working hours and regions
+		apiv1.PUT("/users/:id/profile", middleware.RequirePermission(middleware.PermUsersProfile), api.SaveKonsulentProfile)
+		apiv1.DELETE("/users/:id/profile", middleware.RequirePermission(middleware.PermUsersProfile), api.DeleteKonsulentProfile)
+		apiv1.GET("/users/:id/absences", middleware.RequireAuth, api.GetAbsences) // vacation, sickness and blocked days, ?from and ?to
+		apiv1.POST("/users/:id/absences", middleware.RequireAuth, api.CreateAbsence)
+		apiv1.PATCH("/users/:id/absences/:absenceId", middleware.RequireAuth, api.UpdateAbsence)
+		apiv1.DELETE("/users/:id/absences/:absenceId", middleware.RequireAuth, api.DeleteAbsence)
+		apiv1.GET("/availability", middleware.RequirePermission(middleware.PermVisitsPlan), api.GetAvailability)     // konsulenter who are free on ?date in ?postnr
+		apiv1.POST("/users/:id/handover", middleware.RequirePermission(middleware.PermUsersLifecycle), api.Handover) // move open visits to another konsulent
+		apiv1.GET("/users/:id/stats", middleware.RequireAuth, api.GetUserStats)                                      // personal statistics and achievements, ?from ?to ?period
+		apiv1.PATCH("/users/:id/leaderboard", middleware.RequireAuth, api.SetLeaderboardOptIn)                       // choose to be shown on the leaderboard
+		apiv1.GET("/leaderboard", middleware.RequireAuth, api.GetLeaderboard)                                        // ?metric=visits, only users who opted in
+		apiv1.GET("/achievements", middleware.RequireAuth, api.GetAchievements)
+		apiv1.POST("/achievements", middleware.RequirePermission(middleware.PermAchievements), api.CreateAchievement)
+		apiv1.PUT("/achievements/:id", middleware.RequirePermission(middleware.PermAchievements), api.UpdateAchievement)
+		apiv1.DELETE("/achievements/:id", middleware.RequirePermission(middleware.PermAchievements), api.DeleteAchievement)         // turns it off, earned badges are kept
+		apiv1.POST("/users/:id/achievements", middleware.RequirePermission(middleware.PermAchievements), api.AwardUserAchievements) // awards what the user has earned, e.g. after a new achievement
+
+		apiv1.POST("/register", middleware.RequirePermission(middleware.PermUsersCreate), api.CreateUser)
 		apiv1.POST("/login", middleware.LoginAttemptLog, api.Login)
-		apiv1.POST("/logout", middleware.RequireAuthUser, api.Logout)
-
-		apiv1.GET("/visit-response/all", middleware.RequireAuthUser, api.Visit_responses)         // get all the responses
-		apiv1.POST("/visit-response/create", middleware.RequireAuthUser, api.CreateVisitResponse) // make a response
-		apiv1.POST("/visit-response/:id/images", middleware.RequireAuthUser, api.UploadVisitImage)
-
-		apiv1.GET("/visits", middleware.RequireAuthUser, api.GetVisits)
+		apiv1.POST("/logout", middleware.RequireAuth, api.Logout)
+		apiv1.POST("/refresh", api.Refresh)                                                                                  // exchanges the refresh token for a new access token
+		apiv1.POST("/login/2fa", api.LoginTOTP)                                                                              // second login step, mfa_token from /login and a code
+		apiv1.POST("/login/2fa/setup", api.LoginTOTPSetup)                                                                   // enrolment for users who must have two factor but do not yet
+		apiv1.POST("/login/2fa/enable", api.LoginTOTPEnable)                                                                 // confirms the enrolment and finishes the login
+		apiv1.GET("/oidc", api.OIDCStatus)                                                                                   // whether single sign-on is configured
+		apiv1.GET("/oidc/login", api.OIDCLogin)                                                                              // redirects to the identity provider
+		apiv1.GET("/oidc/callback", api.OIDCCallback)                                                                        // the identity provider redirects back here
+		apiv1.GET("/password/policy", api.GetPasswordPolicy)                                                                 // the rules a new password must follow
+		apiv1.POST("/password/forgot", middleware.PasswordResetAttemptLog(models.LoginStepResetRequest), api.ForgotPassword) // mails a reset link
+		apiv1.POST("/password/reset", middleware.PasswordResetAttemptLog(models.LoginStepReset), api.ResetPassword)          // sets the password with the token from the mail
+
+		apiv1.GET("/bans", middleware.RequirePermission(middleware.PermSecurityBans), api.GetBans)           // active bans, ?all=true for the history
+		apiv1.POST("/bans", middleware.RequirePermission(middleware.PermSecurityBans), api.CreateBan)        // ban an ip or username by hand
+		apiv1.DELETE("/bans/:id", middleware.RequirePermission(middleware.PermSecurityBans), api.LiftBan)    // lift a ban before it expires
+		apiv1.GET("/allowlist", middleware.RequirePermission(middleware.PermSecurityBans), api.GetAllowlist) // ips and ranges that are never banned
+		apiv1.POST("/allowlist", middleware.RequirePermission(middleware.PermSecurityBans), api.CreateAllowlistEntry)
+		apiv1.DELETE("/allowlist/:id", middleware.RequirePermission(middleware.PermSecurityBans), api.DeleteAllowlistEntry)
+
+		apiv1.POST("/impersonation", middleware.RequirePermission(middleware.PermUsersImpersonate), api.StartImpersonation) // act as another user for support
+		apiv1.GET("/impersonation", middleware.RequireAuth, api.GetImpersonation)
+		apiv1.DELETE("/impersonation", middleware.RequireAuth, api.EndImpersonation)
+
+		apiv1.GET("/apikeys", middleware.RequirePermission(middleware.PermAPIKeys), api.GetAPIKeys)
+		apiv1.POST("/apikeys", middleware.RequirePermission(middleware.PermAPIKeys), api.CreateAPIKey) // keys for integrations, scoped to permissions
+		apiv1.DELETE("/apikeys/:id", middleware.RequirePermission(middleware.PermAPIKeys), api.RevokeAPIKey)
+
+		apiv1.GET("/visit-response/all", middleware.Deprecated("/api/v2/visit-response/all"), middleware.RequireAuth, api.Visit_responses) // get all the responses
+		apiv1.POST("/visit-response/create", middleware.RequireAuth, api.CreateVisitResponse)                                              // make a response
+		apiv1.POST("/visit-response/:id/images", middleware.RequireAuth, api.UploadVisitImage)
+		apiv1.PATCH("/visit-response/:id", middleware.RequireAuth, api.PatchVisitResponse)              // edits are kept as versions, after export they wait for approval
+		apiv1.GET("/visit-response/:id/versions", middleware.RequireAuth, api.GetVisitResponseVersions) // the version history with what changed
+		apiv1.GET("/visit-response/edits", middleware.RequirePermission(middleware.PermVisitsReview), api.GetResponseEdits)
+		apiv1.POST("/visit-response/edits/:id/approve", middleware.RequirePermission(middleware.PermVisitsReview), api.ApproveResponseEdit)
+		apiv1.POST("/visit-response/edits/:id/reject", middleware.RequirePermission(middleware.PermVisitsReview), api.RejectResponseEdit)
+
+		apiv1.GET("/visits", middleware.Deprecated("/api/v2/visits"), middleware.RequireAuth, api.GetVisits)
 		apiv1.GET("/visits/types", api.GetVisitTypes)
-		apiv1.GET("/visits/byId", middleware.RequireAuthUser, api.GetVisitsById)                 //query parameter
-		apiv1.GET("/visits/byStatus", middleware.RequireAuthOfficeWorker, api.GetVisitsByStatus) // query parameter
-		apiv1.GET("/visits/debt", middleware.RequireAuthUser, api.DebtInformation)               // query parameter
-		apiv1.DELETE("/visit/byId", middleware.RequireAuthOfficeWorker, api.DeleteVisit)
-
-		apiv1.GET("/visits/AvailableVisit", middleware.RequireAuthOfficeWorker, api.AvailableVisitCreation) // gets visits that can be created
-		apiv1.POST("/visits/create", middleware.RequireAuthOfficeWorker, api.VisitCreation)                 // creates thoses visits
-		apiv1.GET("/visits/create", middleware.RequireAuthOfficeWorker, api.CreatedVisits)                  // retrives the created visits that have not yet been planned
-
-		apiv1.PATCH("/visits/:id/group", middleware.RequireAuthOfficeWorker, api.ChangeGroupId)                  // move a singe visit to a new groupId
-		apiv1.PATCH("/visits/group/:groupId/date", middleware.RequireAuthOfficeWorker, api.ChangeGroupDate)      // change the date of all visits with a groupID
-		apiv1.GET("/visits/group/:groupId", middleware.RequireAuthOfficeWorker, api.GetInGroup)                  // get all the visits in a group
-		apiv1.DELETE("/visits/group/:groupId", middleware.RequireAuthOfficeWorker, api.RemoveFromGroup)          // removes the visits from a group. sets GroupID = 0 for all visits in that group
-		apiv1.PATCH("/visits/group/:groupId/konsulent", middleware.RequireAuthOfficeWorker, api.ChangeKonsulent) // Change the konsulent/user, so a different one is going to perform the visits
-		apiv1.GET("/visits/group/:groupId/planned", middleware.RequireAuthOfficeWorker, api.PlannedVisitsExcel)  // gets the excel sheet for the inkasso afdeling enabeling easier workflow
-
-		apiv1.POST("/visits/visitfile", middleware.RequireAuthOfficeWorker, api.VisitFile)     // generates a visit excel file so the visits can be planned without making another visit
-		apiv1.POST("/visits/plan", middleware.RequireAuthOfficeWorker, api.PlanVisit)          // here visits are planned
-		apiv1.GET("/visits/planned", middleware.RequireAuthOfficeWorker, api.PlannedVisits)    // here are the planned visits
-		apiv1.PATCH("/visits/planned/:id", middleware.RequireAuthOfficeWorker, api.PatchVisit) // here are the planned visits
+		apiv1.GET("/visits/types/eligible", middleware.RequirePermission(middleware.PermVisitsCreate), api.GetEligibleVisitTypes) // which types ?sagsnr can get, e.g. a revisit
+		apiv1.POST("/visits/types", middleware.RequirePermission(middleware.PermVisitTypes), api.CreateVisitType)
+		apiv1.PUT("/visits/types/:id", middleware.RequirePermission(middleware.PermVisitTypes), api.UpdateVisitType)
+		apiv1.DELETE("/visits/types/:id", middleware.RequirePermission(middleware.PermVisitTypes), api.DeleteVisitType) // turns it off, visits keep their type
+		apiv1.GET("/visits/statuses/transitions", middleware.RequireAuth, api.GetVisitTransitions)                      // which status a visit can go to from which
+		apiv1.PATCH("/visits/:id/status", middleware.RequireAuth, api.ChangeVisitStatus)                                // the graph decides who may make the change
+		apiv1.GET("/visits/:id/timeline", middleware.RequireAuth, api.GetVisitTimeline)                                 // the konsulent of the visit or visits:read
+		apiv1.GET("/visits/:id/draft", middleware.RequireAuth, api.GetResponseDraft)                                    // the response the konsulent is filling out
+		apiv1.PUT("/visits/:id/draft", middleware.RequireAuth, api.SaveResponseDraft)                                   // auto-save, only the fields sent are changed
+		apiv1.DELETE("/visits/:id/draft", middleware.RequireAuth, api.DiscardResponseDraft)
+		apiv1.POST("/visits/:id/draft/submit", middleware.RequireAuth, api.SubmitResponseDraft)                        // becomes the response and sends the visit to review
+		apiv1.POST("/visits/:id/cancel", middleware.RequirePermission(middleware.PermVisitsPlan), api.CancelVisit)     // kept with the cancelled status and a reason code
+		apiv1.POST("/visits/:id/postpone", middleware.RequirePermission(middleware.PermVisitsPlan), api.PostponeVisit) // back to planning with a reason code
+		apiv1.GET("/visits/:id/cancellations", middleware.RequirePermission(middleware.PermVisitsRead), api.GetVisitCancellations)
+		apiv1.GET("/visits/cancellations/report", middleware.RequirePermission(middleware.PermVisitsRead), api.GetCancellationReport) // per client and reason, ?kind ?from ?to
+		apiv1.GET("/visits/reasons", middleware.RequireAuth, api.GetReasonCodes)
+		apiv1.POST("/visits/reasons", middleware.RequirePermission(middleware.PermVisitReasons), api.CreateReasonCode)
+		apiv1.PUT("/visits/reasons/:id", middleware.RequirePermission(middleware.PermVisitReasons), api.UpdateReasonCode)
+		apiv1.DELETE("/visits/reasons/:id", middleware.RequirePermission(middleware.PermVisitReasons), api.DeleteReasonCode) // turns it off
+		apiv1.GET("/followups", middleware.RequirePermission(middleware.PermVisitsCreate), api.GetFollowUps)                 // proposed follow-up visits, e.g. when the debitor was not home
+		apiv1.POST("/followups/:id/accept", middleware.RequirePermission(middleware.PermVisitsCreate), api.AcceptFollowUp)   // creates the linked visit
+		apiv1.POST("/followups/:id/dismiss", middleware.RequirePermission(middleware.PermVisitsCreate), api.DismissFollowUp)
+		apiv1.GET("/visits/byId", middleware.RequireAuth, api.GetVisitsById)                                                                                            //query parameter
+		apiv1.GET("/visits/byStatus", middleware.Deprecated("/api/v2/visits/byStatus"), middleware.RequirePermission(middleware.PermVisitsRead), api.GetVisitsByStatus) // query parameter
+		apiv1.GET("/visits/debt", middleware.RequireAuth, api.DebtInformation)                                                                                          // query parameter
+		apiv1.DELETE("/visit/byId", middleware.RequirePermission(middleware.PermVisitsDelete), api.DeleteVisit)
+		apiv1.GET("/visits/search", middleware.RequireAuth, api.SearchVisits)                                    // ranked search over addresses, notes, debitors and comments
+		apiv1.GET("/visits/trash", middleware.RequirePermission(middleware.PermVisitsDelete), api.GetVisitTrash) // deleted visits and who deleted them
+		apiv1.POST("/visits/trash/:id/restore", middleware.RequirePermission(middleware.PermVisitsDelete), api.RestoreVisit)
+		apiv1.DELETE("/visits/trash", middleware.RequirePermission(middleware.PermVisitsPurge), api.PurgeVisitTrash) // ?days, at least the retention period
+
+		apiv1.GET("/visits/AvailableVisit", middleware.RequirePermission(middleware.PermVisitsCreate), api.AvailableVisitCreation) // gets visits that can be created
+		apiv1.POST("/visits/create", middleware.RequirePermission(middleware.PermVisitsCreate), api.VisitCreation)                 // creates thoses visits
+		apiv1.GET("/visits/create", middleware.RequirePermission(middleware.PermVisitsCreate), api.CreatedVisits)                  // retrives the created visits that have not yet been planned
+
+		apiv1.PATCH("/visits/:id/group", middleware.RequirePermission(middleware.PermVisitsPlan), api.ChangeGroupId)                  // move a singe visit to a new groupId
+		apiv1.PATCH("/visits/group/:groupId/date", middleware.RequirePermission(middleware.PermVisitsPlan), api.ChangeGroupDate)      // change the date of all visits with a groupID
+		apiv1.GET("/visits/group/:groupId", middleware.RequirePermission(middleware.PermVisitsPlan), api.GetInGroup)                  // get all the visits in a group
+		apiv1.DELETE("/visits/group/:groupId", middleware.RequirePermission(middleware.PermVisitsPlan), api.RemoveFromGroup)          // removes the visits from a group. sets GroupID = 0 for all visits in that group
+		apiv1.GET("/visits/group/:groupId/check", middleware.RequirePermission(middleware.PermVisitsPlan), api.CheckGroupAssignment)  // warnings if the group is given to ?userId
+		apiv1.PATCH("/visits/group/:groupId/konsulent", middleware.RequirePermission(middleware.PermVisitsPlan), api.ChangeKonsulent) // Change the konsulent/user, so a different one is going to perform the visits
+		apiv1.GET("/visits/group/:groupId/planned", middleware.RequirePermission(middleware.PermVisitsPlan), api.PlannedVisitsExcel)  // gets the excel sheet for the inkasso afdeling enabeling easier workflow
+
+		apiv1.POST("/visits/visitfile", middleware.RequirePermission(middleware.PermVisitsPlan), api.VisitFile)                                                   // generates a visit excel file so the visits can be planned without making another visit
+		apiv1.POST("/visits/plan", middleware.RequirePermission(middleware.PermVisitsPlan), api.PlanVisit)                                                        // here visits are planned
+		apiv1.GET("/visits/planned", middleware.Deprecated("/api/v2/visits/planned"), middleware.RequirePermission(middleware.PermVisitsPlan), api.PlannedVisits) // here are the planned visits
+		apiv1.PATCH("/visits/planned/:id", middleware.RequirePermission(middleware.PermVisitsPlan), api.PatchVisit)                                               // here are the planned visits
 
 		//send the letters
-		apiv1.POST("/visit/letterSent", middleware.RequireAuthOfficeWorker, api.VisitLetterSent) // remember GetQuery("id")
+		apiv1.POST("/visit/letterSent", middleware.RequirePermission(middleware.PermVisitsLetter), api.VisitLetterSent) // remember GetQuery("id")
 
-		apiv1.GET("/visit/pdf", middleware.RequireAuthOfficeWorker, api.VisitPDF)
-		apiv1.POST("visit/reviewed", middleware.RequireAuthOfficeWorker, api.ReviewedVisit)
+		apiv1.GET("/visit/pdf", middleware.RequirePermission(middleware.PermVisitsReview), api.VisitPDF)
+		apiv1.POST("visit/reviewed", middleware.RequirePermission(middleware.PermVisitsReview), api.ReviewedVisit)
 
 		// penneo integration
 
@@ -135,46 +237,128 @@ func start_server() {
 	apiv2 := r.Group("/api/v2") // Grouping routes under /api/v1
 	{
 		apiv2.GET("/health", api.Hello) // Adding a route to the group
-		apiv2.GET("/verifytoken", middleware.RequireAuthUser, api.Verifytoken)
-
-		apiv2.GET("/users", middleware.RequireAuthOfficeWorker, api.GetUsers)   // Adding a route to the group
-		apiv2.GET("/user", middleware.RequireAuthUser, api.GetUser)             // Adding a route to the group
-		apiv2.GET("/users/:id", middleware.RequireAuthUser, api.GetUserByParam) // Adding a route to the group
-		apiv2.PATCH("/users/:id", middleware.RequireAuthUser, api.Patch)
-		apiv2.PATCH("/users/:id/password", middleware.RequireAuthUser, api.ChangePassword)
-
-		apiv2.DELETE("/users/:id", middleware.RequireAuthOfficeWorker, api.DeleteUser)
-
-		apiv2.POST("/register", middleware.RequireAuthOfficeWorker, api.CreateUser)
+		apiv2.GET("/verifytoken", middleware.RequireAuth, api.Verifytoken)
+
+		apiv2.GET("/users", middleware.RequirePermission(middleware.PermUsersRead), api.GetUsers) // Adding a route to the group
+		apiv2.GET("/user", middleware.RequireAuth, api.GetUser)                                   // Adding a route to the group
+		apiv2.GET("/users/:id", middleware.RequireAuth, api.GetUserByParam)                       // Adding a route to the group
+		apiv2.PATCH("/users/:id", middleware.RequireAuth, api.Patch)
+		apiv2.PATCH("/users/:id/password", middleware.RequireAuth, api.ChangePassword)
+		apiv2.GET("/users/:id/sessions", middleware.RequireAuth, api.GetSessions)                 // active sessions of a user
+		apiv2.DELETE("/users/:id/sessions", middleware.RequireAuth, api.RevokeAllSessions)        // log a user out everywhere
+		apiv2.DELETE("/users/:id/sessions/:sessionId", middleware.RequireAuth, api.RevokeSession) // log a single device out
+		apiv2.POST("/users/:id/2fa/setup", middleware.RequireAuth, api.SetupTOTP)
+		apiv2.POST("/users/:id/2fa/enable", middleware.RequireAuth, api.EnableTOTP)
+		apiv2.DELETE("/users/:id/2fa", middleware.RequireAuth, api.DisableTOTP)
+
+		apiv2.DELETE("/users/:id", middleware.RequirePermission(middleware.PermUsersDelete), api.DeleteUser)               // deactivates, the history is kept
+		apiv2.PATCH("/users/:id/status", middleware.RequirePermission(middleware.PermUsersLifecycle), api.SetUserStatus)   // suspend, deactivate or reactivate
+		apiv2.POST("/users/:id/restore", middleware.RequirePermission(middleware.PermUsersLifecycle), api.RestoreUser)     // make a user active again
+		apiv2.GET("/users/:id/handover", middleware.RequirePermission(middleware.PermUsersLifecycle), api.PreviewHandover) // what a handover would move
+		apiv2.GET("/users/:id/profile", middleware.RequireAuth, api.GetKonsulentProfile)                                   // home base, working hours and regions
+		apiv2.PUT("/users/:id/profile", middleware.RequirePermission(middleware.PermUsersProfile), api.SaveKonsulentProfile)
+		apiv2.DELETE("/users/:id/profile", middleware.RequirePermission(middleware.PermUsersProfile), api.DeleteKonsulentProfile)
+		apiv2.GET("/users/:id/absences", middleware.RequireAuth, api.GetAbsences) // vacation, sickness and blocked days, ?from and ?to
+		apiv2.POST("/users/:id/absences", middleware.RequireAuth, api.CreateAbsence)
+		apiv2.PATCH("/users/:id/absences/:absenceId", middleware.RequireAuth, api.UpdateAbsence)
+		apiv2.DELETE("/users/:id/absences/:absenceId", middleware.RequireAuth, api.DeleteAbsence)
+		apiv2.GET("/availability", middleware.RequirePermission(middleware.PermVisitsPlan), api.GetAvailability)     // konsulenter who are free on ?date in ?postnr
+		apiv2.POST("/users/:id/handover", middleware.RequirePermission(middleware.PermUsersLifecycle), api.Handover) // move open visits to another konsulent
+		apiv2.GET("/users/:id/stats", middleware.RequireAuth, api.GetUserStats)                                      // personal statistics and achievements, ?from ?to ?period
+		apiv2.PATCH("/users/:id/leaderboard", middleware.RequireAuth, api.SetLeaderboardOptIn)                       // choose to be shown on the leaderboard
+		apiv2.GET("/leaderboard", middleware.RequireAuth, api.GetLeaderboard)                                        // ?metric=visits, only users who opted in
+		apiv2.GET("/achievements", middleware.RequireAuth, api.GetAchievements)
+		apiv2.POST("/achievements", middleware.RequirePermission(middleware.PermAchievements), api.CreateAchievement)
+		apiv2.PUT("/achievements/:id", middleware.RequirePermission(middleware.PermAchievements), api.UpdateAchievement)
+		apiv2.DELETE("/achievements/:id", middleware.RequirePermission(middleware.PermAchievements), api.DeleteAchievement)         // turns it off, earned badges are kept
+		apiv2.POST("/users/:id/achievements", middleware.RequirePermission(middleware.PermAchievements), api.AwardUserAchievements) // awards what the user has earned, e.g. after a new achievement
+
+		apiv2.POST("/register", middleware.RequirePermission(middleware.PermUsersCreate), api.CreateUser)
 		apiv2.POST("/login", middleware.LoginAttemptLog, api.Login)
-		apiv2.POST("/logout", middleware.RequireAuthUser, api.Logout)
-
-		apiv2.GET("/visit-response/all", middleware.RequireAuthUser, api.Visit_responses)         // get all the responses
-		apiv2.POST("/visit-response/create", middleware.RequireAuthUser, api.CreateVisitResponse) // make a response
-		apiv2.POST("/visit-response/:id/images", middleware.RequireAuthUser, api.UploadVisitImage)
-
-		apiv2.GET("/visits", middleware.RequireAuthUser, api2.GetVisits)
+		apiv2.POST("/logout", middleware.RequireAuth, api.Logout)
+		apiv2.POST("/refresh", api.Refresh)                                                                                  // exchanges the refresh token for a new access token
+		apiv2.POST("/login/2fa", api.LoginTOTP)                                                                              // second login step, mfa_token from /login and a code
+		apiv2.POST("/login/2fa/setup", api.LoginTOTPSetup)                                                                   // enrolment for users who must have two factor but do not yet
+		apiv2.POST("/login/2fa/enable", api.LoginTOTPEnable)                                                                 // confirms the enrolment and finishes the login
+		apiv2.GET("/oidc", api.OIDCStatus)                                                                                   // whether single sign-on is configured
+		apiv2.GET("/oidc/login", api.OIDCLogin)                                                                              // redirects to the identity provider
+		apiv2.GET("/oidc/callback", api.OIDCCallback)                                                                        // the identity provider redirects back here
+		apiv2.GET("/password/policy", api.GetPasswordPolicy)                                                                 // the rules a new password must follow
+		apiv2.POST("/password/forgot", middleware.PasswordResetAttemptLog(models.LoginStepResetRequest), api.ForgotPassword) // mails a reset link
+		apiv2.POST("/password/reset", middleware.PasswordResetAttemptLog(models.LoginStepReset), api.ResetPassword)          // sets the password with the token from the mail
+
+		apiv2.GET("/bans", middleware.RequirePermission(middleware.PermSecurityBans), api.GetBans)           // active bans, ?all=true for the history
+		apiv2.POST("/bans", middleware.RequirePermission(middleware.PermSecurityBans), api.CreateBan)        // ban an ip or username by hand
+		apiv2.DELETE("/bans/:id", middleware.RequirePermission(middleware.PermSecurityBans), api.LiftBan)    // lift a ban before it expires
+		apiv2.GET("/allowlist", middleware.RequirePermission(middleware.PermSecurityBans), api.GetAllowlist) // ips and ranges that are never banned
+		apiv2.POST("/allowlist", middleware.RequirePermission(middleware.PermSecurityBans), api.CreateAllowlistEntry)
+		apiv2.DELETE("/allowlist/:id", middleware.RequirePermission(middleware.PermSecurityBans), api.DeleteAllowlistEntry)
+
+		apiv2.POST("/impersonation", middleware.RequirePermission(middleware.PermUsersImpersonate), api.StartImpersonation) // act as another user for support
+		apiv2.GET("/impersonation", middleware.RequireAuth, api.GetImpersonation)
+		apiv2.DELETE("/impersonation", middleware.RequireAuth, api.EndImpersonation)
+
+		apiv2.GET("/apikeys", middleware.RequirePermission(middleware.PermAPIKeys), api.GetAPIKeys)
+		apiv2.POST("/apikeys", middleware.RequirePermission(middleware.PermAPIKeys), api.CreateAPIKey) // keys for integrations, scoped to permissions
+		apiv2.DELETE("/apikeys/:id", middleware.RequirePermission(middleware.PermAPIKeys), api.RevokeAPIKey)
+
+		apiv2.GET("/visit-response/all", middleware.RequireAuth, api2.GetVisitResponses)      // get all the responses
+		apiv2.POST("/visit-response/create", middleware.RequireAuth, api.CreateVisitResponse) // make a response
+		apiv2.POST("/visit-response/:id/images", middleware.RequireAuth, api.UploadVisitImage)
+		apiv2.PATCH("/visit-response/:id", middleware.RequireAuth, api.PatchVisitResponse)              // edits are kept as versions, after export they wait for approval
+		apiv2.GET("/visit-response/:id/versions", middleware.RequireAuth, api.GetVisitResponseVersions) // the version history with what changed
+		apiv2.GET("/visit-response/edits", middleware.RequirePermission(middleware.PermVisitsReview), api.GetResponseEdits)
+		apiv2.POST("/visit-response/edits/:id/approve", middleware.RequirePermission(middleware.PermVisitsReview), api.ApproveResponseEdit)
+		apiv2.POST("/visit-response/edits/:id/reject", middleware.RequirePermission(middleware.PermVisitsReview), api.RejectResponseEdit)
+
+		apiv2.GET("/visits", middleware.RequireAuth, api2.GetVisits)
 
 		apiv2.GET("/visits/types", api.GetVisitTypes)
-		apiv2.GET("/visits/byId", middleware.RequireAuthUser, api.GetVisitsById)                 //query parameter
-		apiv2.GET("/visits/byStatus", middleware.RequireAuthOfficeWorker, api.GetVisitsByStatus) // query parameter
-		apiv2.GET("/visits/debt", middleware.RequireAuthUser, api.DebtInformation)               // query parameter
-		apiv2.DELETE("/visit/byId", middleware.RequireAuthOfficeWorker, api.DeleteVisit)
-
-		apiv2.GET("/visits/AvailableVisit", middleware.RequireAuthOfficeWorker, api.AvailableVisitCreation) // gets visits that can be created
-		apiv2.POST("/visits/create", middleware.RequireAuthOfficeWorker, api.VisitCreation)                 // creates thoses visits
-		apiv2.GET("/visits/create", middleware.RequireAuthOfficeWorker, api.CreatedVisits)                  // retrives the created visits that have not yet been planned
-
-		apiv2.POST("/visits/visitfile", middleware.RequireAuthOfficeWorker, api.VisitFile)     // generates a visit excel file so the visits can be planned without making another visit
-		apiv2.POST("/visits/plan", middleware.RequireAuthOfficeWorker, api.PlanVisit)          // here visits are planned
-		apiv2.GET("/visits/planned", middleware.RequireAuthOfficeWorker, api.PlannedVisits)    // here are the planned visits
-		apiv2.PATCH("/visits/planned/:id", middleware.RequireAuthOfficeWorker, api.PatchVisit) // here are the planned visits
+		apiv2.GET("/visits/types/eligible", middleware.RequirePermission(middleware.PermVisitsCreate), api.GetEligibleVisitTypes) // which types ?sagsnr can get, e.g. a revisit
+		apiv2.POST("/visits/types", middleware.RequirePermission(middleware.PermVisitTypes), api.CreateVisitType)
+		apiv2.PUT("/visits/types/:id", middleware.RequirePermission(middleware.PermVisitTypes), api.UpdateVisitType)
+		apiv2.DELETE("/visits/types/:id", middleware.RequirePermission(middleware.PermVisitTypes), api.DeleteVisitType) // turns it off, visits keep their type
+		apiv2.GET("/visits/statuses/transitions", middleware.RequireAuth, api.GetVisitTransitions)                      // which status a visit can go to from which
+		apiv2.PATCH("/visits/:id/status", middleware.RequireAuth, api.ChangeVisitStatus)                                // the graph decides who may make the change
+		apiv2.GET("/visits/:id/timeline", middleware.RequireAuth, api.GetVisitTimeline)                                 // the konsulent of the visit or visits:read
+		apiv2.GET("/visits/:id/draft", middleware.RequireAuth, api.GetResponseDraft)                                    // the response the konsulent is filling out
+		apiv2.PUT("/visits/:id/draft", middleware.RequireAuth, api.SaveResponseDraft)                                   // auto-save, only the fields sent are changed
+		apiv2.DELETE("/visits/:id/draft", middleware.RequireAuth, api.DiscardResponseDraft)
+		apiv2.POST("/visits/:id/draft/submit", middleware.RequireAuth, api.SubmitResponseDraft)                        // becomes the response and sends the visit to review
+		apiv2.POST("/visits/:id/cancel", middleware.RequirePermission(middleware.PermVisitsPlan), api.CancelVisit)     // kept with the cancelled status and a reason code
+		apiv2.POST("/visits/:id/postpone", middleware.RequirePermission(middleware.PermVisitsPlan), api.PostponeVisit) // back to planning with a reason code
+		apiv2.GET("/visits/:id/cancellations", middleware.RequirePermission(middleware.PermVisitsRead), api.GetVisitCancellations)
+		apiv2.GET("/visits/cancellations/report", middleware.RequirePermission(middleware.PermVisitsRead), api.GetCancellationReport) // per client and reason, ?kind ?from ?to
+		apiv2.GET("/visits/reasons", middleware.RequireAuth, api.GetReasonCodes)
+		apiv2.POST("/visits/reasons", middleware.RequirePermission(middleware.PermVisitReasons), api.CreateReasonCode)
+		apiv2.PUT("/visits/reasons/:id", middleware.RequirePermission(middleware.PermVisitReasons), api.UpdateReasonCode)
+		apiv2.DELETE("/visits/reasons/:id", middleware.RequirePermission(middleware.PermVisitReasons), api.DeleteReasonCode) // turns it off
+		apiv2.GET("/followups", middleware.RequirePermission(middleware.PermVisitsCreate), api.GetFollowUps)                 // proposed follow-up visits, e.g. when the debitor was not home
+		apiv2.POST("/followups/:id/accept", middleware.RequirePermission(middleware.PermVisitsCreate), api.AcceptFollowUp)   // creates the linked visit
+		apiv2.POST("/followups/:id/dismiss", middleware.RequirePermission(middleware.PermVisitsCreate), api.DismissFollowUp)
+		apiv2.GET("/visits/byId", middleware.RequireAuth, api.GetVisitsById)                                           //query parameter
+		apiv2.GET("/visits/byStatus", middleware.RequirePermission(middleware.PermVisitsRead), api2.GetVisitsByStatus) // query parameter
+		apiv2.GET("/visits/debt", middleware.RequireAuth, api.DebtInformation)                                         // query parameter
+		apiv2.DELETE("/visit/byId", middleware.RequirePermission(middleware.PermVisitsDelete), api.DeleteVisit)
+		apiv2.GET("/visits/search", middleware.RequireAuth, api.SearchVisits)                                    // ranked search over addresses, notes, debitors and comments
+		apiv2.GET("/visits/trash", middleware.RequirePermission(middleware.PermVisitsDelete), api.GetVisitTrash) // deleted visits and who deleted them
+		apiv2.POST("/visits/trash/:id/restore", middleware.RequirePermission(middleware.PermVisitsDelete), api.RestoreVisit)
+		apiv2.DELETE("/visits/trash", middleware.RequirePermission(middleware.PermVisitsPurge), api.PurgeVisitTrash) // ?days, at least the retention period
+
+		apiv2.GET("/visits/AvailableVisit", middleware.RequirePermission(middleware.PermVisitsCreate), api.AvailableVisitCreation) // gets visits that can be created
+		apiv2.POST("/visits/create", middleware.RequirePermission(middleware.PermVisitsCreate), api.VisitCreation)                 // creates thoses visits
+		apiv2.GET("/visits/create", middleware.RequirePermission(middleware.PermVisitsCreate), api.CreatedVisits)                  // retrives the created visits that have not yet been planned
+
+		apiv2.POST("/visits/visitfile", middleware.RequirePermission(middleware.PermVisitsPlan), api.VisitFile)      // generates a visit excel file so the visits can be planned without making another visit
+		apiv2.POST("/visits/plan", middleware.RequirePermission(middleware.PermVisitsPlan), api.PlanVisit)           // here visits are planned
+		apiv2.GET("/visits/planned", middleware.RequirePermission(middleware.PermVisitsPlan), api2.GetPlannedVisits) // here are the planned visits
+		apiv2.PATCH("/visits/planned/:id", middleware.RequirePermission(middleware.PermVisitsPlan), api.PatchVisit)  // here are the planned visits
 
 		//send the letters
-		apiv2.POST("/visit/letterSent", middleware.RequireAuthOfficeWorker, api.VisitLetterSent) // remember GetQuery("id")
+		apiv2.POST("/visit/letterSent", middleware.RequirePermission(middleware.PermVisitsLetter), api.VisitLetterSent) // remember GetQuery("id")
 
-		apiv2.GET("/visit/pdf", middleware.RequireAuthOfficeWorker, api.VisitPDF)
-		apiv2.POST("visit/reviewed", middleware.RequireAuthOfficeWorker, api.ReviewedVisit)
+		apiv2.GET("/visit/pdf", middleware.RequirePermission(middleware.PermVisitsReview), api.VisitPDF)
+		apiv2.POST("visit/reviewed", middleware.RequirePermission(middleware.PermVisitsReview), api.ReviewedVisit)
 	}
 
 	// the desktop frontend
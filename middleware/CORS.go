@@ -10,9 +10,10 @@ func CORSMiddleware(c *gin.Context) {
 	// Set CORS headers
 
 	c.Writer.Header().Set("Access-Control-Allow-Origin", os.Getenv("ALLOW_ORIGIN")) // Change to specific origin if needed
-	c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PATCH, DELETE, OPTIONS")
-	c.Writer.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Authorization")
+	c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+	c.Writer.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Authorization, "+CSRFHeaderName+", "+APIKeyHeaderName)
 	c.Writer.Header().Set("Access-Control-Allow-Credentials", "true") // delete if not needed
+	c.Writer.Header().Set("Access-Control-Expose-Headers", "Deprecation, Link")
 
 	if c.Request.Method == "OPTIONS" {
 		c.AbortWithStatus(204)
@@ -3,244 +3,244 @@ package middleware
 import (
 	"fmt"
 	"net/http"
-	"os"
-	"time"
+	"slices"
+	"strings"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v4"
 	"github.com/markuskjeldsen/mop-backend-api/initializers"
+	"github.com/markuskjeldsen/mop-backend-api/internal"
 	"github.com/markuskjeldsen/mop-backend-api/models"
 )
 
-func RequireAuthUser(c *gin.Context) {
-	//fmt.Println("auth middleware")
+// APIKeyHeaderName is the header integrations send their api key in, "Authorization: Bearer mop_..." works as well
+const APIKeyHeaderName = "X-API-Key"
 
-	// get cookie
-	tokenString, err := c.Cookie("Authorization")
+const (
+	authSourceBearer = "bearer"
+	authSourceCookie = "cookie"
+)
+
+// tokenFromRequest finds the access token and where it came from, ok is false if none was sent.
+// The credentials can be sent in three ways, they are checked in this order:
+//  1. an api key in the X-API-Key header or as "Authorization: Bearer mop_...", used by integrations, see apiKeyFromRequest
+//  2. the Authorization header as "Bearer <jwt>", used by the PWA and scripts
+//  3. the Authorization cookie set by Login, used by the desktop frontend
+//
+// A request that sends the header is never authenticated by the cookie, even if the header is invalid.
+func tokenFromRequest(c *gin.Context) (token string, source string, ok bool) {
+	if header := c.GetHeader("Authorization"); header != "" {
+		scheme, token, found := strings.Cut(header, " ")
+		if !found || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+			return "", authSourceBearer, false
+		}
+		return strings.TrimSpace(token), authSourceBearer, true
+	}
+
+	token, err := c.Cookie("Authorization")
+	if err != nil || token == "" {
+		return "", authSourceCookie, false
+	}
+	return token, authSourceCookie, true
+}
+
+// apiKeyFromRequest finds an api key in the X-API-Key header, or in the Authorization header in place of a jwt
+func apiKeyFromRequest(c *gin.Context) (string, bool) {
+	if key := c.GetHeader(APIKeyHeaderName); key != "" {
+		return key, true
+	}
+	scheme, token, found := strings.Cut(c.GetHeader("Authorization"), " ")
+	if found && strings.EqualFold(scheme, "Bearer") && internal.IsAPIKey(strings.TrimSpace(token)) {
+		return strings.TrimSpace(token), true
+	}
+	return "", false
+}
+
+// authenticate validates the access token and checks that its session is still active.
+// The user and session are attached to the request as "user" and "sessionID".
+// On failure the request is aborted and false is returned.
+func authenticate(c *gin.Context) (models.User, bool) {
+	if _, isKey := apiKeyFromRequest(c); isKey {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "api keys can only be used on endpoints that require a permission"})
+		return models.User{}, false
+	}
 
-	if err != nil || tokenString == "" {
+	tokenString, source, ok := tokenFromRequest(c)
+	if !ok && source == authSourceBearer {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+			"error": "Authorization header must be of the form: Bearer <token>",
+		})
+		return models.User{}, false
+	}
+	if !ok {
 		fmt.Println("There is no token")
 		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
 			"error": "No token provided",
 		})
-		return
+		return models.User{}, false
+	}
+
+	// the browser sends cookies on cross site requests by itself, so those need the csrf header as well
+	if source == authSourceCookie && !ValidCSRF(c) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Missing or invalid CSRF token"})
+		return models.User{}, false
 	}
 
 	//decode
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		// hmacSampleSecret is a []byte containing your secret, e.g. []byte("my_secret_key")
-		return []byte(os.Getenv("JWT_secret")), nil
-	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	userID, sessionID, err := internal.ParseAccessToken(tokenString)
 	if err != nil {
 		c.AbortWithStatus(http.StatusUnauthorized)
-		return
+		return models.User{}, false
 	}
 
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		// check exp
-		if float64(time.Now().Unix()) > claims["exp"].(float64) {
-			fmt.Println("The token is too old")
-			c.AbortWithStatus(http.StatusUnauthorized)
-			return
-		}
-		//find user with token
-
-		// attach to request
-
-		var user models.User
-		initializers.DB.First(&user, claims["sub"])
-		if user.ID == 0 {
-			fmt.Println("The token does not belong to any user")
-			var attempt models.AuthAttempt
-			attempt.IP = c.ClientIP()
-			attempt.FailureReason = "Token does not belong to any user"
-			initializers.DB.Create(&attempt)
-			c.AbortWithStatus(http.StatusUnauthorized)
-			return
-		}
-
-		c.Set("user", user)
-		c.Next()
-	} else {
-		c.AbortWithStatus(http.StatusUnauthorized)
-		return
+	// a revoked session is rejected even though the token itself has not expired yet
+	if _, err := internal.ActiveSession(sessionID, userID); err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return models.User{}, false
 	}
 
-}
-
-func RequireAuthOfficeWorker(c *gin.Context) {
-	// get cookie
-	tokenString, err := c.Cookie("Authorization")
-	if err != nil {
+	//find user with token
+	var user models.User
+	initializers.DB.First(&user, userID)
+	if user.ID == 0 {
+		fmt.Println("The token does not belong to any user")
+		var attempt models.AuthAttempt
+		attempt.IP = c.ClientIP()
+		attempt.FailureReason = "Token does not belong to any user"
+		initializers.DB.Create(&attempt)
 		c.AbortWithStatus(http.StatusUnauthorized)
-		return
-	}
-	if tokenString == "" {
-		fmt.Println("There is no token")
-		c.AbortWithStatus(http.StatusUnauthorized)
-		return
+		return models.User{}, false
 	}
 
-	//decode
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		// hmacSampleSecret is a []byte containing your secret, e.g. []byte("my_secret_key")
-		return []byte(os.Getenv("JWT_secret")), nil
-	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
-	if err != nil {
-		c.AbortWithStatus(http.StatusUnauthorized)
-		return
+	// suspended and deactivated users have their sessions revoked, this catches any request in between
+	if !internal.UserActive(user) {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": internal.ErrUserInactive.Error()})
+		return models.User{}, false
 	}
 
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		// check exp
-		if float64(time.Now().Unix()) > claims["exp"].(float64) {
-			c.AbortWithStatus(http.StatusUnauthorized)
-			return
-		}
-		//find user with token
-
-		// attach to request
-
-		var user models.User
-		initializers.DB.First(&user, claims["sub"])
-		if user.ID == 0 {
-			var attempt models.AuthAttempt
-			attempt.IP = c.ClientIP()
-			attempt.FailureReason = "Token does not belong to any user"
-			initializers.DB.Create(&attempt)
-			c.AbortWithStatus(http.StatusUnauthorized)
-			return
-		}
+	// an expired password has to be changed before anything else can be done
+	if internal.PasswordExpired(user) && !allowedWithExpiredPassword(c) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+			"error":            "password expired",
+			"password_expired": true,
+		})
+		return models.User{}, false
+	}
 
-		if user.Rights != models.RightsAdmin &&
-			user.Rights != models.RightsDeveloper &&
-			user.Rights != models.RightsOfficeWorker {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Not high enough rights"})
-			return
+	// a developer acting as another user gets that users rights and data, the developer is kept as "realUser"
+	if impersonation, ok := internal.ActiveImpersonation(sessionID); ok {
+		var target models.User
+		if err := initializers.DB.First(&target, impersonation.TargetUserID).Error; err == nil {
+			realUser := user
+			target.ImpersonatorID = &realUser.ID
+			c.Set("realUser", realUser)
+			user = target
+			if blockedWhileImpersonating(c) {
+				c.Set("user", user) // so the refused request is logged as well
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "not allowed while acting as another user"})
+				return models.User{}, false
+			}
 		}
-		c.Set("user", user)
-		c.Next()
-	} else {
-		c.AbortWithStatus(http.StatusUnauthorized)
-		return
 	}
 
+	c.Set("user", user)
+	c.Set("sessionID", sessionID)
+	return user, true
 }
 
-func RequireAuthAuditor(c *gin.Context) {
-	// get cookie
-	tokenString, err := c.Cookie("Authorization")
-	if err != nil {
-		c.AbortWithStatus(http.StatusUnauthorized)
-		return
-	}
-	if tokenString == "" {
-		fmt.Println("There is no token")
-		c.AbortWithStatus(http.StatusUnauthorized)
-		return
+// allowedWithExpiredPassword is true for the routes a user needs to get out of an expired password
+func allowedWithExpiredPassword(c *gin.Context) bool {
+	path := c.FullPath()
+	return strings.HasSuffix(path, "/users/:id/password") || strings.HasSuffix(path, "/logout")
+}
+
+// the credentials of the user cannot be changed by a developer acting as them
+func blockedWhileImpersonating(c *gin.Context) bool {
+	path := c.FullPath()
+	for _, blocked := range []string{"/users/:id/password", "/users/:id/2fa", "/users/:id/sessions"} {
+		if strings.Contains(path, blocked) {
+			return true
+		}
 	}
+	return false
+}
 
-	//decode
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		// hmacSampleSecret is a []byte containing your secret, e.g. []byte("my_secret_key")
-		return []byte(os.Getenv("JWT_secret")), nil
-	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
-	if err != nil {
-		c.AbortWithStatus(http.StatusUnauthorized)
+// RequireAuth lets any logged in user through.
+func RequireAuth(c *gin.Context) {
+	if _, ok := authenticate(c); !ok {
 		return
 	}
+	c.Next()
+}
 
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		// check exp
-		if float64(time.Now().Unix()) > claims["exp"].(float64) {
-			c.AbortWithStatus(http.StatusUnauthorized)
-			return
-		}
-		//find user with token
-
-		// attach to request
-
-		var user models.User
-		initializers.DB.First(&user, claims["sub"])
-		if user.ID == 0 {
-			var attempt models.AuthAttempt
-			attempt.IP = c.ClientIP()
-			attempt.FailureReason = "Token does not belong to any user"
-			initializers.DB.Create(&attempt)
-			c.AbortWithStatus(http.StatusUnauthorized)
+// RequireRights lets the request through if the logged in user has one of the given rights.
+func RequireRights(rights ...models.UserRights) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := authenticate(c)
+		if !ok {
 			return
 		}
-
-		// if auditor is permitted then admin and dev are aswell but not office worker
-		if user.Rights != models.RightsAdmin &&
-			user.Rights != models.RightsDeveloper &&
-			user.Rights != models.RightsAuditor {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Not high enough rights"})
+		if !hasRights(user, rights) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Not high enough rights"})
 			return
 		}
-		c.Set("user", user)
 		c.Next()
-	} else {
-		c.AbortWithStatus(http.StatusUnauthorized)
-		return
 	}
-
 }
 
-func RequireAuthAdmin(c *gin.Context) {
-	// get cookie
-	tokenString, err := c.Cookie("Authorization")
-	if err != nil {
-		c.AbortWithStatus(http.StatusUnauthorized)
-		return
-	}
-	if tokenString == "" {
-		fmt.Println("There is no token")
-		c.AbortWithStatus(http.StatusUnauthorized)
-		return
-	}
-
-	//decode
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		// hmacSampleSecret is a []byte containing your secret, e.g. []byte("my_secret_key")
-		return []byte(os.Getenv("JWT_secret")), nil
-	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
-	if err != nil {
-		c.AbortWithStatus(http.StatusUnauthorized)
-		return
+// RequirePermission looks up which rights are granted the permission in the permission matrix.
+// It panics on an unknown permission so a typo in a route is caught when the server starts.
+// These are the only routes an api key can call, and only if the key is scoped to the permission.
+func RequirePermission(permission Permission) gin.HandlerFunc {
+	rights, ok := permissions[permission]
+	if !ok {
+		panic(fmt.Sprintf("unknown permission %q", permission))
 	}
+	requireRights := RequireRights(rights...)
 
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		// check exp
-		if float64(time.Now().Unix()) > claims["exp"].(float64) {
-			c.AbortWithStatus(http.StatusUnauthorized)
+	return func(c *gin.Context) {
+		key, isKey := apiKeyFromRequest(c)
+		if !isKey {
+			requireRights(c)
 			return
 		}
-		//find user with token
-
-		// attach to request
-
-		var user models.User
-		initializers.DB.First(&user, claims["sub"])
-		if user.ID == 0 {
-			var attempt models.AuthAttempt
-			attempt.IP = c.ClientIP()
-			attempt.FailureReason = "Token does not belong to any user"
-			initializers.DB.Create(&attempt)
-			c.AbortWithStatus(http.StatusUnauthorized)
+
+		apiKey, err := internal.AuthenticateAPIKey(key, c.ClientIP())
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
 			return
 		}
-
-		if user.Rights != models.RightsAdmin &&
-			user.Rights != models.RightsDeveloper {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Not high enough rights"})
+		if !slices.Contains(internal.APIKeyPermissions(apiKey), string(permission)) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "api key is not allowed " + string(permission)})
 			return
 		}
-		c.Set("user", user)
+
+		c.Set("user", internal.APIKeyPrincipal(apiKey))
+		c.Set("apiKey", apiKey)
 		c.Next()
-	} else {
-		c.AbortWithStatus(http.StatusUnauthorized)
-		return
 	}
+}
+
+func hasRights(user models.User, rights []models.UserRights) bool {
+	for _, r := range rights {
+		if user.Rights == r {
+			return true
+		}
+	}
+	return false
+}
 
+// Allowed reports whether the request may perform the action, for checks inside a handler.
+// A request made with an api key is allowed what the key is scoped to, any other request what the rights of the user allow.
+func Allowed(c *gin.Context, permission Permission) bool {
+	if k, ok := c.Get("apiKey"); ok {
+		if apiKey, ok := k.(models.APIKey); ok {
+			return slices.Contains(internal.APIKeyPermissions(apiKey), string(permission))
+		}
+	}
+	u, ok := c.Get("user")
+	if !ok {
+		return false
+	}
+	user, ok := u.(models.User)
+	return ok && HasPermission(user.Rights, permission)
 }
@@ -0,0 +1,45 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// double submit: the token is set in a cookie the frontend can read,
+// and has to be sent back in a header on every request that changes something.
+// A cross site form can make the browser send the cookie, but it cannot read it to fill out the header.
+const CSRFCookieName = "csrf_token"
+const CSRFHeaderName = "X-CSRF-Token"
+
+func NewCSRFToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// ValidCSRF reports whether the request is allowed to change state when it is authenticated by a cookie.
+func ValidCSRF(c *gin.Context) bool {
+	if isSafeMethod(c.Request.Method) {
+		return true
+	}
+	cookie, err := c.Cookie(CSRFCookieName)
+	if err != nil || cookie == "" {
+		return false
+	}
+	header := c.GetHeader(CSRFHeaderName)
+	return subtle.ConstantTimeCompare([]byte(cookie), []byte(header)) == 1
+}
@@ -0,0 +1,13 @@
+package middleware
+
+import "github.com/gin-gonic/gin"
+
+// Deprecated marks a route that is kept for the old frontend, the successor is the route to move to.
+// The headers follow RFC 8594 so clients and proxies can see it without reading the docs.
+func Deprecated(successor string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Deprecation", "true")
+		c.Header("Link", "<"+successor+`>; rel="successor-version"`)
+		c.Next()
+	}
+}
@@ -0,0 +1,254 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/markuskjeldsen/mop-backend-api/internal"
+	"github.com/oschwald/geoip2-golang"
+)
+
+type GeoIPMode string
+
+const (
+	GeoIPEnforce GeoIPMode = "enforce" // requests from other countries are rejected
+	GeoIPLogOnly GeoIPMode = "log"     // requests from other countries are logged but let through, for trying out a policy
+	GeoIPOff     GeoIPMode = "off"     // no country check, bans still apply
+)
+
+// GeoIPPolicy decides which requests are let through based on the country of the ip.
+type GeoIPPolicy struct {
+	Mode             GeoIPMode
+	DBFile           string
+	AllowedCountries []string     // iso codes, e.g. DK
+	TrustedCIDRs     []*net.IPNet // partners calling from abroad, e.g. the webhook ips of the signing provider
+	ExemptPaths      []string     // path prefixes that skip the country check, e.g. /api/v1/penneo/webhook
+	ReloadInterval   time.Duration
+}
+
+// GeoIPPolicyFromEnv reads the policy from the environment, lists are comma separated.
+//
+//	GEOIP_MODE               enforce, log or off, default enforce
+//	GEOIP_DB                 the mmdb file, default ./static/GeoLite2-Country.mmdb
+//	GEOIP_ALLOWED_COUNTRIES  default DK
+//	GEOIP_TRUSTED_CIDRS      ips or cidr ranges that may call from any country
+//	GEOIP_EXEMPT_PATHS       path prefixes that are not checked
+//	GEOIP_RELOAD_INTERVAL    how often the mmdb file is checked for changes, default 1m
+func GeoIPPolicyFromEnv() (GeoIPPolicy, error) {
+	policy := GeoIPPolicy{
+		Mode:             GeoIPMode(strings.ToLower(os.Getenv("GEOIP_MODE"))),
+		DBFile:           os.Getenv("GEOIP_DB"),
+		AllowedCountries: splitList(os.Getenv("GEOIP_ALLOWED_COUNTRIES")),
+		ExemptPaths:      splitList(os.Getenv("GEOIP_EXEMPT_PATHS")),
+		ReloadInterval:   time.Minute,
+	}
+	if policy.Mode == "" {
+		policy.Mode = GeoIPEnforce
+	}
+	if policy.Mode != GeoIPEnforce && policy.Mode != GeoIPLogOnly && policy.Mode != GeoIPOff {
+		return GeoIPPolicy{}, fmt.Errorf("GEOIP_MODE must be enforce, log or off, not %q", policy.Mode)
+	}
+	if policy.DBFile == "" {
+		policy.DBFile = "./static/GeoLite2-Country.mmdb"
+	}
+	if len(policy.AllowedCountries) == 0 {
+		policy.AllowedCountries = []string{"DK"}
+	}
+	for i, country := range policy.AllowedCountries {
+		policy.AllowedCountries[i] = strings.ToUpper(country)
+	}
+
+	for _, value := range splitList(os.Getenv("GEOIP_TRUSTED_CIDRS")) {
+		cidr, err := internal.ParseAllowlistCIDR(value)
+		if err != nil {
+			return GeoIPPolicy{}, fmt.Errorf("GEOIP_TRUSTED_CIDRS: %q: %w", value, err)
+		}
+		_, ipnet, _ := net.ParseCIDR(cidr)
+		policy.TrustedCIDRs = append(policy.TrustedCIDRs, ipnet)
+	}
+
+	if interval := os.Getenv("GEOIP_RELOAD_INTERVAL"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil {
+			return GeoIPPolicy{}, fmt.Errorf("GEOIP_RELOAD_INTERVAL: %w", err)
+		}
+		policy.ReloadInterval = d
+	}
+	return policy, nil
+}
+
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func (p GeoIPPolicy) countryAllowed(isoCode string) bool {
+	for _, country := range p.AllowedCountries {
+		if country == isoCode {
+			return true
+		}
+	}
+	return false
+}
+
+func (p GeoIPPolicy) trusted(ip net.IP) bool {
+	for _, ipnet := range p.TrustedCIDRs {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p GeoIPPolicy) exempt(path string) bool {
+	for _, prefix := range p.ExemptPaths {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// geoIPReader reopens the mmdb file when it changes on disk, so a new database can be dropped in without a restart
+type geoIPReader struct {
+	mu      sync.RWMutex
+	file    string
+	db      *geoip2.Reader
+	modTime time.Time
+}
+
+func openGeoIPReader(file string) (*geoIPReader, error) {
+	r := &geoIPReader{file: file}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *geoIPReader) reload() error {
+	info, err := os.Stat(r.file)
+	if err != nil {
+		return fmt.Errorf("geoip database %s: %w", r.file, err)
+	}
+
+	r.mu.RLock()
+	unchanged := r.db != nil && info.ModTime().Equal(r.modTime)
+	r.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	db, err := geoip2.Open(r.file)
+	if err != nil {
+		return fmt.Errorf("geoip database %s: %w", r.file, err)
+	}
+
+	r.mu.Lock()
+	old := r.db
+	r.db = db
+	r.modTime = info.ModTime()
+	r.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+		slog.Info("reloaded geoip database", slog.String("file", r.file))
+	}
+	return nil
+}
+
+// watch keeps the old database if the new file cannot be opened, e.g. while it is still being copied
+func (r *geoIPReader) watch(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	for range time.Tick(interval) {
+		if err := r.reload(); err != nil {
+			slog.Error("failed to reload geoip database", slog.String("error", err.Error()))
+		}
+	}
+}
+
+func (r *geoIPReader) country(ip net.IP) (string, string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	record, err := r.db.Country(ip)
+	if err != nil {
+		return "", "", err
+	}
+	if record == nil {
+		return "", "", errors.New("no record")
+	}
+	return record.Country.IsoCode, record.Country.Names["en"], nil
+}
+
+// GeoIPBlocker rejects banned ips and, depending on the policy, requests from other countries.
+// It fails if the policy needs the geoip database and it cannot be opened, so a missing file stops the server at startup.
+func GeoIPBlocker(policy GeoIPPolicy) (gin.HandlerFunc, error) {
+	var reader *geoIPReader
+	if policy.Mode != GeoIPOff {
+		var err error
+		reader, err = openGeoIPReader(policy.DBFile)
+		if err != nil {
+			return nil, err
+		}
+		go reader.watch(policy.ReloadInterval)
+	}
+
+	return func(c *gin.Context) {
+		ip := net.ParseIP(c.ClientIP())
+		if (os.Getenv("PRODUCTION")) != "True" && len(c.GetHeader("REAL-IP")) > 4 {
+			ip = net.ParseIP(c.GetHeader("REAL-IP"))
+		}
+		// allowlisted ips are trusted, also from abroad
+		if isLocalIP(ip) || internal.IPAllowlisted(ip) {
+			c.Next()
+			return
+		}
+		if internal.IPBanned(ip) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Access forbidden"})
+			return
+		}
+
+		if policy.Mode == GeoIPOff || policy.trusted(ip) || policy.exempt(c.Request.URL.Path) {
+			c.Next()
+			return
+		}
+
+		isoCode, name, err := reader.country(ip)
+		if err == nil && policy.countryAllowed(isoCode) {
+			c.Next()
+			return
+		}
+
+		attributes := []any{
+			slog.String("ip", ip.String()),
+			slog.String("path", c.Request.URL.Path),
+			slog.String("country", isoCode),
+			slog.String("country_name", name),
+			slog.String("mode", string(policy.Mode)),
+		}
+		if err != nil {
+			attributes = append(attributes, slog.String("error", err.Error()))
+		}
+		slog.Warn("geoip: request from a country that is not allowed", attributes...)
+
+		if policy.Mode == GeoIPLogOnly {
+			c.Next()
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Access forbidden"})
+	}, nil
+}
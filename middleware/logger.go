@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/markuskjeldsen/mop-backend-api/internal"
 	"github.com/markuskjeldsen/mop-backend-api/models"
 )
 
@@ -18,10 +19,18 @@ func RequestLogger() gin.HandlerFunc {
 
 		status := c.Writer.Status()
 		username := "-"
+		impersonator := ""
 
 		if v, ok := c.Get("user"); ok {
 			if u, ok := v.(models.User); ok {
 				username = u.Username
+				// every request made while acting as another user goes in the ActivityLog as well
+				internal.LogImpersonatedRequest(u, c.Request.Method, path, query, status)
+			}
+		}
+		if v, ok := c.Get("realUser"); ok {
+			if u, ok := v.(models.User); ok {
+				impersonator = u.Username
 			}
 		}
 
@@ -36,6 +45,9 @@ func RequestLogger() gin.HandlerFunc {
 			slog.Duration("latency", end),
 			slog.String("user", username),
 		}
+		if impersonator != "" {
+			attributes = append(attributes, slog.String("impersonator", impersonator))
+		}
 
 		if len(c.Errors) > 0 {
 			attributes = append(attributes, slog.String("errors", c.Errors.String()))
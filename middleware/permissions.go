@@ -0,0 +1,111 @@
+package middleware
+
+import (
+	"fmt"
+
+	"github.com/markuskjeldsen/mop-backend-api/internal"
+	"github.com/markuskjeldsen/mop-backend-api/models"
+)
+
+// Permission is a named action that a route can require, e.g. "visits:plan".
+type Permission string
+
+const (
+	PermUsersRead        Permission = "users:read"
+	PermUsersCreate      Permission = "users:create"
+	PermUsersDelete      Permission = "users:delete"
+	PermUsersLifecycle   Permission = "users:lifecycle"   // suspend, deactivate, restore and hand over the visits of a user
+	PermUsersProfile     Permission = "users:profile"     // edit the home base, working hours and regions of a konsulent
+	PermUsersAbsences    Permission = "users:absences"    // register vacation, sickness and blocked days for other users
+	PermUsersSessions    Permission = "users:sessions"    // see and revoke the sessions of other users
+	PermUsers2FAReset    Permission = "users:2fa-reset"   // turn off two factor for a user who lost their phone
+	PermUsersImpersonate Permission = "users:impersonate" // act as another user for support
+
+	PermSecurityBans Permission = "security:bans"  // list, create and lift bans and edit the ip allowlist
+	PermAPIKeys      Permission = "apikeys:manage" // create and revoke api keys for integrations
+
+	PermAchievements Permission = "achievements:manage" // create and change the achievements konsulenter can earn
+
+	PermVisitsRead   Permission = "visits:read"    // every visit regardless of konsulent
+	PermVisitsCreate Permission = "visits:create"  // fetch cases from advopro and create visits
+	PermVisitsPlan   Permission = "visits:plan"    // plan, regroup, redate and reassign visits
+	PermVisitsDelete Permission = "visits:delete"  // delete, see the trash and restore
+	PermVisitsPurge  Permission = "visits:purge"   // remove deleted visits for good
+	PermVisitsLetter Permission = "visits:letter"  // mark the letter as sent
+	PermVisitsReview Permission = "visits:review"  // pdf, advopro note and marking as exported
+	PermVisitTypes   Permission = "visits:types"   // create and change visit types and their rules
+	PermVisitReasons Permission = "visits:reasons" // the catalogue of reasons to cancel or postpone a visit
+)
+
+var rightsDeveloper = []models.UserRights{models.RightsDeveloper}
+
+var rightsAdmin = []models.UserRights{models.RightsDeveloper, models.RightsAdmin}
+
+// the rights that make up the office staff, developer is always included so support can use every endpoint
+var rightsOffice = []models.UserRights{models.RightsDeveloper, models.RightsAdmin, models.RightsOfficeWorker}
+
+// permissions is the single place that decides which rights may perform which action.
+// Adding a role or moving an endpoint between roles should only require a change here.
+var permissions = map[Permission][]models.UserRights{
+	PermUsersRead:        rightsOffice,
+	PermUsersCreate:      rightsOffice,
+	PermUsersDelete:      rightsOffice,
+	PermUsersLifecycle:   rightsOffice,
+	PermUsersProfile:     rightsOffice,
+	PermUsersAbsences:    rightsOffice,
+	PermUsersSessions:    rightsAdmin,
+	PermUsers2FAReset:    rightsAdmin,
+	PermUsersImpersonate: rightsDeveloper,
+	PermSecurityBans:     rightsAdmin,
+	PermAPIKeys:          rightsDeveloper,
+	PermAchievements:     rightsAdmin,
+
+	PermVisitsRead:   rightsOffice,
+	PermVisitsCreate: rightsOffice,
+	PermVisitsPlan:   rightsOffice,
+	PermVisitsDelete: rightsOffice,
+	PermVisitsPurge:  rightsDeveloper,
+	PermVisitsLetter: rightsOffice,
+	PermVisitsReview: rightsOffice,
+	PermVisitTypes:   rightsAdmin,
+	PermVisitReasons: rightsAdmin,
+}
+
+// these rights can write to advopro and manage users, so they have to log in with two factor
+var mfaRequired = []models.UserRights{models.RightsDeveloper, models.RightsAdmin, models.RightsOfficeWorker}
+
+// MFARequired reports whether users with the given rights must have two factor enabled to log in.
+func MFARequired(rights models.UserRights) bool {
+	for _, r := range mfaRequired {
+		if r == rights {
+			return true
+		}
+	}
+	return false
+}
+
+// HasPermission reports whether a user with the given rights is granted the permission.
+func HasPermission(rights models.UserRights, permission Permission) bool {
+	for _, r := range permissions[permission] {
+		if r == rights {
+			return true
+		}
+	}
+	return false
+}
+
+// APIKeyPermission reports whether an api key may be scoped to the permission.
+// Keys cannot manage keys, so a leaked key cannot be used to mint new ones, and they cannot act as a user.
+func APIKeyPermission(permission Permission) bool {
+	_, known := permissions[permission]
+	return known && permission != PermAPIKeys && permission != PermUsersImpersonate
+}
+
+// the visit status graph names its permissions, a typo there would otherwise only show when a visit is refused
+func init() {
+	for _, t := range internal.VisitTransitions() {
+		if _, ok := permissions[Permission(t.Permission)]; !ok {
+			panic(fmt.Sprintf("visit transition %q needs the unknown permission %q", t.Name, t.Permission))
+		}
+	}
+}
@@ -1,16 +1,15 @@
 package middleware
 
 import (
-	"fmt"
 	"net"
 	"net/http"
-	"os"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/markuskjeldsen/mop-backend-api/initializers"
+	"github.com/markuskjeldsen/mop-backend-api/internal"
 	"github.com/markuskjeldsen/mop-backend-api/models"
-	"github.com/oschwald/geoip2-golang"
 )
 
 type BodyLogin struct {
@@ -47,26 +46,96 @@ func LoginAttemptLog(c *gin.Context) {
 	attempt.Successful = false
 	attempt.FailureReason = "Failed to bind values"
 
-	var userCount, ipCount int64
-	initializers.DB.Model(&models.LoginAttempt{}).
-		Where("username = ?  AND created_at > ?", body.Username, time.Now().Add(-12*time.Hour)).
-		Count(&userCount)
-
-	initializers.DB.Model(&models.LoginAttempt{}).
-		Where("ip = ? AND created_at > ?", addr, time.Now().Add(-12*time.Hour)).
-		Count(&ipCount)
-
-	if userCount >= 20 || ipCount >= 30 {
-		attempt.FailureReason = "Too many requests"
+	if ban, banned := loginBan(body.Username, addr); banned {
+		attempt.FailureReason = internal.FailureTooManyRequests
 		initializers.DB.Create(&attempt)
-		c.AbortWithStatus(http.StatusTooManyRequests)
+		abortBanned(c, ban)
 		return
 	}
 
 	initializers.DB.Create(&attempt)
 	c.Set("attemptID", attempt.ID)
-	attempt.FailureReason = "Failed to bind values"
 	c.Next()
+
+	// the handler has written the outcome to the attempt, failures count towards a lockout
+	initializers.DB.First(&attempt, attempt.ID)
+	if !attempt.Successful {
+		internal.RegisterLoginFailure(body.Username, addr)
+	}
+}
+
+// loginBan finds a ban on the username or the ip, the username is checked first since it is the more specific one
+func loginBan(username string, ip string) (models.Ban, bool) {
+	if username != "" {
+		if ban, banned := internal.ActiveBan(models.BanKindUsername, username); banned {
+			return ban, true
+		}
+	}
+	if internal.IPAllowlisted(net.ParseIP(ip)) {
+		return models.Ban{}, false
+	}
+	return internal.ActiveBan(models.BanKindIP, ip)
+}
+
+// abortBanned tells the client how long to wait, a ban without expiry has no Retry-After
+func abortBanned(c *gin.Context, ban models.Ban) {
+	resp := gin.H{"error": "too many failed attempts, try again later"}
+	if ban.ExpiresAt != nil {
+		seconds := int(time.Until(*ban.ExpiresAt).Seconds()) + 1
+		c.Header("Retry-After", strconv.Itoa(seconds))
+		resp["retry_after"] = seconds
+	}
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, resp)
+}
+
+// PasswordResetAttemptLog rate limits the password reset endpoints the same way LoginAttemptLog does for logins.
+// The attempts are stored as LoginAttempts with the given step, the handler updates the outcome through "attemptID".
+func PasswordResetAttemptLog(step string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// only the forgot endpoint has a username, the reset endpoint is limited by ip alone
+		var body struct {
+			Username string `json:"username"`
+		}
+		c.ShouldBindBodyWithJSON(&body)
+
+		addr := c.ClientIP()
+		var attempt models.LoginAttempt
+		attempt.Username = body.Username
+		attempt.IP = addr
+		attempt.Successful = false
+		attempt.Step = step
+		attempt.FailureReason = "Failed to bind values"
+
+		if ban, banned := loginBan("", addr); banned {
+			attempt.FailureReason = internal.FailureTooManyRequests
+			initializers.DB.Create(&attempt)
+			abortBanned(c, ban)
+			return
+		}
+
+		resetSteps := []string{models.LoginStepResetRequest, models.LoginStepReset}
+		var userCount, ipCount int64
+		if body.Username != "" {
+			initializers.DB.Model(&models.LoginAttempt{}).
+				Where("username = ? AND step IN ? AND created_at > ?", body.Username, resetSteps, time.Now().Add(-12*time.Hour)).
+				Count(&userCount)
+		}
+
+		initializers.DB.Model(&models.LoginAttempt{}).
+			Where("ip = ? AND step IN ? AND created_at > ?", addr, resetSteps, time.Now().Add(-12*time.Hour)).
+			Count(&ipCount)
+
+		if userCount >= 5 || ipCount >= 20 {
+			attempt.FailureReason = internal.FailureTooManyRequests
+			initializers.DB.Create(&attempt)
+			c.AbortWithStatus(http.StatusTooManyRequests)
+			return
+		}
+
+		initializers.DB.Create(&attempt)
+		c.Set("attemptID", attempt.ID)
+		c.Next()
+	}
 }
 
 func isLocalIP(ip net.IP) bool {
@@ -94,43 +163,3 @@ func isLocalIP(ip net.IP) bool {
 	}
 	return false
 }
-
-func isBannedIP(ip net.IP) bool {
-	var attempt models.AuthAttempt
-	initializers.DB.First(&attempt).Where("ip = ? AND created_at > ?", ip, time.Now().Add(-12*time.Hour))
-	return attempt.ID != 0 // if id is not zero then its banned
-}
-
-func GeoIPBlocker(allowedCountry string, dbFile string) gin.HandlerFunc {
-	db, _ := geoip2.Open(dbFile)
-	return func(c *gin.Context) {
-		ip := net.ParseIP(c.ClientIP())
-		if (os.Getenv("PRODUCTION")) != "True" && len(c.GetHeader("REAL-IP")) > 4 {
-			ip = net.ParseIP(c.GetHeader("REAL-IP"))
-		}
-		if isLocalIP(ip) {
-			c.Next()
-			return
-		}
-		if isBannedIP(ip) {
-			c.AbortWithStatusJSON(403, gin.H{"error": "Access forbidden"})
-			return
-		}
-
-		record, err := db.Country(ip)
-		if err != nil {
-			c.AbortWithStatusJSON(500, gin.H{"error": "geo lookup failed"})
-			return
-		}
-		if record == nil || record.Country.IsoCode != allowedCountry {
-			name := record.Country.Names["en"] // or pick from Accept-Language
-			if name == "" {
-				name = record.Country.IsoCode
-			}
-			fmt.Printf("IP: %s Country: %s (%s)\n", ip, name, record.Country.IsoCode)
-			c.AbortWithStatusJSON(403, gin.H{"error": "Access forbidden"})
-			return
-		}
-		c.Next()
-	}
-}
@@ -9,8 +9,10 @@ import (
 	"time"
 
 	"github.com/markuskjeldsen/mop-backend-api/initializers"
+	"github.com/markuskjeldsen/mop-backend-api/internal"
 	"github.com/markuskjeldsen/mop-backend-api/models"
 	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
 )
 
 // ptr is a generic helper that returns a pointer to the value passed in
@@ -88,11 +90,44 @@ func migrateTables() {
 		&models.VisitType{},
 		&models.ActivityLog{},
 		&models.VisitLog{},
+		&models.Session{},
+		&models.PasswordResetToken{},
+		&models.PasswordHistory{},
+		&models.Ban{},
+		&models.AllowlistEntry{},
+		&models.APIKey{},
+		&models.OIDCLoginState{},
+		&models.Impersonation{},
+		&models.KonsulentProfile{},
+		&models.KonsulentWorkingHours{},
+		&models.KonsulentRegion{},
+		&models.Absence{},
+		&models.Achievement{},
+		&models.UserAchievement{},
+		&models.FollowUpProposal{},
+		&models.VisitReasonCode{},
+		&models.VisitCancellation{},
+		&models.VisitResponseVersion{},
+		&models.VisitResponseEdit{},
+		&models.VisitResponseDraft{},
 	)
 	if err != nil {
 		fmt.Println(err.Error())
 		return
 	}
+	if err := restrictUserVisits(); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	seedAchievements()
+	activateOldVisitTypes()
+	seedRevisitTypes()
+	seedCancelledStatus()
+	seedReasonCodes()
+	if err := internal.SetupVisitSearch(initializers.DB); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
 	fmt.Println("Migration went well")
 }
 
@@ -134,14 +169,36 @@ func fullreset() {
 	initializers.DB.Exec("DROP TABLE IF EXISTS visits;")
 	initializers.DB.Exec("DROP TABLE IF EXISTS visit_statuses;")
 	initializers.DB.Exec("DROP TABLE IF EXISTS visit_status_logs;")
+	initializers.DB.Exec("DROP TABLE IF EXISTS visit_logs;")
 
 	initializers.DB.Exec("DROP TABLE IF EXISTS login_attempts;")
 	initializers.DB.Exec("DROP TABLE IF EXISTS auth_attempt;")
+	initializers.DB.Exec("DROP TABLE IF EXISTS sessions;")
+	initializers.DB.Exec("DROP TABLE IF EXISTS password_reset_tokens;")
+	initializers.DB.Exec("DROP TABLE IF EXISTS password_histories;")
+	initializers.DB.Exec("DROP TABLE IF EXISTS bans;")
+	initializers.DB.Exec("DROP TABLE IF EXISTS allowlist_entries;")
+	initializers.DB.Exec("DROP TABLE IF EXISTS api_keys;")
+	initializers.DB.Exec("DROP TABLE IF EXISTS oidc_login_states;")
+	initializers.DB.Exec("DROP TABLE IF EXISTS impersonations;")
+	initializers.DB.Exec("DROP TABLE IF EXISTS konsulent_profiles;")
+	initializers.DB.Exec("DROP TABLE IF EXISTS konsulent_working_hours;")
+	initializers.DB.Exec("DROP TABLE IF EXISTS konsulent_regions;")
+	initializers.DB.Exec("DROP TABLE IF EXISTS absences;")
+	initializers.DB.Exec("DROP TABLE IF EXISTS achievements;")
+	initializers.DB.Exec("DROP TABLE IF EXISTS user_achievements;")
+	initializers.DB.Exec("DROP TABLE IF EXISTS follow_up_proposals;")
+	initializers.DB.Exec("DROP TABLE IF EXISTS visit_reason_codes;")
+	initializers.DB.Exec("DROP TABLE IF EXISTS visit_cancellations;")
+	initializers.DB.Exec("DROP TABLE IF EXISTS visit_response_versions;")
+	initializers.DB.Exec("DROP TABLE IF EXISTS visit_response_edits;")
+	initializers.DB.Exec("DROP TABLE IF EXISTS visit_response_drafts;")
 
 	initializers.DB.Exec("DROP TABLE IF EXISTS visit_responses;")
 	initializers.DB.Exec("DROP TABLE IF EXISTS visit_response_images;")
 
 	initializers.DB.Exec("DROP TABLE IF EXISTS visit_types;")
+	initializers.DB.Exec("DROP TABLE IF EXISTS visit_search;")
 
 	initializers.DB.Exec("PRAGMA foreign_keys = ON;")
 
@@ -157,6 +214,27 @@ func fullreset() {
 		&models.AuthAttempt{},
 		&models.VisitType{},
 		&models.ActivityLog{},
+		&models.VisitLog{},
+		&models.Session{},
+		&models.PasswordResetToken{},
+		&models.PasswordHistory{},
+		&models.Ban{},
+		&models.AllowlistEntry{},
+		&models.APIKey{},
+		&models.OIDCLoginState{},
+		&models.Impersonation{},
+		&models.KonsulentProfile{},
+		&models.KonsulentWorkingHours{},
+		&models.KonsulentRegion{},
+		&models.Absence{},
+		&models.Achievement{},
+		&models.UserAchievement{},
+		&models.FollowUpProposal{},
+		&models.VisitReasonCode{},
+		&models.VisitCancellation{},
+		&models.VisitResponseVersion{},
+		&models.VisitResponseEdit{},
+		&models.VisitResponseDraft{},
 	)
 
 	initializers.DB.Create(&status1)
@@ -164,6 +242,10 @@ func fullreset() {
 	initializers.DB.Create(&status3)
 	initializers.DB.Create(&status4)
 	initializers.DB.Create(&status5)
+	seedCancelledStatus()
+
+	seedAchievements()
+	seedReasonCodes()
 
 	//Hash the password
 	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte(user.Password), 14)
@@ -181,6 +263,7 @@ func fullreset() {
 	initializers.DB.Create(&type2)
 	initializers.DB.Create(&type3)
 	initializers.DB.Create(&type4)
+	seedRevisitTypes()
 
 	//create debitors
 	initializers.DB.Create(&db1)
@@ -238,6 +321,123 @@ func fullreset() {
 		initializers.DB.Create(&visitResponse4) // Save the visit response to the database
 	*/
 
+	if err := internal.SetupVisitSearch(initializers.DB); err != nil {
+		fmt.Println(err.Error())
+	}
+}
+
+// the achievements a new database starts with, existing ones are left alone so changes made by an admin are kept
+var achievements = []models.Achievement{
+	{Key: "first_visit", Name: "Første besøg", Description: "Lav dit første besøg", Badge: "door", Metric: models.MetricVisits, Threshold: 1, Active: true},
+	{Key: "visits_100", Name: "100 besøg", Description: "Lav 100 besøg", Badge: "medal", Metric: models.MetricVisits, Threshold: 100, Active: true},
+	{Key: "first_asset", Name: "Første bil hjem", Description: "Få det første aktiv ind", Badge: "car", Metric: models.MetricAssetsRecovered, Threshold: 1, Active: true},
+	{Key: "assets_25", Name: "25 biler hjem", Description: "Få 25 aktiver ind", Badge: "trophy", Metric: models.MetricAssetsRecovered, Threshold: 25, Active: true},
+	{Key: "payments_100k", Name: "100.000 kr", Description: "Modtag betalinger for i alt 100.000 kr", Badge: "coins", Metric: models.MetricPaymentAmount, Threshold: 100000, Active: true},
+}
+
+// the revisit types from the README, added by name so a database that already has them is left alone
+var revisitTypes = []models.VisitType{
+	{
+		Text:               "uanmeldt genbesøg",
+		Description:        "Et uanmeldt besøg indenfor 10 dage af det seneste anmeldte besøg på sagen",
+		Unannounced:        true,
+		Revisit:            true,
+		RevisitOfAnnounced: true,
+		RevisitMinDays:     1,
+		RevisitMaxDays:     10,
+		ServiceMinutes:     10,
+		Active:             true,
+	},
+	{
+		Text:           "anmeldt genbesøg",
+		Description:    "Et nyt anmeldt besøg på en sag der allerede har haft et besøg",
+		MinNoticeDays:  5,
+		Revisit:        true,
+		RevisitMinDays: 1,
+		Active:         true,
+	},
+}
+
+// visit types from before they could be turned off got the active column empty, they are all in use
+func activateOldVisitTypes() {
+	initializers.DB.Model(&models.VisitType{}).Where("active IS NULL").Update("active", true)
+}
+
+// restrictUserVisits rebuilds the visits table of databases made while deleting a user deleted their visits.
+// AutoMigrate does not change the foreign keys of an existing sqlite table, so it is done here the way sqlite
+// describes it: a new table is made, the rows copied over and it takes the place of the old one.
+func restrictUserVisits() error {
+	var onDelete string
+	initializers.DB.Raw(`SELECT on_delete FROM pragma_foreign_key_list('visits') WHERE "table" = 'users'`).Scan(&onDelete)
+	if onDelete != "CASCADE" {
+		return nil
+	}
+	fmt.Println("Rebuilding visits so deleting a user does not delete their visits")
+
+	// the pragma only holds for one connection, and dropping the old table must not cascade to the responses
+	return initializers.DB.Connection(func(db *gorm.DB) error {
+		if err := db.Exec("PRAGMA foreign_keys = OFF").Error; err != nil {
+			return err
+		}
+		defer db.Exec("PRAGMA foreign_keys = ON")
+
+		return db.Transaction(func(tx *gorm.DB) error {
+			var table string
+			if err := tx.Raw("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'visits'").Scan(&table).Error; err != nil {
+				return err
+			}
+			restricted := strings.Replace(table, "REFERENCES `users`(`id`) ON DELETE CASCADE", "REFERENCES `users`(`id`) ON DELETE RESTRICT", 1)
+			if restricted == table {
+				return fmt.Errorf("visits: the foreign key to users was not found in %q", table)
+			}
+			restricted = strings.Replace(restricted, "CREATE TABLE `visits`", "CREATE TABLE `visits__new`", 1)
+
+			// the indexes and triggers go with the old table, and triggers elsewhere that read visits stop the rename
+			// while it is gone, they are all made again once the new table is in place
+			var triggers []struct{ Name, SQL string }
+			if err := tx.Raw("SELECT name, sql FROM sqlite_master WHERE type = 'trigger' AND (tbl_name = 'visits' OR sql LIKE '%visits%')").Scan(&triggers).Error; err != nil {
+				return err
+			}
+			var indexes []string
+			if err := tx.Raw("SELECT sql FROM sqlite_master WHERE tbl_name = 'visits' AND type = 'index' AND sql IS NOT NULL").Scan(&indexes).Error; err != nil {
+				return err
+			}
+
+			queries := []string{restricted, "INSERT INTO `visits__new` SELECT * FROM `visits`"}
+			for _, t := range triggers {
+				queries = append(queries, "DROP TRIGGER `"+t.Name+"`")
+			}
+			queries = append(queries, "DROP TABLE `visits`", "ALTER TABLE `visits__new` RENAME TO `visits`")
+			queries = append(queries, indexes...)
+			for _, t := range triggers {
+				queries = append(queries, t.SQL)
+			}
+			for _, query := range queries {
+				if err := tx.Exec(query).Error; err != nil {
+					return err
+				}
+			}
+
+			var broken int64
+			tx.Raw("SELECT count(*) FROM pragma_foreign_key_check('visits')").Scan(&broken)
+			if broken > 0 {
+				return fmt.Errorf("visits: %d rows point at something that does not exist", broken)
+			}
+			return nil
+		})
+	})
+}
+
+func seedRevisitTypes() {
+	for _, t := range revisitTypes {
+		initializers.DB.Where(models.VisitType{Text: t.Text}).Attrs(t).FirstOrCreate(&models.VisitType{})
+	}
+}
+
+func seedAchievements() {
+	for _, a := range achievements {
+		initializers.DB.Where(models.Achievement{Key: a.Key}).Attrs(a).FirstOrCreate(&models.Achievement{})
+	}
 }
 
 // placeholder information
@@ -256,12 +456,39 @@ var status4 = models.VisitStatus{
 var status5 = models.VisitStatus{
 	Text: "exported",
 }
+var status6 = models.VisitStatus{
+	Model: gorm.Model{ID: models.VisitStatusCancelled},
+	Text:  "cancelled",
+}
+
+// the cancelled status came after the first five, so an existing database gets it with the id the code expects
+func seedCancelledStatus() {
+	initializers.DB.Where(models.VisitStatus{Model: gorm.Model{ID: status6.ID}}).Attrs(status6).FirstOrCreate(&models.VisitStatus{})
+}
+
+// the reason codes a new database starts with, an admin can add more and turn these off
+var reasonCodes = []models.VisitReasonCode{
+	{Code: "paid_in_full", Text: "Betalt fuldt ud", Kind: models.ReasonCancel, Active: true},
+	{Code: "closed_in_advopro", Text: "Sagen er lukket i AdvoPro", Kind: models.ReasonCancel, Active: true},
+	{Code: "debitor_moved", Text: "Debitor er flyttet", Kind: models.ReasonCancel, Active: true},
+	{Code: "debitor_deceased", Text: "Debitor er død", Kind: models.ReasonCancel, Active: true},
+	{Code: "konsulent_sick", Text: "Konsulenten er syg", Kind: models.ReasonPostpone, Active: true},
+	{Code: "debitor_request", Text: "Debitor har bedt om en anden dag", Kind: models.ReasonPostpone, Active: true},
+	{Code: "route_full", Text: "Ruten blev for lang", Kind: models.ReasonPostpone, Active: true},
+}
+
+func seedReasonCodes() {
+	for _, r := range reasonCodes {
+		initializers.DB.Where(models.VisitReasonCode{Code: r.Code}).Attrs(r).FirstOrCreate(&models.VisitReasonCode{})
+	}
+}
 
 var type1 = models.VisitType{
 	Text: "købekontrakt",
 	Description: `En købekontrakt betyder at bilen ejes af debitor. 
 	Debitor skylder dog penge som han har brugt på bilen. 
 	Det er derfor vigtigt at vide hvordan bilen har det og om han har solgt eller andet`,
+	Active: true,
 }
 
 var type2 = models.VisitType{
@@ -269,17 +496,20 @@ var type2 = models.VisitType{
 	Description: `En Leasing aftale betyder at bilen ikke ejes af debitor. 
 	Det betyder at man godt bare må tage bilen. 
 	Det er derfor vigtigt at vide hvordan bilen har det, og evt. hvor den er nu`,
+	Active: true,
 }
 
 var type3 = models.VisitType{
 	Text: "blanco",
 	Description: `En blanco aftale betyder at man bare skal have penge ud af debitor.
 	Det betyder at det er vigtigt at finde ud af hvor rig personen er, og hvor godt de kan betale en gæld tilbage`,
+	Active: true,
 }
 
 var type4 = models.VisitType{
 	Text:        "brev",
 	Description: `Dette betyder at vi bare gerne vil aflevere et brev, evt. tage et billede af postkassen eller mangel derpå`,
+	Active:      true,
 }
 
 var root = models.User{
@@ -36,6 +36,16 @@ const (
 	RightsNone         UserRights = "none"
 )
 
+// UserStatus is where a user is in their employment, only active users can log in.
+// Users are never deleted so their visits and logs keep pointing at someone.
+type UserStatus string
+
+const (
+	UserStatusActive      UserStatus = "active"
+	UserStatusSuspended   UserStatus = "suspended"   // temporarily blocked, e.g. on leave
+	UserStatusDeactivated UserStatus = "deactivated" // has left the company
+)
+
 type CivilStatus string
 
 const (
@@ -70,7 +80,217 @@ type User struct {
 	Rights   UserRights `json:"rights" gorm:"default:user"`
 	Email    string     `json:"email"`
 	Phone    string     `json:"phone"`
-	Visits   []Visit    `json:"visits" gorm:"foreignKey:UserID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	Visits   []Visit    `json:"visits" gorm:"foreignKey:UserID;constraint:OnUpdate:CASCADE,OnDelete:RESTRICT;"`
+
+	Status          UserStatus `json:"status" gorm:"not null;default:active;index"`
+	StatusReason    string     `json:"status_reason"`
+	StatusChangedAt *time.Time `json:"status_changed_at"`
+
+	// the user has chosen to be shown on the leaderboard to the rest of the team
+	LeaderboardOptIn bool `json:"leaderboard_opt_in" gorm:"not null;default:false"`
+
+	PasswordChangedAt *time.Time `json:"password_changed_at"`
+
+	// two factor, the secret is set when enrolment starts and only used once TOTPEnabled is true
+	TOTPSecret        string         `json:"-"`
+	TOTPEnabled       bool           `json:"totp_enabled" gorm:"not null;default:false"`
+	TOTPLastStep      int64          `json:"-"` // time step of the last accepted code, so a code cannot be replayed
+	TOTPRecoveryCodes datatypes.JSON `json:"-"` // sha256 hashes of the unused recovery codes
+
+	// the subject of the company directory account, set on the first single sign-on login
+	OIDCSubject *string `json:"-" gorm:"column:oidc_subject;uniqueIndex:ux_users_oidc_subject_active,where:deleted_at IS NULL"`
+	// the rights follow the groups in the directory, only for users created by single sign-on
+	OIDCRights bool `json:"oidc_rights" gorm:"column:oidc_rights;not null;default:false"`
+
+	// set when the request was made with an api key, the user is then not a row in the table but stands in for the key
+	APIKeyID *uint `json:"-" gorm:"-"`
+	// set when a developer is acting as this user, it is the id of the developer
+	ImpersonatorID *uint `json:"-" gorm:"-"`
+}
+
+// KonsulentProfile is what planning needs to know about a konsulent.
+// Days without working hours are days off, and a konsulent without regions covers every postnr.
+type KonsulentProfile struct {
+	gorm.Model
+	UserID          uint                    `json:"user_id" gorm:"not null;uniqueIndex"`
+	StartAddress    string                  `json:"start_address"` // where the day starts, usually home
+	StartLatitude   float64                 `json:"start_latitude"`
+	StartLongitude  float64                 `json:"start_longitude"`
+	MaxVisitsPerDay int                     `json:"max_visits_per_day"` // 0 is no limit
+	WorkingHours    []KonsulentWorkingHours `json:"working_hours" gorm:"foreignKey:ProfileID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	Regions         []KonsulentRegion       `json:"regions" gorm:"foreignKey:ProfileID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+}
+
+type KonsulentWorkingHours struct {
+	gorm.Model
+	ProfileID uint         `json:"-" gorm:"not null;index"`
+	Weekday   time.Weekday `json:"weekday"` // 0 is sunday, 1 is monday
+	Start     string       `json:"start"`   // 15:04
+	End       string       `json:"end"`
+}
+
+// KonsulentRegion is a range of postnr, both ends included, e.g. 8000-8999 for Aarhus
+type KonsulentRegion struct {
+	gorm.Model
+	ProfileID  uint `json:"-" gorm:"not null;index"`
+	PostnrFrom int  `json:"postnr_from"`
+	PostnrTo   int  `json:"postnr_to"`
+}
+
+// StatsMetric is a number from the personal statistics that achievements and the leaderboard can use.
+type StatsMetric string
+
+const (
+	MetricVisits          StatsMetric = "visits"           // visits with a response
+	MetricDebitorHome     StatsMetric = "debitor_home"     // visits where the debitor was home
+	MetricPayments        StatsMetric = "payments"         // visits where a payment was received
+	MetricPaymentAmount   StatsMetric = "payment_amount"   // kroner received
+	MetricAssetsRecovered StatsMetric = "assets_recovered" // assets delivered, e.g. cars brought in
+	MetricExported        StatsMetric = "exported"         // visits reviewed and exported to advopro
+)
+
+// Achievement is a badge a konsulent gets when a metric reaches the threshold over all time.
+type Achievement struct {
+	gorm.Model
+	Key         string      `json:"key" gorm:"not null;uniqueIndex"`
+	Name        string      `json:"name" gorm:"not null"`
+	Description string      `json:"description"`
+	Badge       string      `json:"badge"` // the icon the frontend shows
+	Metric      StatsMetric `json:"metric" gorm:"not null"`
+	Threshold   float64     `json:"threshold" gorm:"not null"`
+	Active      bool        `json:"active" gorm:"not null"` // no default, gorm would store a false as true
+}
+
+// UserAchievement is an achievement a user has earned, it is kept when the achievement is changed later.
+type UserAchievement struct {
+	gorm.Model
+	UserID        uint        `json:"user_id" gorm:"not null;uniqueIndex:ux_user_achievement"`
+	AchievementID uint        `json:"achievement_id" gorm:"not null;uniqueIndex:ux_user_achievement"`
+	Achievement   Achievement `json:"achievement"`
+	AwardedAt     time.Time   `json:"awarded_at"`
+}
+
+type AbsenceType string
+
+const (
+	AbsenceVacation AbsenceType = "vacation"
+	AbsenceSick     AbsenceType = "sick"
+	AbsenceBlocked  AbsenceType = "blocked" // e.g. training or other work, the konsulent cannot take visits
+	AbsenceOther    AbsenceType = "other"
+)
+
+// Absence is a range of days a konsulent cannot be given visits, both days included.
+type Absence struct {
+	gorm.Model
+	UserID      uint        `json:"user_id" gorm:"not null;index"`
+	Type        AbsenceType `json:"type" gorm:"not null"`
+	StartDate   time.Time   `json:"start_date" gorm:"type:date;not null;index"`
+	EndDate     time.Time   `json:"end_date" gorm:"type:date;not null;index"`
+	Note        string      `json:"note"`
+	CreatedByID uint        `json:"created_by_id"`
+}
+
+// Impersonation lets a developer see the api as another user for a limited time, to help with support.
+// It belongs to the developers session, so ending the session also ends it.
+type Impersonation struct {
+	gorm.Model
+	SessionID    uint       `json:"session_id" gorm:"not null;index"`
+	RealUserID   uint       `json:"real_user_id" gorm:"not null;index"`
+	TargetUserID uint       `json:"target_user_id" gorm:"not null;index"`
+	Reason       string     `json:"reason" gorm:"not null"`
+	ExpiresAt    time.Time  `json:"expires_at" gorm:"not null"`
+	EndedAt      *time.Time `json:"ended_at"`
+}
+
+// OIDCLoginState is a single sign-on login that has been sent to the identity provider and not come back yet.
+type OIDCLoginState struct {
+	gorm.Model
+	StateHash    string    `json:"-" gorm:"not null;uniqueIndex"`
+	CodeVerifier string    `json:"-" gorm:"not null"` // pkce, only this server knows it
+	Nonce        string    `json:"-" gorm:"not null"`
+	RedirectTo   string    `json:"redirect_to"`
+	ExpiresAt    time.Time `json:"expires_at" gorm:"not null"`
+}
+
+// gorm would name the table o_id_c_login_states
+func (OIDCLoginState) TableName() string {
+	return "oidc_login_states"
+}
+
+// APIKey lets an integration call the endpoints of its permissions without borrowing a users login.
+// Only the hash of the key is kept, the key itself is shown once when it is created.
+type APIKey struct {
+	gorm.Model
+	Name        string         `json:"name" gorm:"not null"`
+	Prefix      string         `json:"prefix" gorm:"not null"` // the start of the key, so it can be recognised in a list
+	KeyHash     string         `json:"-" gorm:"not null;uniqueIndex"`
+	Permissions datatypes.JSON `json:"permissions"` // list of permission names, e.g. ["visits:plan"]
+	ExpiresAt   *time.Time     `json:"expires_at"`  // nil never expires
+	LastUsedAt  *time.Time     `json:"last_used_at"`
+	LastUsedIP  string         `json:"last_used_ip" gorm:"size:45"`
+	CreatedByID uint           `json:"created_by_id"`
+	RevokedAt   *time.Time     `json:"revoked_at"`
+}
+
+// Session is a login on a device. The refresh token is rotated on every use, so only its hash is kept.
+// An access token carries the session id and stops working as soon as the session is revoked.
+type Session struct {
+	gorm.Model
+	UserID            uint       `json:"user_id" gorm:"not null;index"`
+	RefreshTokenHash  string     `json:"-" gorm:"not null;uniqueIndex"`
+	PreviousTokenHash string     `json:"-" gorm:"index"` // the token before the latest rotation, used to detect reuse
+	IP                string     `json:"ip" gorm:"size:45"`
+	UserAgent         string     `json:"user_agent"`
+	ExpiresAt         time.Time  `json:"expires_at" gorm:"not null"`
+	LastUsedAt        time.Time  `json:"last_used_at"`
+	RevokedAt         *time.Time `json:"revoked_at"`
+	RevokedReason     string     `json:"revoked_reason"`
+}
+
+// PasswordResetToken is a single use token mailed to a user who forgot their password. Only its hash is kept.
+type PasswordResetToken struct {
+	gorm.Model
+	UserID    uint       `json:"user_id" gorm:"not null;index"`
+	TokenHash string     `json:"-" gorm:"not null;uniqueIndex"`
+	ExpiresAt time.Time  `json:"expires_at" gorm:"not null"`
+	UsedAt    *time.Time `json:"used_at"`
+	IP        string     `json:"ip" gorm:"size:45"`
+}
+
+// PasswordHistory keeps the hashes of a users latest passwords so they cannot be reused.
+type PasswordHistory struct {
+	gorm.Model
+	UserID uint   `json:"user_id" gorm:"not null;index"`
+	Hash   string `json:"-" gorm:"not null"`
+}
+
+// Ban blocks logins from a username or every request from an ip until it expires or is lifted.
+// Bans are created automatically by the lockout after repeated failed logins, or by an admin.
+type Ban struct {
+	gorm.Model
+	Kind        BanKind    `json:"kind" gorm:"not null;index:idx_ban_value,priority:1"`
+	Value       string     `json:"value" gorm:"not null;index:idx_ban_value,priority:2"` // the ip or username
+	Reason      string     `json:"reason"`
+	ExpiresAt   *time.Time `json:"expires_at"` // nil means the ban lasts until it is lifted
+	Automatic   bool       `json:"automatic"`
+	CreatedByID *uint      `json:"created_by_id"`
+	LiftedAt    *time.Time `json:"lifted_at"`
+	LiftedByID  *uint      `json:"lifted_by_id"`
+}
+
+type BanKind string
+
+const (
+	BanKindIP       BanKind = "ip"
+	BanKindUsername BanKind = "username"
+)
+
+// AllowlistEntry is an ip or cidr range that is never banned, for the office network and the like.
+type AllowlistEntry struct {
+	gorm.Model
+	CIDR        string `json:"cidr" gorm:"not null;uniqueIndex"`
+	Note        string `json:"note"`
+	CreatedByID uint   `json:"created_by_id"`
 }
 
 type AuthAttempt struct {
@@ -89,8 +309,19 @@ type LoginAttempt struct {
 	IP            string         `gorm:"size:45;not null"`
 	Successful    bool           `gorm:"not null"`
 	FailureReason string         `json:"failure_reason"`
+	Step          string         `json:"step" gorm:"not null;default:password"` // one of the LoginStep constants
 }
 
+const (
+	LoginStepPassword     = "password"
+	LoginStepTOTP         = "totp"
+	LoginStepRecoveryCode = "recovery_code"
+	LoginStepTOTPEnrol    = "totp_enrol"
+	LoginStepResetRequest = "reset_request" // asked for a password reset mail
+	LoginStepReset        = "reset"         // used the token from the mail
+	LoginStepOIDC         = "oidc"          // single sign-on through the company directory
+)
+
 type Debitor struct {
 	gorm.Model
 	Name             string    `json:"name" gorm:"not null"`
@@ -117,6 +348,47 @@ type VisitStatus struct {
 	Description string `json:"description"`
 }
 
+// the ids of the statuses seeded by migrate, the allowed changes between them are in internal/visitStatus.go
+const (
+	VisitStatusNotPlanned   uint = 1
+	VisitStatusPlanned      uint = 2
+	VisitStatusReadyToVisit uint = 3 // the letter has been sent
+	VisitStatusToReview     uint = 4 // the konsulent has made a response
+	VisitStatusExported     uint = 5
+	VisitStatusCancelled    uint = 6 // taken out of the pipeline with a reason, see VisitCancellation
+)
+
+// ReasonKind says whether a reason code is for cancelling or postponing a visit.
+type ReasonKind string
+
+const (
+	ReasonCancel   ReasonKind = "cancel"
+	ReasonPostpone ReasonKind = "postpone"
+)
+
+// VisitReasonCode is an entry in the catalogue of why a visit is cancelled or postponed, e.g. paid in full.
+type VisitReasonCode struct {
+	gorm.Model
+	Code   string     `json:"code" gorm:"uniqueIndex;not null"`
+	Text   string     `json:"text"`
+	Kind   ReasonKind `json:"kind" gorm:"not null"`
+	Active bool       `json:"active" gorm:"not null"`
+}
+
+// VisitCancellation records that a visit was cancelled or postponed, and what it was planned as before.
+type VisitCancellation struct {
+	gorm.Model
+	VisitID         uint            `json:"visit_id" gorm:"not null;index"`
+	Kind            ReasonKind      `json:"kind" gorm:"not null"`
+	ReasonCodeID    uint            `json:"reason_code_id" gorm:"not null"`
+	ReasonCode      VisitReasonCode `json:"reason_code"`
+	Note            string          `json:"note"`
+	PreviousStatus  uint            `json:"previous_status_id"`
+	PreviousDate    time.Time       `json:"previous_date" gorm:"type:date"`
+	PreviousGroupID *uint           `json:"previous_group_id"`
+	CreatedByID     uint            `json:"created_by_id"`
+}
+
 type VisitStatusLog struct {
 	gorm.Model
 	VisitID     uint      `json:"visit_id" gorm:"not null"`
@@ -124,6 +396,7 @@ type VisitStatusLog struct {
 	NewStatusID uint      `json:"new_status_id"`
 	ChangedAt   time.Time `json:"changed_at" gorm:"autoCreateTime"`
 	ChangedByID uint      `json:"changed_by_id"` // Optionally, reference User.ID
+	APIKeyID    *uint     `json:"api_key_id"`    // set when the change was made with an api key
 }
 
 type VisitLog struct {
@@ -134,12 +407,34 @@ type VisitLog struct {
 	ValType     string    `json:"val_type"`
 	ChangedAt   time.Time `json:"changed_at" gorm:"autoCreateTime"`
 	ChangedByID uint      `json:"changed_by_id"`
+	APIKeyID    *uint     `json:"api_key_id"` // set when the change was made with an api key
 }
 
+// VisitType is both what the visit is about and the rules for when it may take place.
+// An announced visit needs a letter before it, an unannounced one does not.
+// A revisit type can only be used for a case that already had a visit, within a window of days after it.
 type VisitType struct {
 	gorm.Model
-	Text        string `json:"text"`
-	Description string `json:"description"`
+	Text               string `json:"text"`
+	Description        string `json:"description"`
+	Unannounced        bool   `json:"unannounced"`          // no letter is sent before the visit
+	MinNoticeDays      int    `json:"min_notice_days"`      // days from planning to the visit date, so the letter can arrive
+	Revisit            bool   `json:"revisit"`              // needs an earlier performed visit of the same sagsnr
+	RevisitOfAnnounced bool   `json:"revisit_of_announced"` // the earlier visit must have been announced
+	RevisitMinDays     int    `json:"revisit_min_days"`     // days after the earlier visit, 0 means the same day is allowed
+	RevisitMaxDays     int    `json:"revisit_max_days"`     // 0 means no limit
+	ServiceMinutes     int    `json:"service_minutes"`      // the default time spent at the address, 0 means 15
+	Active             bool   `json:"active"`
+}
+
+// DefaultServiceMinutes is used for visit types that do not set their own service time.
+const DefaultServiceMinutes = 15
+
+func (t VisitType) ServiceTime() int {
+	if t.ServiceMinutes > 0 {
+		return t.ServiceMinutes
+	}
+	return DefaultServiceMinutes
 }
 
 type Visit struct {
@@ -170,6 +465,43 @@ type Visit struct {
 	AdvoproKlient       string `json:"advopro_klient"`
 	// a new type of ID for grouping
 	GroupId *uint `json:"group_id"`
+	// the visit this one follows up on, e.g. when the debitor was not home
+	ParentVisitID *uint `json:"parent_visit_id" gorm:"index"`
+}
+
+// FollowUpKind is what a FollowUpProposal suggests.
+type FollowUpKind string
+
+const (
+	FollowUpRevisit   FollowUpKind = "unannounced_revisit" // visit again unannounced within the window of the visit type
+	FollowUpOtherTime FollowUpKind = "other_time"          // a new visit at another time of day
+	FollowUpEscalate  FollowUpKind = "escalate"            // the office has to decide, no visit is created
+)
+
+type FollowUpStatus string
+
+const (
+	FollowUpPending   FollowUpStatus = "pending"
+	FollowUpAccepted  FollowUpStatus = "accepted"
+	FollowUpDismissed FollowUpStatus = "dismissed"
+)
+
+// FollowUpProposal is a visit the system suggests after a response, waiting for the office to accept or dismiss it.
+type FollowUpProposal struct {
+	gorm.Model
+	VisitID         uint           `json:"visit_id" gorm:"not null;uniqueIndex:idx_followup_visit_kind"`
+	Visit           Visit          `json:"visit"`
+	Kind            FollowUpKind   `json:"kind" gorm:"not null;uniqueIndex:idx_followup_visit_kind"`
+	Reason          string         `json:"reason"`
+	VisitTypeID     *uint          `json:"visit_type_id"` // the type the new visit gets, nil keeps the type of the visit
+	EarliestDate    *time.Time     `json:"earliest_date" gorm:"type:date"`
+	LatestDate      *time.Time     `json:"latest_date" gorm:"type:date"`
+	PreferredTime   string         `json:"preferred_time"` // e.g. "17:00 - 20:00"
+	Status          FollowUpStatus `json:"status" gorm:"not null;default:pending;index"`
+	DecidedByID     *uint          `json:"decided_by_id"`
+	DecidedAt       *time.Time     `json:"decided_at"`
+	DismissedReason string         `json:"dismissed_reason"`
+	CreatedVisitID  *uint          `json:"created_visit_id"`
 }
 
 type VisitResponse struct {
@@ -244,6 +576,54 @@ type VisitResponse struct {
 	Comments string `json:"comments"` // free text field for comments
 	// images
 	Images []VisitResponseImage `json:"images" gorm:"foreignKey:VisitResponseID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+
+	Version int `json:"version" gorm:"not null;default:1"` // counts up with every edit, see VisitResponseVersion
+}
+
+// VisitResponseDraft is a response the konsulent is still filling out, saved as they go so it survives a dead phone.
+// The fields do not have to be complete until it is submitted and becomes the VisitResponse.
+type VisitResponseDraft struct {
+	gorm.Model
+	VisitID  uint           `json:"visit_id" gorm:"not null;uniqueIndex"`
+	UserID   uint           `json:"user_id" gorm:"not null"`
+	Data     datatypes.JSON `json:"data"`     // the fields saved so far, by their json names on VisitResponse
+	Revision int            `json:"revision"` // counts the saves, a client can send it back to not overwrite a newer save
+}
+
+// VisitResponseVersion is a revision of a response as it was saved, versions are never changed or removed.
+type VisitResponseVersion struct {
+	gorm.Model
+	VisitResponseID uint           `json:"visit_response_id" gorm:"not null;uniqueIndex:idx_response_version"`
+	VisitID         uint           `json:"visit_id" gorm:"not null;index"`
+	Version         int            `json:"version" gorm:"not null;uniqueIndex:idx_response_version"`
+	Snapshot        datatypes.JSON `json:"snapshot"` // the whole response as of this version
+	Changes         datatypes.JSON `json:"changes"`  // the fields that changed from the version before, empty for the first
+	CreatedByID     uint           `json:"created_by_id"`
+	EditID          *uint          `json:"edit_id"` // the approved edit this version came from
+}
+
+type ResponseEditStatus string
+
+const (
+	ResponseEditPending  ResponseEditStatus = "pending"
+	ResponseEditApproved ResponseEditStatus = "approved"
+	ResponseEditRejected ResponseEditStatus = "rejected"
+)
+
+// VisitResponseEdit is a change to the response of an exported visit, it is only applied when the office approves it.
+type VisitResponseEdit struct {
+	gorm.Model
+	VisitResponseID uint               `json:"visit_response_id" gorm:"not null;index"`
+	VisitID         uint               `json:"visit_id" gorm:"not null"`
+	BaseVersion     int                `json:"base_version"` // the version the change was made against
+	Patch           datatypes.JSON     `json:"patch"`
+	Changes         datatypes.JSON     `json:"changes"`
+	Status          ResponseEditStatus `json:"status" gorm:"not null;default:pending;index"`
+	RequestedByID   uint               `json:"requested_by_id"`
+	DecidedByID     *uint              `json:"decided_by_id"`
+	DecidedAt       *time.Time         `json:"decided_at"`
+	RejectedReason  string             `json:"rejected_reason"`
+	Version         *int               `json:"version"` // the version it became when approved
 }
 
 type VisitResponseImage struct {
@@ -255,11 +635,13 @@ type VisitResponseImage struct {
 
 type ActivityLog struct {
 	gorm.Model
-	ActingUserID uint           `json:"acting_user_id"`
-	TargetID     uint           `json:"target_id"`
-	TargetIDType string         `json:"target_id_type"`
-	ActionType   string         `json:"action_type"`
-	ColumnType   string         `json:"column_type"`
-	PrevVal      datatypes.JSON `json:"prev_val"`
-	CurrentVal   datatypes.JSON `json:"current_val"`
+	ActingUserID   uint           `json:"acting_user_id"`
+	APIKeyID       *uint          `json:"api_key_id"`      // set instead of ActingUserID when the action was made with an api key
+	ImpersonatorID *uint          `json:"impersonator_id"` // the developer acting as ActingUserID
+	TargetID       uint           `json:"target_id"`
+	TargetIDType   string         `json:"target_id_type"`
+	ActionType     string         `json:"action_type"`
+	ColumnType     string         `json:"column_type"`
+	PrevVal        datatypes.JSON `json:"prev_val"`
+	CurrentVal     datatypes.JSON `json:"current_val"`
 }